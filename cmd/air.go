@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// airSettleTime is skipped after start, as delta swings while the collector heats up.
+const airSettleTime = 5 * time.Minute
+
+type airSample struct {
+	at    time.Time
+	delta float64
+	flow  float64
+}
+
+var (
+	airSamples []airSample
+	airInLoop  bool
+
+	airInLoopMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "air_in_loop",
+		Help:      "Set when oscillating delta and unstable flow indicate air in the loop, which should be bled",
+	})
+)
+
+// observeAir collects delta and measured flow of a running circuit in steady state and checks them for the signature
+// of air pockets once a full window is collected. Alert is cleared after a full window without the signature.
+func observeAir(delta float64, measuredFlow homeassistant.Entity, now time.Time) {
+	detection := controllerCfg().Maintenance.AirDetection
+	if detection.Swings == 0 {
+		return
+	}
+	if !circuitRunning || coolingDown || preCirculating || time.Since(runningSince) < airSettleTime {
+		airSamples = airSamples[:0]
+		return
+	}
+
+	window := detection.GetWindow()
+	airSamples = append(airSamples, airSample{at: now, delta: delta, flow: measuredFlow.Value})
+	if now.Sub(airSamples[0].at) < window {
+		return
+	}
+	for len(airSamples) > 0 && now.Sub(airSamples[0].at) > window {
+		airSamples = airSamples[1:]
+	}
+
+	swings := deltaSwings(airSamples, detection.GetAmplitude())
+	detected := swings >= detection.Swings
+	reason := fmt.Sprintf("delta reversed %d times by %.1f within %s", swings, detection.GetAmplitude(), window)
+	if measuredFlow.EntityID != "" && detected {
+		variation := flowVariation(airSamples)
+		detected = !measuredFlow.Stale && variation >= detection.GetFlowVariation()
+		reason = fmt.Sprintf("%s and measured flow varies by %.0f%%", reason, variation*100)
+	}
+	if detected == airInLoop {
+		return
+	}
+	airInLoop = detected
+	systemStatus.AirInLoop = detected
+
+	state := "off"
+	if detected {
+		state = "on"
+		airInLoopMetric.Set(1)
+		log.Printf("Air in the loop suspected, %s. Bleed the loop", reason)
+		notifyEvent(config.EventAirInLoop)
+	} else {
+		airInLoopMetric.Set(0)
+		log.Println("Delta is stable again, air in the loop is no longer suspected")
+	}
+
+	entity := detection.EntityID
+	if entity == "" {
+		return
+	}
+	attributes := map[string]interface{}{
+		"friendly_name": "Solar loop needs bleeding",
+		"reason":        reason,
+	}
+	sendToHA("publish air in loop state", func(c *homeassistant.Client) error {
+		return c.PublishState(entity, state, attributes)
+	})
+}
+
+// deltaSwings counts reversals of delta direction by at least amplitude.
+func deltaSwings(samples []airSample, amplitude float64) int {
+	if len(samples) == 0 {
+		return 0
+	}
+	swings, direction := 0, 0
+	high, low := samples[0].delta, samples[0].delta
+	for _, s := range samples[1:] {
+		high, low = math.Max(high, s.delta), math.Min(low, s.delta)
+		if direction >= 0 && s.delta <= high-amplitude {
+			if direction > 0 {
+				swings++
+			}
+			direction, low = -1, s.delta
+		} else if direction <= 0 && s.delta >= low+amplitude {
+			if direction < 0 {
+				swings++
+			}
+			direction, high = 1, s.delta
+		}
+	}
+	return swings
+}
+
+// flowVariation returns relative standard deviation of measured flow.
+func flowVariation(samples []airSample) float64 {
+	var sum, sumSq float64
+	for _, s := range samples {
+		sum += s.flow
+		sumSq += s.flow * s.flow
+	}
+	n := float64(len(samples))
+	mean := sum / n
+	if mean <= 0 {
+		return 0
+	}
+	return math.Sqrt(math.Max(0, sumSq/n-mean*mean)) / mean
+}
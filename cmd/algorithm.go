@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Control algorithms which can be switched at runtime to compare them day by day. Legacy makes decisions on raw
+// temperature delta with linear flow only. Adaptive smooths delta over DeltaWindow and boosts flow for DHW
+// recirculation.
+const (
+	algorithmLegacy   = "legacy"
+	algorithmAdaptive = "adaptive"
+)
+
+type algorithm struct {
+	smoothing bool
+	dhwBoost  bool
+}
+
+var algorithms = map[string]algorithm{
+	algorithmLegacy:   {},
+	algorithmAdaptive: {smoothing: true, dhwBoost: true},
+}
+
+var (
+	algorithmMu     sync.Mutex
+	activeAlgorithm = algorithmAdaptive
+
+	algorithmActiveMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "algorithm_active",
+		Help:      "Control algorithm which is currently active",
+	}, []string{"algorithm"})
+)
+
+// setAlgorithm switches control algorithm used from the next control loop iteration.
+func setAlgorithm(name string) error {
+	if _, ok := algorithms[name]; !ok {
+		return fmt.Errorf("unknown algorithm %s", name)
+	}
+
+	algorithmMu.Lock()
+	defer algorithmMu.Unlock()
+	if name != activeAlgorithm {
+		log.Printf("Switching control algorithm from %s to %s", activeAlgorithm, name)
+		algorithmActiveMetric.WithLabelValues(activeAlgorithm).Set(0)
+	}
+	activeAlgorithm = name
+	systemStatus.Algorithm = name
+	algorithmActiveMetric.WithLabelValues(name).Set(1)
+	return nil
+}
+
+// currentAlgorithm returns parameters of active control algorithm.
+func currentAlgorithm() algorithm {
+	algorithmMu.Lock()
+	defer algorithmMu.Unlock()
+	return algorithms[activeAlgorithm]
+}
+
+// syncAlgorithmFromHA follows the algorithm selected in Home Assistant, which takes precedence over the flag.
+func syncAlgorithmFromHA() {
+	entity := controllerCfg().AlgorithmEntity
+	if entity == "" {
+		return
+	}
+
+	selected, err := hass().GetState(entity)
+	if err != nil {
+		log.Printf("Could not get control algorithm from HomeAssistant: %v", err)
+		return
+	}
+	if err := setAlgorithm(selected); err != nil {
+		log.Printf("Could not switch to control algorithm selected in HomeAssistant: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+)
+
+const (
+	baselineKey = "harvestBaseline"
+	// baselineWeight of a new day in hourly baseline. It makes the baseline follow seasons over a few weeks.
+	baselineWeight = 0.1
+	// anomalyThreshold is a score above which a day is flagged as underperforming.
+	anomalyThreshold = 0.5
+)
+
+// harvestBaseline is a seasonal baseline of temperature delta while harvesting for every hour of the day. Hours when
+// circuit is not running count as zero delta.
+type harvestBaseline struct {
+	Hours [24]float64 `json:"hours"`
+	// Days is the number of days the baseline was learned from.
+	Days int `json:"days"`
+}
+
+var (
+	baseline harvestBaseline
+	// Current hour accumulator.
+	hourStart time.Time
+	hourSum   float64
+	hourCount int
+	// Hourly means of the current day.
+	dayHours [24]float64
+	dayStart time.Time
+	// partialDay is set for the day controller started in. It is neither flagged nor learned.
+	partialDay bool
+
+	anomalyScoreMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "harvest_anomaly_score",
+		Help:      "Relative underperformance of harvest today compared to seasonal baseline, 0 is normal and 1 means no harvest",
+	})
+	harvestAnomalyMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "harvest_anomaly",
+		Help:      "Set when previous day significantly underperformed seasonal baseline",
+	})
+)
+
+// loadBaseline restores harvest baseline from the state store.
+func loadBaseline() {
+	if _, err := stateStore.Get(baselineKey, &baseline); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("Restored harvest baseline learned from %d day(s)", baseline.Days)
+}
+
+// storeBaseline puts harvest baseline into the state store.
+func storeBaseline() {
+	if err := stateStore.Set(baselineKey, baseline); err != nil {
+		log.Println(err)
+	}
+}
+
+// resetHarvestHour drops samples of the current hour and makes the current day partial.
+func resetHarvestHour() {
+	hourStart, hourSum, hourCount = time.Time{}, 0, 0
+	dayHours = [24]float64{}
+}
+
+// observeHarvest accumulates delta samples into hourly means and evaluates anomaly score on every hour change.
+func observeHarvest(delta float64, now time.Time) {
+	sample := 0.0
+	if circuitRunning && delta > 0 {
+		sample = delta
+	}
+
+	hour := now.Truncate(time.Hour)
+	if hourStart.IsZero() {
+		hourStart = hour
+		dayStart = startOfDay(now)
+		partialDay = true
+	}
+	if hour.Equal(hourStart) {
+		hourSum += sample
+		hourCount++
+		return
+	}
+
+	if hourCount > 0 {
+		dayHours[hourStart.Hour()] = hourSum / float64(hourCount)
+	}
+	score := anomalyScore(hourStart.Hour())
+	anomalyScoreMetric.Set(score)
+
+	if day := startOfDay(now); !day.Equal(dayStart) {
+		previousDayScore = score
+		if !partialDay {
+			finishDay(score)
+		}
+		dayStart, partialDay = day, false
+		dayHours = [24]float64{}
+	}
+
+	hourStart, hourSum, hourCount = hour, sample, 1
+}
+
+// anomalyScore compares harvest of the current day up to the given hour with the baseline.
+func anomalyScore(lastHour int) float64 {
+	var actual, expected float64
+	for h := 0; h <= lastHour; h++ {
+		actual += dayHours[h]
+		expected += baseline.Hours[h]
+	}
+	if baseline.Days == 0 || expected <= 0 {
+		return 0
+	}
+
+	score := 1 - actual/expected
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// finishDay flags underperforming day and learns it into the baseline.
+func finishDay(score float64) {
+	if score >= anomalyThreshold {
+		log.Printf("Harvest was %.0f%% below seasonal baseline today", score*100)
+		harvestAnomalyMetric.Set(1)
+		notifyEvent(config.EventHarvestAnomaly)
+	} else {
+		harvestAnomalyMetric.Set(0)
+	}
+
+	for h := range baseline.Hours {
+		if baseline.Days == 0 {
+			baseline.Hours[h] = dayHours[h]
+		} else {
+			baseline.Hours[h] += baselineWeight * (dayHours[h] - baseline.Hours[h])
+		}
+	}
+	baseline.Days++
+	storeBaseline()
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
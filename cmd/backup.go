@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/backup"
+	"github.com/automatedhome/solar/pkg/config"
+)
+
+const (
+	backupConfigFile = "config.yaml"
+	backupStateFile  = "state.json"
+	// maxBackupSize limits size of backup accepted for restore.
+	maxBackupSize = 32 << 20
+	// restoreExitCode makes process supervisor restart the controller with restored files.
+	restoreExitCode = 3
+)
+
+var (
+	// configPath is a file the configuration was read from, empty when it was given in SOLAR_CONFIG_JSON.
+	configPath string
+	// backupKeyFile holds passphrase encrypting backups, empty disables them.
+	backupKeyFile string
+	// stateFrozen stops state persistence once restored state was written, so it is not overwritten before restart.
+	stateFrozen int32
+)
+
+func readBackupKey() (string, error) {
+	data, err := ioutil.ReadFile(backupKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read backup passphrase: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// httpBackup serves encrypted backup of configuration file and controller state, including persistent counters, on
+// GET and restores it on POST. Restored controller exits to be restarted with restored files by its supervisor.
+func httpBackup(w http.ResponseWriter, r *http.Request) {
+	if backupKeyFile == "" {
+		http.Error(w, "backups are disabled", http.StatusNotFound)
+		return
+	}
+	passphrase, err := readBackupKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sendBackup(w, passphrase)
+	case http.MethodPost:
+		restoreBackup(w, r, passphrase)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sendBackup(w http.ResponseWriter, passphrase string) {
+	cfg, _, err := config.Read(&configPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	storeCounters()
+	state, err := stateStore.Export()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := backup.Write(&buf, passphrase, map[string][]byte{backupConfigFile: cfg, backupStateFile: state}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := fmt.Sprintf("solar-backup-%s.bin", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Println(err)
+	}
+}
+
+type restoreResponse struct {
+	Restored   []string `json:"restored"`
+	Restarting bool     `json:"restarting"`
+	Warning    string   `json:"warning,omitempty"`
+}
+
+func restoreBackup(w http.ResponseWriter, r *http.Request, passphrase string) {
+	files, err := backup.Read(http.MaxBytesReader(w, r.Body, maxBackupSize), passphrase)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg, state := files[backupConfigFile], files[backupStateFile]
+	if cfg == nil || state == nil {
+		http.Error(w, fmt.Sprintf("backup has to contain %s and %s", backupConfigFile, backupStateFile), http.StatusBadRequest)
+		return
+	}
+	if _, err := config.Parse(cfg); err != nil {
+		http.Error(w, fmt.Sprintf("backup contains %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Configuration is often mounted read-only, so it is written only when it differs. Configuration given in
+	// environment is left to the deployment.
+	resp := restoreResponse{Restored: []string{backupStateFile}, Restarting: true}
+	current, _, err := config.Read(&configPath)
+	if err != nil || !bytes.Equal(current, cfg) {
+		if configPath == "" {
+			resp.Warning = fmt.Sprintf("configuration in backup differs from %s, which has to be updated in deployment", config.EnvConfig)
+		} else if err := writeFileAtomic(configPath, cfg); err != nil {
+			http.Error(w, fmt.Sprintf("could not write configuration: %v", err), http.StatusInternalServerError)
+			return
+		} else {
+			resp.Restored = append(resp.Restored, backupConfigFile)
+		}
+	}
+	atomic.StoreInt32(&stateFrozen, 1)
+	if err := stateStore.Restore(state); err != nil {
+		atomic.StoreInt32(&stateFrozen, 0)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Backup restored, exiting to restart with restored configuration and state")
+	if resp.Warning != "" {
+		log.Println(resp.Warning)
+	}
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(js); err != nil {
+		log.Println(err)
+	}
+
+	go func() {
+		// Give the response a moment to reach the client
+		time.Sleep(1 * time.Second)
+		attempt("switch pump off", safeState)
+		os.Exit(restoreExitCode)
+	}()
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
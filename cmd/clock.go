@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// clockJumpThreshold is a difference between wall clock and monotonic time elapsed between iterations which is
+// reported as a wall clock jump, e.g. on NTP sync after boot of a board without RTC.
+const clockJumpThreshold = 10 * time.Second
+
+var (
+	lastClockCheck time.Time
+
+	clockJumpsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "clock_jumps_total",
+		Help:      "Increase when wall clock jumped between control loop iterations",
+	})
+)
+
+// checkClock detects wall clock jumps between iterations. Durations and deadlines, like reduced mode window, are
+// measured on monotonic clock and are not affected. Hourly aggregates started before the jump would be attributed
+// to wrong hours, so they are dropped.
+func checkClock(now time.Time) {
+	prev := lastClockCheck
+	lastClockCheck = now
+	if prev.IsZero() {
+		return
+	}
+
+	// Round(0) strips monotonic reading, so the first difference is measured on wall clock
+	skew := now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+	if skew > -clockJumpThreshold && skew < clockJumpThreshold {
+		return
+	}
+	log.Printf("Wall clock jumped by %s to %s, dropping hourly aggregates of the current hour", skew, now.Format(time.RFC3339))
+	clockJumpsTotal.Inc()
+	trend = hourAggregate{}
+	resetHarvestHour()
+}
+
+// wallTime returns t on current wall clock. Time taken before a wall clock jump keeps wall reading from before the
+// jump, only monotonic time elapsed since then is reliable. It has to be used whenever time is persisted or shown.
+func wallTime(t time.Time) time.Time {
+	return time.Now().Add(-time.Since(t))
+}
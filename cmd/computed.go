@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/expr"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+type computedSensor struct {
+	name string
+	expr *expr.Expr
+}
+
+var (
+	// computedMu guards compiled expressions, which are evaluated both by the control loop and on sensor updates.
+	computedMu       sync.Mutex
+	computedSensors  []computedSensor
+	deltaExpr        *expr.Expr
+	startExpr        *expr.Expr
+	computedCompiled *config.Config
+
+	computedSensorMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "computed_sensor_value",
+		Help:      "Value of a computed sensor",
+	}, []string{"sensor"})
+	streamDeltaMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "temperature_delta_stream_celsius",
+		Help:      "Temperature delta computed on every sensor update, independently of the control loop",
+	})
+)
+
+// compileComputed prepares computed sensors and delta expression of running configuration. They are compiled
+// again only when configuration changes.
+func compileComputed() {
+	if computedCompiled == runningConfig() {
+		return
+	}
+	computedCompiled = runningConfig()
+
+	computedSensorMetric.Reset()
+	computedSensors = nil
+	for _, sensor := range runningConfig().Computed {
+		// Configuration is validated when loaded, so this can't fail.
+		e, err := expr.Parse(sensor.Expr)
+		if err != nil {
+			log.Printf("Skipping computed sensor %s: %v", sensor.Name, err)
+			continue
+		}
+		computedSensors = append(computedSensors, computedSensor{name: sensor.Name, expr: e})
+	}
+
+	deltaExpr = nil
+	if src := runningConfig().Controller.Delta; src != "" {
+		e, err := expr.Parse(src)
+		if err != nil {
+			log.Printf("Using default delta, could not parse %q: %v", src, err)
+		} else {
+			deltaExpr = e
+		}
+	}
+
+	startExpr = nil
+	if src := runningConfig().Controller.StartCondition; src != "" {
+		e, err := expr.Parse(src)
+		if err != nil {
+			log.Printf("Using default start condition, could not parse %q: %v", src, err)
+		} else {
+			startExpr = e
+		}
+	}
+}
+
+// sensorValues returns readings of real sensors together with values of computed sensors.
+func sensorValues(s *evok.Sensors) map[string]float64 {
+	computedMu.Lock()
+	defer computedMu.Unlock()
+	compileComputed()
+
+	values := s.Values()
+	for _, sensor := range computedSensors {
+		v, err := sensor.expr.Eval(values)
+		if err != nil {
+			log.Printf("Could not compute sensor %s: %v", sensor.name, err)
+			continue
+		}
+		values[sensor.name] = v
+		computedSensorMetric.WithLabelValues(sensor.name).Set(v)
+	}
+	return values
+}
+
+// rawDelta computes temperature delta from configured expression or from the default formula.
+func rawDelta(s *evok.Sensors, values map[string]float64) float64 {
+	computedMu.Lock()
+	defer computedMu.Unlock()
+	if deltaExpr != nil {
+		delta, err := deltaExpr.Eval(values)
+		if err == nil {
+			return delta
+		}
+		log.Printf("Could not compute delta, using default formula: %v", err)
+	}
+	return (s.SolarUp.Value+s.SolarOut.Value)/2 - s.SolarIn.Value
+}
+
+// startCondition evaluates configured start condition over rule variables, or the default one: delta at least
+// solarOn and collector hotter than its outlet. Reason describes values the condition was evaluated with.
+func startCondition(vars map[string]float64, s *evok.Sensors, cfg homeassistant.Settings, delta float64) (bool, string) {
+	computedMu.Lock()
+	e := startExpr
+	computedMu.Unlock()
+	if e != nil {
+		v, err := e.Eval(vars)
+		if err == nil {
+			if v != 0 {
+				return true, fmt.Sprintf("start condition %s holds", e)
+			}
+			return false, fmt.Sprintf("start condition %s doesn't hold", e)
+		}
+		log.Printf("Could not evaluate start condition, using default: %v", err)
+	}
+
+	if delta >= cfg.SolarOn.Value && s.SolarUp.Value > s.SolarOut.Value {
+		return true, fmt.Sprintf("delta %.1f ≥ solarOn %.1f and solarUp %.1f > solarOut %.1f", delta, cfg.SolarOn.Value, s.SolarUp.Value, s.SolarOut.Value)
+	}
+	return false, fmt.Sprintf("delta %.1f, solarOn %.1f, solarUp %.1f, solarOut %.1f", delta, cfg.SolarOn.Value, s.SolarUp.Value, s.SolarOut.Value)
+}
+
+// exportOnUpdate makes client export computed sensors and delta on every sensor update, so metrics have higher
+// resolution than the control loop.
+func exportOnUpdate(client *evok.Client) {
+	client.SetUpdateHook(func() {
+		s := client.GetSensors()
+		streamDeltaMetric.Set(rawDelta(s, sensorValues(s)))
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const countersKey = "counters"
+
+// persistentCounters holds counters restored from and saved to the state store, keyed by metric name.
+var persistentCounters = make(map[string]*persistentCounter)
+
+// persistentCounter is a Prometheus counter whose value survives process restarts.
+type persistentCounter struct {
+	prometheus.Counter
+	mu    sync.Mutex
+	value float64
+}
+
+func newPersistentCounter(opts prometheus.CounterOpts) *persistentCounter {
+	c := &persistentCounter{Counter: promauto.NewCounter(opts)}
+	persistentCounters[prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)] = c
+	return c
+}
+
+func (c *persistentCounter) Inc() {
+	c.Add(1)
+}
+
+func (c *persistentCounter) Add(v float64) {
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+	c.Counter.Add(v)
+}
+
+func (c *persistentCounter) get() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+// loadCounters restores persistent counters from the state store.
+func loadCounters() {
+	values := make(map[string]float64)
+	if _, err := stateStore.Get(countersKey, &values); err != nil {
+		log.Println(err)
+		return
+	}
+
+	for name, value := range values {
+		if c, ok := persistentCounters[name]; ok {
+			c.Add(value)
+		}
+	}
+	log.Printf("Restored %d counter(s) from state", len(values))
+}
+
+// storeCounters puts persistent counters values into the state store.
+func storeCounters() {
+	values := make(map[string]float64, len(persistentCounters))
+	for name, c := range persistentCounters {
+		values[name] = c.get()
+	}
+	if err := stateStore.Set(countersKey, values); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+var (
+	// crashDir is a directory where crash reports are written, empty disables them.
+	crashDir string
+	// crashMu is never unlocked, so only the first of concurrently panicking goroutines handles the crash.
+	crashMu sync.Mutex
+)
+
+// recoverCrash handles panic of a long running goroutine. It has to be deferred directly at the top of the goroutine.
+func recoverCrash(where string) {
+	if r := recover(); r != nil {
+		crashed(where, r)
+	}
+}
+
+// recoverClientCrash makes panic of client receiving goroutine handled as a crash of the controller.
+func recoverClientCrash(client *evok.Client) {
+	client.SetPanicHook(func(r interface{}) { crashed("websocket messages", r) })
+}
+
+// crashed switches the pump off, writes a crash report and exits. Continuing after a panic would leave the control
+// loop in an unknown state, so the process is restarted by its supervisor instead.
+func crashed(where string, r interface{}) {
+	stack := debug.Stack()
+	crashMu.Lock()
+
+	log.Printf("Panic in %s: %v\n%s", where, r, stack)
+	attempt("switch pump off", safeState)
+	attempt("persist controller state", func() { persistState(true) })
+	attempt("write crash report", func() { writeCrashReport(where, r, stack) })
+	os.Exit(2)
+}
+
+// attempt runs f, which may panic again as the controller is in an unknown state.
+func attempt(what string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Could not %s after panic: %v", what, r)
+		}
+	}()
+	f()
+}
+
+// safeState switches off the pump and then the switching valve, so the circuit stays stopped until restart.
+func safeState() {
+	if evokClient() == nil {
+		return
+	}
+	act := evokClient().GetActuators()
+	for _, dev := range []evok.Device{act.Pump, act.Switch} {
+		if err := evokClient().SetValue(dev.Dev, dev.Circuit, 0); err != nil {
+			log.Println(err)
+		}
+	}
+	markStopped()
+}
+
+func writeCrashReport(where string, r interface{}, stack []byte) {
+	if crashDir == "" {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Time: %s\nGoroutine: %s\nIteration: %s\nPanic: %v\n\n", time.Now().Format(time.RFC3339), where, iterationID, r)
+	if status, err := json.MarshalIndent(systemStatus, "", "  "); err == nil {
+		fmt.Fprintf(&b, "Status:\n%s\n\n", status)
+	}
+	decisionMu.Lock()
+	last, err := json.MarshalIndent(lastDecision, "", "  ")
+	decisionMu.Unlock()
+	if err == nil {
+		fmt.Fprintf(&b, "Last decision:\n%s\n\n", last)
+	}
+	if evokClient() != nil {
+		if sensors, err := json.MarshalIndent(evokClient().GetSensors(), "", "  "); err == nil {
+			fmt.Fprintf(&b, "Sensors:\n%s\n\n", sensors)
+		}
+	}
+	fmt.Fprintf(&b, "Stack:\n%s", stack)
+
+	path := filepath.Join(crashDir, fmt.Sprintf("crash-%s.txt", time.Now().Format("20060102-150405")))
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		log.Printf("Could not write crash report: %v", err)
+		return
+	}
+	log.Printf("Crash report written to %s", path)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+const ctlUsage = `Usage: solar ctl [--address host:port] <command> [flags]
+
+Commands:
+  status                          Print controller status
+  override --flow DUTY --for DUR  Override flow duty in percent for a duration
+  override --clear                Clear flow override
+  override                        Print flow override
+  events                          Print recent events`
+
+// runCtl implements "ctl" subcommand, a client of the HTTP API of a running controller, so it can be operated from
+// scripts. Responses are printed as JSON. Exit code is 1 when the request fails and 2 on wrong usage.
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	address := fs.String("address", "localhost"+httpAddress, "HTTP address of the controller")
+	timeout := fs.Duration("timeout", 10*time.Second, "Request timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	method, path, body := http.MethodGet, "", []byte(nil)
+	switch fs.Arg(0) {
+	case "status":
+		path = "/status"
+	case "events":
+		path = "/api/v1/events"
+	case "override":
+		path = "/api/v1/override"
+		ofs := flag.NewFlagSet("override", flag.ExitOnError)
+		flow := ofs.Float64("flow", -1, "Flow duty in percent")
+		duration := ofs.Duration("for", 0, "How long override lasts")
+		clear := ofs.Bool("clear", false, "Clear override")
+		if err := ofs.Parse(fs.Args()[1:]); err != nil {
+			return 2
+		}
+		switch {
+		case *clear:
+			method = http.MethodDelete
+		case *flow >= 0 || *duration > 0:
+			if *flow < 0 || *duration <= 0 {
+				fmt.Fprintln(os.Stderr, "override needs both --flow and --for")
+				return 2
+			}
+			method = http.MethodPut
+			body, _ = json.Marshal(map[string]interface{}{"flow": *flow, "for": duration.String()})
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+
+	if err := ctlRequest(os.Stdout, &http.Client{Timeout: *timeout}, method, "http://"+*address+path, body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// ctlRequest sends request to the controller and writes indented JSON response to w.
+func ctlRequest(w io.Writer, client *http.Client, method, url string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(data))
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		out.Reset()
+		out.Write(data)
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(w)
+	return err
+}
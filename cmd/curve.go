@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// curvePlotRows is the number of duty levels in ASCII plot, 10% each.
+const curvePlotRows = 10
+
+type curvePoint struct {
+	Delta float64 `json:"delta"`
+	Duty  float64 `json:"duty"`
+	Volts float64 `json:"volts"`
+}
+
+type curveReport struct {
+	DutyMin  float64      `json:"dutyMin"`
+	DutyMax  float64      `json:"dutyMax"`
+	TempMin  float64      `json:"tempMin"`
+	TempMax  float64      `json:"tempMax"`
+	Points   []curvePoint `json:"points"`
+	Problems []string     `json:"problems,omitempty"`
+}
+
+// runCurve implements "curve" subcommand. It evaluates flow curve of configured settings over a range of temperature
+// deltas without connecting to EVOK or Home Assistant. Settings are merged from the same layers as in the controller,
+// except Home Assistant. Exit code is 1 when settings make no sense, so it can be used to check them in scripts.
+func runCurve(args []string) int {
+	fs := flag.NewFlagSet("curve", flag.ExitOnError)
+	configFile := fs.String("config", "", "Configuration file with settings, defaults to SOLAR_CONFIG_JSON or /config.yaml")
+	from := fs.Float64("from", 0, "Lowest temperature delta")
+	to := fs.Float64("to", 40, "Highest temperature delta")
+	step := fs.Float64("step", 1, "Temperature delta step")
+	invert := fs.Bool("invert", false, "Show actuator voltage for 'inverted' flow regulator")
+	plot := fs.Bool("plot", false, "Print ASCII plot after the table")
+	asJSON := fs.Bool("json", false, "Print JSON instead of the table")
+	overrides := settingFlags{}
+	fs.Var(overrides, "setting", "Set value of a setting as name=value, can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *step <= 0 || *to < *from {
+		fmt.Fprintln(os.Stderr, "step must be positive and range must not be empty")
+		return 2
+	}
+
+	settings, err := offlineSettings(configFile, overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	report := evaluateCurve(settings.Flow, *from, *to, *step, *invert)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		printCurve(os.Stdout, report, *plot)
+	}
+
+	if len(report.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// offlineSettings merges settings from the same layers as in the controller, except Home Assistant, for subcommands
+// which run without connecting to it.
+func offlineSettings(configFile *string, overrides settingFlags) (homeassistant.Settings, error) {
+	data, _, err := config.Read(configFile)
+	if err != nil {
+		return homeassistant.Settings{}, fmt.Errorf("could not read configuration: %w", err)
+	}
+	cfg, err := config.Parse(data)
+	if err != nil {
+		return homeassistant.Settings{}, fmt.Errorf("could not parse configuration: %w", err)
+	}
+	env, err := config.EnvLayer(os.Environ())
+	if err != nil {
+		return homeassistant.Settings{}, fmt.Errorf("could not read settings from environment: %w", err)
+	}
+
+	settings := *cfg.GetSettingsConfig()
+	layers := []config.Layer{config.DefaultLayer(), cfg.YAMLLayer(), env, {Source: config.SourceFlag, Values: overrides}}
+	for name, e := range config.Merge(layers...) {
+		settings.Set(name, e.Value, e.Source)
+	}
+	return settings, nil
+}
+
+// evaluateCurve samples flow curve and checks settings for combinations which can't work as intended.
+func evaluateCurve(flow homeassistant.FlowSettings, from, to, step float64, invert bool) curveReport {
+	report := curveReport{
+		DutyMin: flow.DutyMin.Value,
+		DutyMax: flow.DutyMax.Value,
+		TempMin: flow.TempMin.Value,
+		TempMax: flow.TempMax.Value,
+	}
+
+	for i := 0; ; i++ {
+		delta := from + float64(i)*step
+		if delta > to+step/1000 {
+			break
+		}
+		duty := flowCurve(flow, delta)
+		volts := math.Round(duty/10*100) / 100
+		if invert {
+			volts = 10 - volts
+		}
+		report.Points = append(report.Points, curvePoint{Delta: delta, Duty: duty, Volts: volts})
+	}
+
+	values := map[string]float64{
+		"flow.dutyMin": report.DutyMin,
+		"flow.dutyMax": report.DutyMax,
+		"flow.tempMin": report.TempMin,
+		"flow.tempMax": report.TempMax,
+	}
+	for _, name := range []string{"flow.dutyMin", "flow.dutyMax", "flow.tempMin", "flow.tempMax"} {
+		if b, ok := config.SettingBounds[name]; ok && (values[name] < b.Min || values[name] > b.Max) {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s %g is outside of safety bounds [%g, %g]", name, values[name], b.Min, b.Max))
+		}
+	}
+	if report.DutyMin > report.DutyMax {
+		report.Problems = append(report.Problems, fmt.Sprintf("flow.dutyMin %g is above flow.dutyMax %g, flow decreases with delta", report.DutyMin, report.DutyMax))
+	}
+	if report.TempMin >= report.TempMax {
+		report.Problems = append(report.Problems, fmt.Sprintf("flow.tempMin %g is not below flow.tempMax %g, flow jumps from minimum to maximum", report.TempMin, report.TempMax))
+	}
+	if report.DutyMin == 0 {
+		report.Problems = append(report.Problems, "flow.dutyMin is 0, flow valve closes at low delta while the pump runs")
+	}
+	return report
+}
+
+// printCurve writes curve as a table, optionally followed by ASCII plot of duty over delta.
+func printCurve(w io.Writer, report curveReport, plot bool) {
+	fmt.Fprintf(w, "dutyMin %g, dutyMax %g, tempMin %g, tempMax %g\n\n", report.DutyMin, report.DutyMax, report.TempMin, report.TempMax)
+	fmt.Fprintf(w, "%8s %8s %8s\n", "delta", "duty", "volts")
+	for _, p := range report.Points {
+		fmt.Fprintf(w, "%8.1f %8.1f %8.2f\n", p.Delta, p.Duty, p.Volts)
+	}
+
+	if plot {
+		fmt.Fprintln(w)
+		for row := curvePlotRows; row >= 0; row-- {
+			line := make([]byte, len(report.Points))
+			for i, p := range report.Points {
+				line[i] = ' '
+				if int(math.Round(p.Duty/10)) == row {
+					line[i] = '*'
+				}
+			}
+			fmt.Fprintf(w, "%4d |%s\n", row*10, strings.TrimRight(string(line), " "))
+		}
+		fmt.Fprintf(w, "     +%s\n", strings.Repeat("-", len(report.Points)))
+		first, last := report.Points[0].Delta, report.Points[len(report.Points)-1].Delta
+		fmt.Fprintf(w, "      %-*g%g ΔT\n", len(report.Points)-len(fmt.Sprint(last)), first, last)
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Fprintf(w, "\nWARNING: %s", problem)
+	}
+	if len(report.Problems) > 0 {
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// streak counts consecutive iterations in which condition of a transition held.
+type streak struct {
+	count int
+	// seen is set when the transition was evaluated in the current iteration.
+	seen bool
+}
+
+var (
+	streaks = make(map[string]*streak)
+
+	debouncedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "transitions_debounced_total",
+		Help:      "Increase when condition of a transition stopped holding before it was acted upon",
+	}, []string{"transition"})
+)
+
+// confirmed reports if condition of transition held for configured number of consecutive iterations. It has to be
+// called in every iteration the transition is evaluated.
+func confirmed(transition string, condition bool) bool {
+	s, ok := streaks[transition]
+	if !ok {
+		s = &streak{}
+		streaks[transition] = s
+	}
+	s.seen = true
+
+	if !condition {
+		s.reset(transition)
+		return false
+	}
+	s.count++
+	return s.count >= controllerCfg().Debounce[transition]
+}
+
+// beyond reports if a safety reading exceeds its threshold by at least margin, so it is acted upon without waiting for
+// debounce. Zero margin never bypasses it.
+func beyond(value, threshold, margin float64) bool {
+	return margin > 0 && value >= threshold+margin
+}
+
+// reset ends the streak. Streak ended before the transition was confirmed means a flap was avoided.
+func (s *streak) reset(transition string) {
+	if s.count > 0 && s.count < controllerCfg().Debounce[transition] {
+		debouncedTotal.WithLabelValues(transition).Inc()
+	}
+	s.count = 0
+}
+
+// debounceTick starts a new iteration. Streaks of transitions which were not evaluated in the previous one are
+// dropped, as their conditions no longer held consecutively.
+func debounceTick() {
+	for transition, s := range streaks {
+		if !s.seen {
+			s.reset(transition)
+			delete(streaks, transition)
+			continue
+		}
+		s.seen = false
+	}
+}
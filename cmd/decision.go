@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/logging"
+)
+
+// Priority classes of control loop steps. Steps of a higher class always preempt those of a lower one: safety
+// handling can't be overridden by anything, protective modes (frost, overheat) preempt comfort modes (reduced mode,
+// user rules) and normal harvesting.
+const (
+	classSafety     = "safety"
+	classProtective = "protective"
+	classComfort    = "comfort"
+	classNormal     = "normal"
+)
+
+// Control loop steps. Each iteration ends in exactly one of them.
+const (
+	stepEmergency      = "emergency shutoff"
+	stepLockout        = "maintenance lockout"
+	stepSensorFault    = "sensor fault"
+	stepPurge          = "post-stop purge"
+	stepCritical       = "critical temperature"
+	stepFill           = "drainback fill"
+	stepSoftEmergency  = "emergency standby"
+	stepNightCooldown  = "night cooldown"
+	stepFrost          = "frost protection"
+	stepTankFull       = "tank full"
+	stepTankSensor     = "tank sensor fault"
+	stepScald          = "scald protection"
+	stepPumpRest       = "pump rest"
+	stepPreCirculation = "pre-circulation"
+	stepHeatEscape     = "heat escape"
+	stepThermostat     = "fallback thermostat"
+	stepRules          = "rules"
+	stepWorking        = "working"
+	stepReduced        = "reduced mode"
+	stepPumpKick       = "pump kick"
+	stepValveExercise  = "valve exercise"
+	stepStopped        = "stopped"
+)
+
+type decisionStep struct {
+	Name  string `json:"name"`
+	Class string `json:"class"`
+}
+
+// decisionOrder is the order in which the control loop evaluates its steps. The first step whose condition holds
+// decides the iteration.
+var decisionOrder = []decisionStep{
+	{stepEmergency, classSafety},
+	{stepSensorFault, classSafety},
+	{stepPurge, classSafety},
+	{stepCritical, classSafety},
+	{stepLockout, classSafety},
+	{stepSoftEmergency, classSafety},
+	{stepFill, classProtective},
+	{stepNightCooldown, classProtective},
+	{stepFrost, classProtective},
+	{stepTankFull, classProtective},
+	{stepTankSensor, classProtective},
+	{stepScald, classProtective},
+	{stepPumpRest, classProtective},
+	{stepHeatEscape, classProtective},
+	{stepRules, classComfort},
+	{stepReduced, classComfort},
+	{stepPreCirculation, classNormal},
+	{stepThermostat, classNormal},
+	{stepWorking, classNormal},
+	{stepPumpKick, classNormal},
+	{stepValveExercise, classNormal},
+	{stepStopped, classNormal},
+}
+
+// classRank orders priority classes, lower rank preempts higher.
+var classRank = map[string]int{classSafety: 0, classProtective: 1, classComfort: 2, classNormal: 3}
+
+func init() {
+	if err := checkDecisionOrder(decisionOrder); err != nil {
+		log.Fatalf("Invalid decision order: %v", err)
+	}
+}
+
+// checkDecisionOrder verifies that no step is evaluated before a step of a higher priority class.
+func checkDecisionOrder(order []decisionStep) error {
+	for i := 1; i < len(order); i++ {
+		prev, step := order[i-1], order[i]
+		if classRank[step.Class] < classRank[prev.Class] {
+			return fmt.Errorf("%s step of %s class is evaluated after %s step of %s class", step.Name, step.Class, prev.Name, prev.Class)
+		}
+	}
+	return nil
+}
+
+type decision struct {
+	Iteration string `json:"iteration"`
+	Time      int64  `json:"time"`
+	Step      string `json:"step"`
+	Class     string `json:"class"`
+	Mode      mode   `json:"mode"`
+	Reason    string `json:"reason,omitempty"`
+	// Preempted is a lower priority mode which was interrupted by this decision.
+	Preempted string `json:"preempted,omitempty"`
+}
+
+var (
+	decisionMu   sync.Mutex
+	lastDecision decision
+	// lastPreemption is kept until another mode is preempted.
+	lastPreemption *decision
+)
+
+// decide records step which decided the current control loop iteration.
+func decide(step string) {
+	decisionMu.Lock()
+	defer decisionMu.Unlock()
+	lastDecision = decision{
+		Iteration: iterationID,
+		Time:      time.Now().Unix(),
+		Step:      step,
+		Class:     stepClass(step),
+		Mode:      systemStatus.Mode,
+		Reason:    systemStatus.Reason,
+	}
+	logging.Debugf("Iteration %s decided by %s step, mode %s: %s", iterationID, step, systemStatus.Mode, systemStatus.Reason)
+}
+
+// preempt records that step interrupted a lower priority mode.
+func preempt(step, preempted string) {
+	log.Printf("%s preempts %s", step, preempted)
+	decide(step)
+
+	decisionMu.Lock()
+	defer decisionMu.Unlock()
+	lastDecision.Preempted = preempted
+	d := lastDecision
+	lastPreemption = &d
+}
+
+func stepClass(step string) string {
+	for _, s := range decisionOrder {
+		if s.Name == step {
+			return s.Class
+		}
+	}
+	return ""
+}
+
+// httpDecision shows order of control loop steps, the step which decided the last iteration and the last
+// preemption of a lower priority mode.
+func httpDecision(w http.ResponseWriter, r *http.Request) {
+	decisionMu.Lock()
+	resp := struct {
+		Order          []decisionStep `json:"order"`
+		Last           decision       `json:"last"`
+		LastPreemption *decision      `json:"lastPreemption,omitempty"`
+	}{decisionOrder, lastDecision, lastPreemption}
+	js, err := json.Marshal(resp)
+	decisionMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// Only EVOK is required. The control loop keeps running on last known settings while Home Assistant is down and
+// everything sent to it is queued for opportunistic delivery.
+const (
+	dependencyEVOK          = "evok"
+	dependencyHomeAssistant = "homeassistant"
+)
+
+// hassQueueSize is the number of Home Assistant writes waiting for delivery. Writes are dropped when it is full.
+const hassQueueSize = 32
+
+type dependencyStatus struct {
+	Required bool   `json:"required"`
+	Up       bool   `json:"up"`
+	LastSync int64  `json:"lastSync,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var (
+	dependenciesMu sync.Mutex
+	dependencies   = map[string]*dependencyStatus{
+		dependencyEVOK:          {Required: true},
+		dependencyHomeAssistant: {},
+	}
+
+	hassQueue = make(chan func(), hassQueueSize)
+
+	dependencyUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "dependency_up",
+		Help:      "Whether the last synchronization with external dependency succeeded",
+	}, []string{"dependency"})
+	hassDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "homeassistant_writes_dropped_total",
+		Help:      "Total number of writes to Home Assistant dropped because the queue was full",
+	})
+)
+
+func init() {
+	go func() {
+		defer recoverCrash("homeassistant queue")
+		for f := range hassQueue {
+			f()
+		}
+	}()
+}
+
+// markSync records result of synchronization with a dependency.
+func markSync(name string, err error) {
+	dependenciesMu.Lock()
+	defer dependenciesMu.Unlock()
+
+	d := dependencies[name]
+	if err != nil {
+		if d.Up || d.Error == "" {
+			log.Printf("Dependency %s is down: %v", name, err)
+		}
+		d.Up, d.Error = false, err.Error()
+		dependencyUp.WithLabelValues(name).Set(0)
+		return
+	}
+	if !d.Up {
+		log.Printf("Dependency %s is up", name)
+	}
+	d.Up, d.Error, d.LastSync = true, "", time.Now().Unix()
+	dependencyUp.WithLabelValues(name).Set(1)
+}
+
+// syncSettings refreshes settings from Home Assistant. On failure the last known values stay in use.
+func syncSettings(client *homeassistant.Client) error {
+	err := client.UpdateAll()
+	markSync(dependencyHomeAssistant, err)
+	return err
+}
+
+// sendToHA queues a write to Home Assistant, so the control loop never waits for it. The client is captured when
+// the write is queued, as it can be swapped by configuration reload before delivery.
+func sendToHA(what string, f func(c *homeassistant.Client) error) {
+	client := hass()
+	select {
+	case hassQueue <- func() {
+		err := f(client)
+		if err != nil {
+			log.Printf("Could not %s: %v", what, err)
+		}
+		markSync(dependencyHomeAssistant, err)
+	}:
+	default:
+		hassDroppedTotal.Inc()
+		log.Printf("Home Assistant queue is full, dropping request to %s", what)
+	}
+}
+
+// httpDependencies shows synchronization status of every external dependency.
+func httpDependencies(w http.ResponseWriter, r *http.Request) {
+	dependenciesMu.Lock()
+	resp := make(map[string]dependencyStatus, len(dependencies))
+	for name, d := range dependencies {
+		resp[name] = *d
+	}
+	dependenciesMu.Unlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
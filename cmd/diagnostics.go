@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/config"
+)
+
+// maxRecentEvents is the number of events kept for diagnostics.
+const maxRecentEvents = 50
+
+type recentEvent struct {
+	Time   int64  `json:"time"`
+	Event  string `json:"event"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var (
+	recentEventsMu sync.Mutex
+	recentEvents   []recentEvent
+)
+
+// recordEvent keeps event in a short history included in diagnostics.
+func recordEvent(event, detail string) {
+	recentEventsMu.Lock()
+	defer recentEventsMu.Unlock()
+	recentEvents = append(recentEvents, recentEvent{Time: time.Now().Unix(), Event: event, Detail: detail})
+	if len(recentEvents) > maxRecentEvents {
+		recentEvents = recentEvents[len(recentEvents)-maxRecentEvents:]
+	}
+}
+
+type diagnostics struct {
+	Time         int64                       `json:"time"`
+	Versions     map[string]string           `json:"versions"`
+	Config       string                      `json:"config"`
+	Status       Status                      `json:"status"`
+	Decision     decision                    `json:"decision"`
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+	Features     map[string]bool             `json:"features"`
+	Events       []recentEvent               `json:"events"`
+}
+
+// buildVersions returns Go version and versions of the controller and its modules.
+func buildVersions() map[string]string {
+	versions := map[string]string{"go": runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return versions
+	}
+	versions[info.Main.Path] = info.Main.Version
+	for _, dep := range info.Deps {
+		versions[dep.Path] = dep.Version
+	}
+	return versions
+}
+
+// httpDiagnostics serves a single JSON bundle with running configuration, status, recent events, versions and
+// dependency health, which can be attached to bug reports. Sensitive configuration values are redacted.
+func httpDiagnostics(w http.ResponseWriter, r *http.Request) {
+	cfg, err := config.Redacted(runningConfig())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := diagnostics{
+		Time:         time.Now().Unix(),
+		Versions:     buildVersions(),
+		Config:       string(cfg),
+		Status:       systemStatus,
+		Dependencies: make(map[string]dependencyStatus),
+		Features:     make(map[string]bool),
+	}
+
+	decisionMu.Lock()
+	resp.Decision = lastDecision
+	decisionMu.Unlock()
+
+	dependenciesMu.Lock()
+	for name, d := range dependencies {
+		resp.Dependencies[name] = *d
+	}
+	dependenciesMu.Unlock()
+
+	for name := range config.FeatureDefaults {
+		resp.Features[name] = featureEnabled(name)
+	}
+
+	recentEventsMu.Lock()
+	resp.Events = append([]recentEvent(nil), recentEvents...)
+	recentEventsMu.Unlock()
+
+	js, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("solar-diagnostics-%s.json", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// httpEvents serves recent events, oldest first.
+func httpEvents(w http.ResponseWriter, r *http.Request) {
+	recentEventsMu.Lock()
+	events := append([]recentEvent{}, recentEvents...)
+	recentEventsMu.Unlock()
+
+	js, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
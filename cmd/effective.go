@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// settingFlags collects repeated --setting name=value flags.
+type settingFlags map[string]float64
+
+func (f settingFlags) String() string {
+	var parts []string
+	for name, v := range f {
+		parts = append(parts, fmt.Sprintf("%s=%g", name, v))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f settingFlags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !homeassistant.IsSetting(parts[0]) {
+		return fmt.Errorf("expected name=value of a known setting, got %q", s)
+	}
+	v, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid value of setting %s: %w", parts[0], err)
+	}
+	f[parts[0]] = v
+	return nil
+}
+
+var (
+	flagSettings = settingFlags{}
+	// envSettings are read once at startup, environment does not change while running.
+	envSettings config.Layer
+)
+
+// settingLayers returns layers of setting values below Home Assistant in order of increasing precedence:
+// defaults < YAML < environment < flags.
+func settingLayers(cfg *config.Config) []config.Layer {
+	return []config.Layer{
+		config.DefaultLayer(),
+		cfg.YAMLLayer(),
+		envSettings,
+		{Source: config.SourceFlag, Values: flagSettings},
+	}
+}
+
+// layeredSettings returns settings from cfg with values merged from all layers below Home Assistant. Provenance of
+// every setting is logged.
+func layeredSettings(cfg *config.Config) homeassistant.Settings {
+	settings := *cfg.GetSettingsConfig()
+	merged := config.Merge(settingLayers(cfg)...)
+	for _, name := range homeassistant.SettingNames() {
+		e := merged[name]
+		if given := e.Layers[e.Source]; given != e.Value {
+			log.Printf("Warning: setting %s value %g from %s is outside of safety bounds, using %g", name, given, e.Source, e.Value)
+		}
+		settings.Set(name, e.Value, e.Source)
+
+		entity, _ := settings.Lookup(name)
+		if entity.EntityID != "" {
+			log.Printf("Setting %s = %g from %s until Home Assistant entity %s is read", name, e.Value, e.Source, entity.EntityID)
+			continue
+		}
+		log.Printf("Setting %s = %g from %s", name, e.Value, e.Source)
+	}
+	return settings
+}
+
+type effectiveSetting struct {
+	config.Effective
+	EntityID string `json:"entity_id,omitempty"`
+	Stale    bool   `json:"stale,omitempty"`
+}
+
+// httpConfigEffective shows current value of every setting, the source it came from and values provided by each
+// configuration layer.
+func httpConfigEffective(w http.ResponseWriter, r *http.Request) {
+	merged := config.Merge(settingLayers(runningConfig())...)
+	settings := hass().GetSettings()
+
+	resp := make(map[string]effectiveSetting)
+	for _, name := range homeassistant.SettingNames() {
+		entity, _ := settings.Lookup(name)
+		e := effectiveSetting{Effective: merged[name], EntityID: entity.EntityID, Stale: entity.Stale}
+		e.Value, e.Source = entity.Value, entity.Source
+		if entity.Source == homeassistant.SourceProfile {
+			e.Source = fmt.Sprintf("%s:%s", homeassistant.SourceProfile, activeProfile)
+		}
+		resp[name] = e
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
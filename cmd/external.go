@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// externalChangeEventType is Home Assistant event fired when an actuator is changed outside of the controller.
+const externalChangeEventType = "solar_external_change"
+
+var externalChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "solar",
+	Name:      "actuator_external_changes_total",
+	Help:      "Total number of actuator changes made outside of the controller",
+}, []string{"actuator"})
+
+// handleExternalChanges reacts to actuator changes detected by EVOK client. Depending on configuration commanded
+// state is restored or the change is only reported.
+func handleExternalChanges() {
+	for {
+		var change evok.ExternalChange
+		select {
+		case change = <-evokClient().ExternalChanges():
+		default:
+			return
+		}
+
+		externalChangesTotal.WithLabelValues(change.Actuator).Inc()
+		notifyEvent(config.EventExternalChange)
+		log.Printf("Actuator %s was changed outside of the controller: expected %f, got %f", change.Actuator, change.Expected, change.Actual)
+
+		data := map[string]interface{}{
+			"actuator": change.Actuator,
+			"expected": change.Expected,
+			"actual":   change.Actual,
+		}
+		sendToHA("fire external change event", func(c *homeassistant.Client) error {
+			return c.FireEvent(externalChangeEventType, data)
+		})
+
+		if controllerCfg().ExternalChange != config.ExternalChangeReconcile {
+			soundBuzzer()
+			continue
+		}
+		log.Printf("Restoring %s to %f", change.Actuator, change.Expected)
+		if err := evokClient().SetValue(change.Dev, change.Circuit, change.Expected); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+
+	"github.com/automatedhome/solar/pkg/config"
+)
+
+// activeFailsafe holds safety event handled by an action which keeps the circuit running.
+var activeFailsafe string
+
+// failsafe executes action configured for a safety event. It returns true when event was newly handled and false
+// when the action is already in effect.
+func failsafe(event string, status mode, reason string) bool {
+	if activeFailsafe == event {
+		return false
+	}
+
+	notifyEvent(event)
+
+	action := controllerCfg().Failsafe.Action(event)
+	log.Printf("Safety event %s in iteration %s, taking action: %s", event, iterationID, action)
+	setStatus(status, reason)
+	soundBuzzer()
+
+	if action == config.ActionStop {
+		activeFailsafe = ""
+		setHeatDump(false)
+		if !startPurge(reason) {
+			stop(reason)
+		}
+		return true
+	}
+
+	log.Println("Failsafe: " + reason)
+	coolingDown = false
+	preCirculating = false
+	frostProtecting = false
+	activeFailsafe = event
+
+	flowCfg := hass().GetSettings().Flow
+	switch action {
+	case config.ActionMinFlow:
+		setHeatDump(false)
+		if err := setFlow(flowCfg.DutyMin.Value); err != nil {
+			log.Println(err)
+		}
+	case config.ActionMaxFlow:
+		setHeatDump(false)
+		if err := setFlow(flowCfg.DutyMax.Value); err != nil {
+			log.Println(err)
+		}
+	case config.ActionHeatDump:
+		setHeatDump(true)
+		if err := setFlow(flowCfg.DutyMax.Value); err != nil {
+			log.Println(err)
+		}
+	}
+	return true
+}
+
+// clearFailsafe returns to normal operation after safety event is no longer present.
+func clearFailsafe() {
+	log.Printf("Safety event %s cleared, resuming normal operation", activeFailsafe)
+	activeFailsafe = ""
+	setHeatDump(false)
+}
+
+// setHeatDump switches heat dump output if one is configured.
+func setHeatDump(on bool) {
+	dump := evokClient().GetActuators().HeatDump
+	if dump.Dev == "" || evokClient().IsLockedOut("heatDump") {
+		return
+	}
+
+	value := 0.0
+	if on {
+		value = 1
+	}
+	if err := evokClient().SetValue(dump.Dev, dump.Circuit, value); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+)
+
+var (
+	featuresMu sync.Mutex
+	// featureOverrides holds feature states read from Home Assistant toggles.
+	featureOverrides = make(map[string]bool)
+
+	featureEnabledMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "feature_enabled",
+		Help:      "Set when feature flag is enabled",
+	}, []string{"feature"})
+)
+
+// featureEnabled reports if feature flag is enabled. Home Assistant toggle takes precedence over configuration,
+// which takes precedence over the default.
+func featureEnabled(name string) bool {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	if enabled, ok := featureOverrides[name]; ok {
+		return enabled
+	}
+	if feature, ok := controllerCfg().Features[name]; ok {
+		return feature.Enabled
+	}
+	return config.FeatureDefaults[name]
+}
+
+// syncFeaturesFromHA follows feature toggles in Home Assistant. Configured state is used for toggles which can't
+// be read.
+func syncFeaturesFromHA() {
+	overrides := make(map[string]bool)
+	for name, feature := range controllerCfg().Features {
+		if feature.Entity == "" {
+			continue
+		}
+		state, err := hass().GetState(feature.Entity)
+		if err != nil {
+			log.Printf("Could not get feature %s from HomeAssistant: %v", name, err)
+			continue
+		}
+		overrides[name] = state == "on"
+	}
+
+	featuresMu.Lock()
+	featureOverrides = overrides
+	featuresMu.Unlock()
+
+	for name := range config.FeatureDefaults {
+		if featureEnabled(name) {
+			featureEnabledMetric.WithLabelValues(name).Set(1)
+		} else {
+			featureEnabledMetric.WithLabelValues(name).Set(0)
+		}
+	}
+}
+
+// fillPhaseEnabled reports if drainback fill phase primes the collector on start. Flow is still de-energized
+// first on stop of drainback systems, which is needed to drain the collector.
+func fillPhaseEnabled() bool {
+	return systemProfile().FillPhase && featureEnabled(config.FeatureDrainback)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// heaterPublishPeriod limits how often unchanged interlock is published to Home Assistant.
+const heaterPublishPeriod = 5 * time.Minute
+
+var (
+	heaterBlocked       bool
+	lastHeaterPublish   time.Time
+	heaterBlockedMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "backup_heater_blocked",
+		Help:      "Set while electric backup heater should stay off, as electricity is expensive and solar covers demand",
+	})
+)
+
+// solarCoversDemand reports if tank top is at demand temperature or harvest is predicted to bring it there before
+// sunset.
+func solarCoversDemand(s *evok.Sensors, demand float64, now time.Time) (bool, string) {
+	if s.TankUp.Value >= demand {
+		return true, fmt.Sprintf("tankUp %.1f ≥ demand %.1f", s.TankUp.Value, demand)
+	}
+	if controllerCfg().Tank.Volume <= 0 {
+		return false, fmt.Sprintf("tankUp %.1f < demand %.1f", s.TankUp.Value, demand)
+	}
+	_, sunset, ok := sunTimes(now, controllerCfg().Location)
+	reachedIn := timeToFull(systemStatus.TankEnergy, systemStatus.HarvestPower, demand)
+	if !ok || reachedIn < 0 || now.Add(reachedIn).After(sunset) {
+		return false, fmt.Sprintf("tankUp %.1f < demand %.1f and harvest won't cover it before sunset", s.TankUp.Value, demand)
+	}
+	return true, fmt.Sprintf("harvest brings tank to demand %.1f at %s", demand, now.Add(reachedIn).Format("15:04"))
+}
+
+// coordinateBackupHeater publishes interlock blocking electric backup heater during expensive hours in which solar
+// covers hot water demand. Heater is never blocked while price is unknown.
+func coordinateBackupHeater(s *evok.Sensors, cfg homeassistant.Settings, now time.Time) {
+	heater := controllerCfg().BackupHeater
+	if heater.EntityID == "" {
+		return
+	}
+
+	price := cfg.ElectricityPrice
+	blocked := false
+	var reason string
+	switch {
+	case price.Stale || price.State == "":
+		reason = "electricity price is unknown"
+	case price.Value <= heater.MaxPrice:
+		reason = fmt.Sprintf("price %.2f ≤ max %.2f", price.Value, heater.MaxPrice)
+	default:
+		var covered bool
+		covered, reason = solarCoversDemand(s, heater.DemandTemperature, now)
+		blocked = covered
+		reason = fmt.Sprintf("price %.2f > max %.2f, %s", price.Value, heater.MaxPrice, reason)
+	}
+
+	systemStatus.HeaterBlocked = blocked
+	if blocked {
+		heaterBlockedMetric.Set(1)
+	} else {
+		heaterBlockedMetric.Set(0)
+	}
+
+	changed := blocked != heaterBlocked
+	if !changed && now.Sub(lastHeaterPublish) < heaterPublishPeriod {
+		return
+	}
+	if changed {
+		log.Printf("Backup heater blocked: %t, %s", blocked, reason)
+	}
+	heaterBlocked = blocked
+	lastHeaterPublish = now
+
+	state := "off"
+	if blocked {
+		state = "on"
+	}
+	attributes := map[string]interface{}{
+		"friendly_name": "Solar backup heater blocked",
+		"price":         price.Value,
+		"max_price":     heater.MaxPrice,
+		"reason":        reason,
+	}
+	sendToHA("publish backup heater interlock", func(c *homeassistant.Client) error {
+		return c.PublishState(heater.EntityID, state, attributes)
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+const (
+	heatUpKey = "heatUp"
+	// Collector outlet is in steady state once it rises less than heatUpSteadyRise over heatUpSteadyWindow.
+	heatUpSteadyWindow = time.Minute
+	heatUpSteadyRise   = 0.3
+	// heatUpTimeout ends measurement of an outlet which keeps rising.
+	heatUpTimeout = 20 * time.Minute
+	// heatUpMinRise skips starts with collector outlet already near steady state, as their rate means nothing.
+	heatUpMinRise = 2.0
+	// Baseline follows slow seasonal changes, recent rate reacts within a few starts.
+	heatUpBaselineWeight = 0.05
+	heatUpRecentWeight   = 0.3
+	// heatUpMinStarts is the number of starts baseline is learned from before degradation is reported.
+	heatUpMinStarts = 10
+	// heatUpDegradation is relative drop of recent rate below baseline which is reported.
+	heatUpDegradation = 0.3
+)
+
+// heatUpRates holds heat-up rates of collector outlet after starts in °C/min.
+type heatUpRates struct {
+	Baseline float64 `json:"baseline"`
+	Recent   float64 `json:"recent"`
+	Starts   int     `json:"starts"`
+}
+
+var (
+	heatUp heatUpRates
+	// heatUpDegraded is set while recent rate is significantly below baseline.
+	heatUpDegraded bool
+	// Measurement of the current run.
+	heatUpRun         time.Time
+	heatUpFrom        float64
+	heatUpWindowStart time.Time
+	heatUpWindowValue float64
+	heatUpDone        bool
+
+	heatUpRateMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "heat_up_rate",
+		Help:      "Rate at which collector outlet reached steady state after the last start in °C/min",
+	})
+	heatUpBaselineMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "heat_up_rate_baseline",
+		Help:      "Long term heat-up rate of collector outlet after starts in °C/min",
+	})
+	heatUpDegradedMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "heat_up_degraded",
+		Help:      "Set when heat-up rate after starts dropped significantly below baseline, e.g. because of air in the loop or pump wear",
+	})
+)
+
+// loadHeatUp restores heat-up rates from the state store.
+func loadHeatUp() {
+	if _, err := stateStore.Get(heatUpKey, &heatUp); err != nil {
+		log.Println(err)
+	}
+	heatUpBaselineMetric.Set(heatUp.Baseline)
+}
+
+// storeHeatUp puts heat-up rates into the state store.
+func storeHeatUp() {
+	if heatUp.Starts == 0 {
+		return
+	}
+	if err := stateStore.Set(heatUpKey, heatUp); err != nil {
+		log.Println(err)
+	}
+}
+
+// observeHeatUp measures how fast collector outlet reaches steady state after every start. Pre-circulation and
+// drainback fill phase run the circuit at flows which don't represent a normal start, so they are not measured.
+func observeHeatUp(s *evok.Sensors, now time.Time) {
+	if !circuitRunning || preCirculating || fillPhaseEnabled() {
+		heatUpRun = time.Time{}
+		return
+	}
+	outlet := s.SolarOut.Value
+	if !heatUpRun.Equal(runningSince) {
+		heatUpRun, heatUpDone = runningSince, false
+		heatUpFrom, heatUpWindowStart, heatUpWindowValue = outlet, now, outlet
+		return
+	}
+	if heatUpDone || now.Sub(heatUpWindowStart) < heatUpSteadyWindow {
+		return
+	}
+
+	if outlet-heatUpWindowValue >= heatUpSteadyRise && now.Sub(heatUpRun) < heatUpTimeout {
+		heatUpWindowStart, heatUpWindowValue = now, outlet
+		return
+	}
+	heatUpDone = true
+	rise := outlet - heatUpFrom
+	if rise < heatUpMinRise {
+		return
+	}
+	recordHeatUp(rise / now.Sub(heatUpRun).Minutes())
+}
+
+// recordHeatUp learns heat-up rate of a start and reports when recent starts are significantly slower than baseline.
+func recordHeatUp(rate float64) {
+	heatUpRateMetric.Set(rate)
+	systemStatus.HeatUpRate = rate
+	if heatUp.Starts == 0 {
+		heatUp.Baseline, heatUp.Recent = rate, rate
+	} else {
+		heatUp.Baseline += heatUpBaselineWeight * (rate - heatUp.Baseline)
+		heatUp.Recent += heatUpRecentWeight * (rate - heatUp.Recent)
+	}
+	heatUp.Starts++
+	heatUpBaselineMetric.Set(heatUp.Baseline)
+	log.Printf("Collector outlet heated up at %.2f °C/min, baseline %.2f °C/min", rate, heatUp.Baseline)
+
+	degraded := heatUp.Starts >= heatUpMinStarts && heatUp.Recent < heatUp.Baseline*(1-heatUpDegradation)
+	if degraded == heatUpDegraded {
+		return
+	}
+	heatUpDegraded = degraded
+	if !degraded {
+		heatUpDegradedMetric.Set(0)
+		log.Println("Heat-up rate recovered")
+		return
+	}
+	heatUpDegradedMetric.Set(1)
+	log.Printf("Heat-up rate %.2f °C/min is %.0f%% below baseline, check loop for air and pump for wear", heatUp.Recent, (1-heatUp.Recent/heatUp.Baseline)*100)
+	notifyEvent(config.EventHeatUpDegraded)
+}
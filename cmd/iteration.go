@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// iterationID identifies current control loop iteration. It is logged with safety events and attached to their
+// counters as exemplar, which links a counter spike to the log lines of the triggering iteration.
+var iterationID string
+
+// newIterationID starts a new control loop iteration.
+func newIterationID() {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		iterationID = ""
+		return
+	}
+	iterationID = hex.EncodeToString(id)
+}
+
+// incWithExemplar increments safety event counter with exemplar referencing current iteration.
+func (c *persistentCounter) incWithExemplar() {
+	adder, ok := c.Counter.(prometheus.ExemplarAdder)
+	if !ok || iterationID == "" {
+		c.Inc()
+		return
+	}
+
+	c.mu.Lock()
+	c.value++
+	c.mu.Unlock()
+	adder.AddWithExemplar(1, prometheus.Labels{"iteration_id": iterationID})
+}
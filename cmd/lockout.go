@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// lockoutImpact describes capability lost while an actuator is locked out for maintenance.
+var lockoutImpact = map[string]string{
+	"pump":      "circuit can't be started",
+	"switch":    "circuit can't be started",
+	"flow":      "flow is not regulated",
+	"heatDump":  "heat dump is unavailable",
+	"statusLed": "status LED is off",
+	"buzzer":    "buzzer is silent",
+	"watchdog":  "circuit can't be started",
+}
+
+// degradedCapabilities lists capabilities lost because of maintenance lockouts.
+func degradedCapabilities() []string {
+	seen := make(map[string]bool)
+	var degraded []string
+	for _, name := range evokClient().LockedOut() {
+		if impact := lockoutImpact[name]; !seen[impact] {
+			seen[impact] = true
+			degraded = append(degraded, impact)
+		}
+	}
+	sort.Strings(degraded)
+	return degraded
+}
+
+// circuitLockedOut returns name of a locked out actuator without which the circuit can't run, or of one waiting to be
+// switched off before it is locked out. Watchdog relay cuts the pump while its output is not pulsed.
+func circuitLockedOut() (string, bool) {
+	pending := make(map[string]bool)
+	for _, name := range evokClient().PendingLockouts() {
+		pending[name] = true
+	}
+	for _, name := range []string{"pump", "switch", "watchdog"} {
+		if evokClient().IsLockedOut(name) || pending[name] {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// syncLockoutFromHA follows maintenance lockout switches in Home Assistant.
+func syncLockoutFromHA() {
+	for name, entity := range controllerCfg().Lockout {
+		state, err := hass().GetState(entity)
+		if err != nil {
+			log.Printf("Could not get lockout of %s from HomeAssistant: %v", name, err)
+			continue
+		}
+		if err := evokClient().SetLockedOut(name, state == "on"); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type lockoutResponse struct {
+	LockedOut []string `json:"lockedOut"`
+	// Pending are energized actuators locked out once they are switched off.
+	Pending  []string `json:"pending,omitempty"`
+	Degraded []string `json:"degraded"`
+}
+
+// httpLockout shows locked out actuators on GET and locks out or releases actuator passed as
+// {"actuator": "pump", "locked": true} on PUT. The change is written to Home Assistant lockout switch, if configured.
+func httpLockout(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Actuator string `json:"actuator"`
+			Locked   bool   `json:"locked"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := evokClient().SetLockedOut(req.Actuator, req.Locked); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if entity := controllerCfg().Lockout[req.Actuator]; entity != "" {
+			if err := hass().SetSwitch(entity, req.Locked); err != nil {
+				log.Printf("Could not write lockout of %s to HomeAssistant: %v", req.Actuator, err)
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := lockoutResponse{LockedOut: evokClient().LockedOut(), Pending: evokClient().PendingLockouts(), Degraded: degradedCapabilities()}
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,42 +18,121 @@ import (
 
 	"github.com/automatedhome/solar/pkg/config"
 	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/fault"
 	"github.com/automatedhome/solar/pkg/homeassistant"
+	"github.com/automatedhome/solar/pkg/logging"
+	"github.com/automatedhome/solar/pkg/state"
 )
 
+// modeChangedEventType is Home Assistant event fired when controller mode changes.
+const modeChangedEventType = "solar_mode_changed"
+
 type Status struct {
-	Mode  string  `json:"mode"`
-	Since int64   `json:"since"`
-	Delta float64 `json:"delta"`
-	Flow  float64 `json:"flow"`
+	Mode         mode    `json:"mode"`
+	ModeText     string  `json:"mode_text"`
+	Reason       string  `json:"reason,omitempty"`
+	Since        int64   `json:"since"`
+	Delta        float64 `json:"delta"`
+	Flow         float64 `json:"flow"`
+	PumpHours    float64 `json:"pump_hours"`
+	Profile      string  `json:"profile"`
+	Algorithm    string  `json:"algorithm"`
+	TankEnergy   float64 `json:"tank_energy_kwh,omitempty"`
+	HarvestPower float64 `json:"harvest_power_kw,omitempty"`
+	TankFullAt   int64   `json:"tank_full_at,omitempty"`
+	SurplusHeat  float64 `json:"surplus_heat_kwh,omitempty"`
+	// HeatUpRate of collector outlet after the last start in °C/min.
+	HeatUpRate float64 `json:"heat_up_rate,omitempty"`
+	// AirInLoop is set while air pockets are suspected in the loop.
+	AirInLoop bool `json:"air_in_loop,omitempty"`
+	// ValveStuck is set while flow valve doesn't seem to follow commanded flow.
+	ValveStuck bool `json:"valve_stuck,omitempty"`
+	// TankSensorFault is set while TankUp reading is suspected frozen.
+	TankSensorFault bool `json:"tank_sensor_fault,omitempty"`
+	// SensorFaults holds sensors whose readings are rejected as invalid, with the reason.
+	SensorFaults map[string]string `json:"sensor_faults,omitempty"`
+	// HeaterBlocked is set while electric backup heater should stay off.
+	HeaterBlocked bool     `json:"backup_heater_blocked,omitempty"`
+	ReducedUntil  int64    `json:"reduced_until,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+	// StaleSettings are settings whose entities are unavailable in Home Assistant.
+	StaleSettings []string `json:"stale_settings,omitempty"`
+	TokenInvalid  bool     `json:"homeassistant_token_invalid,omitempty"`
+	// Degraded lists capabilities lost because of actuators locked out for maintenance.
+	Degraded []string `json:"degraded,omitempty"`
 }
 
+// Sensor swap is reported when SolarIn is hotter than SolarOut for swapDetectionTime while the pump runs in steady state.
+const (
+	swapSteadyStateTime = 10 * time.Minute
+	swapDetectionTime   = 15 * time.Minute
+	swapMargin          = 1.0
+)
+
+// controlInterval is a period between control loop iterations.
+const controlInterval = 5 * time.Second
+
+// frostHysteresis is added to frost temperature to get a temperature at which frost protection stops.
+const frostHysteresis = 4.0
+
 var (
 	circuitRunning bool
+	coolingDown    bool
 	invertFlow     bool
 	lastPass       time.Time
 	systemStatus   Status
 
-	hass       *homeassistant.Client
-	evokClient *evok.Client
+	preCirculating    bool
+	preCirculationEnd time.Time
+	lastStartDay      string
+
+	runningSince      time.Time
+	filling           bool
+	frostProtecting   bool
+	hardEmergency     bool
+	softEmergency     bool
+	fillEnd           time.Time
+	swapSuspectedFrom time.Time
+	swapPlausibleFrom time.Time
+	swapSuspected     bool
+	// startInterrupted is set when start failed after some actuators may have been switched on.
+	startInterrupted bool
+
+	stateStore *state.Store
+
+	hassAddress string
+	hassToken   string
+	evokAddress string
+	simulation  bool
 )
 
 var (
-	heatEscapeTotal = promauto.NewCounter(prometheus.CounterOpts{
+	heatEscapeTotal = newPersistentCounter(prometheus.CounterOpts{
 		Namespace: "solar",
 		Name:      "heat_escape_total",
 		Help:      "Increase when heat escape system kicked in",
 	})
-	failsafeTotal = promauto.NewCounter(prometheus.CounterOpts{
+	failsafeTotal = newPersistentCounter(prometheus.CounterOpts{
 		Namespace: "solar",
 		Name:      "failsafe_total",
 		Help:      "Increase when failsafe system kicked in",
 	})
-	tankfullTotal = promauto.NewCounter(prometheus.CounterOpts{
+	tankfullTotal = newPersistentCounter(prometheus.CounterOpts{
 		Namespace: "solar",
 		Name:      "tank_full_total",
 		Help:      "Increase when heating stopped due to tank being full",
 	})
+	loopDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "solar",
+		Name:      "control_loop_duration_seconds",
+		Help:      "Duration of control loop iterations",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 3, 5, 10},
+	})
+	loopDrift = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "control_loop_drift_seconds",
+		Help:      "Difference between actual and expected period of the last control loop iteration",
+	})
 	reducedModeMetric = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: "solar",
 		Name:      "reduced_mode",
@@ -71,60 +153,183 @@ var (
 		Name:      "temperature_delta_celsius",
 		Help:      "Temperature delta used for setting flow rate",
 	})
-	emergencyTotal = promauto.NewCounter(prometheus.CounterOpts{
+	softEmergencyTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "soft_emergency_total",
+		Help:      "Increase when soft emergency standby is triggered",
+	})
+	pumpStartsTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "pump_starts_total",
+		Help:      "Increase when solar circuit pump is started",
+	})
+	emergencyTotal = newPersistentCounter(prometheus.CounterOpts{
 		Namespace: "solar",
 		Name:      "emergency_total",
 		Help:      "Increase when emergency shutoff is triggered",
 	})
+	preCirculationTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "pre_circulation_total",
+		Help:      "Increase when pre-circulation pulse is run before the first start of the day",
+	})
+	frostProtectionTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "frost_protection_total",
+		Help:      "Increase when frost protection circulates tank water through the collector",
+	})
+	drainbackFillTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "drainback_fill_total",
+		Help:      "Increase when drainback collector fill phase is started",
+	})
+	nightCooldownTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "night_cooldown_total",
+		Help:      "Increase when tank is cooled down through the collector",
+	})
+	sensorSwapMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "sensor_swap_suspected",
+		Help:      "Set when SolarIn and SolarOut sensors are probably swapped",
+	})
+	dhwBoostMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "dhw_flow_boost_active",
+		Help:      "Flow is raised due to running domestic hot water recirculation pump",
+	})
+	tankMaxMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "tank_max_celsius",
+		Help:      "Effective tank temperature limit",
+	})
+	coolingSeasonMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "cooling_season",
+		Help:      "Solar circuit is operating in cooling season mode",
+	})
 )
 
 func stop(reason string) {
 	log.Println("Stopping: " + reason)
 
-	act := evokClient.GetActuators()
+	act := evokClient().GetActuators()
+	failed := false
 
-	if err := evokClient.SetValue(act.Pump.Dev, act.Pump.Circuit, 0); err != nil {
-		log.Println(err)
-		return
+	// Drainback collector needs to be drained as soon as possible, so flow actuator is de-energized first.
+	// Locked out actuators are left to the maintenance. A failed command doesn't prevent the others.
+	if systemProfile().FillPhase {
+		if err := switchOff([]evok.Command{{Dev: act.Flow.Dev, Circuit: act.Flow.Circuit, Value: 0}}); err != nil {
+			log.Println(err)
+			failed = true
+		}
 	}
-	time.Sleep(1 * time.Second)
 
-	if err := evokClient.SetValue(act.Switch.Dev, act.Switch.Circuit, 0); err != nil {
+	if err := switchOff([]evok.Command{
+		{Dev: act.Pump.Dev, Circuit: act.Pump.Circuit, Value: 0},
+		{Dev: act.Switch.Dev, Circuit: act.Switch.Circuit, Value: 0},
+	}); err != nil {
 		log.Println(err)
-		return
+		failed = true
 	}
-	time.Sleep(1 * time.Second)
 
-	minFlow := hass.GetSettings().Flow.DutyMin.Value
-	if err := setFlow(minFlow); err != nil {
-		log.Println(err)
+	if !systemProfile().FillPhase {
+		minFlow := hass().GetSettings().Flow.DutyMin.Value
+		if err := setFlow(minFlow); err != nil {
+			log.Println(err)
+			failed = true
+		}
+	}
+
+	// Circuit stays running, so the next iteration repeats the commands which did not succeed.
+	if failed {
+		stopFailed(reason)
 		return
 	}
-	time.Sleep(1 * time.Second)
+	markStopped()
+}
 
+// markStopped resets circuit state after its actuators were switched off.
+func markStopped() {
 	circuitRunning = false
+	coolingDown = false
+	preCirculating = false
+	filling = false
+	frostProtecting = false
+	purging = false
+	startInterrupted = false
+	stopFailing = false
 	circuitRunningMetric.Set(0)
+
+	persistState(true)
+}
+
+// deenergizeAll switches off every configured output and then inhibits all further actuator commands.
+func deenergizeAll(reason string) {
+	log.Println("De-energizing all actuators: " + reason)
+
+	act := evokClient().GetActuators()
+	for _, dev := range []evok.Device{act.Pump, act.Switch, act.Flow, act.HeatDump, act.StatusLED, act.Buzzer} {
+		if dev.Dev == "" {
+			continue
+		}
+		if err := evokClient().SetValue(dev.Dev, dev.Circuit, 0); err != nil && !errors.Is(err, evok.ErrLockedOut) {
+			log.Println(err)
+		}
+	}
+	evokClient().SetInhibited(true)
+
+	activeFailsafe = ""
+	markStopped()
 }
 
 func start() {
 	log.Println("Detected optimal conditions. Harvesting.")
 
-	act := evokClient.GetActuators()
+	act := evokClient().GetActuators()
 
-	if err := evokClient.SetValue(act.Pump.Dev, act.Pump.Circuit, 1); err != nil {
-		log.Println(err)
-		return
+	// Valve pre-positioned for warm up is already at the expected operating point.
+	soft := softStartEnabled() && !warmUpPositioned
+	warmUpPositioned = false
+	if soft {
+		prepositionFlow()
 	}
-	time.Sleep(1 * time.Second)
 
-	if err := evokClient.SetValue(act.Switch.Dev, act.Switch.Circuit, 1); err != nil {
+	// Start interrupted by an error is resumed by the next call, or completed as a stop once start conditions are
+	// gone, so the pump is not left running on its own.
+	err := evokClient().SetValues(evokClient().Pending([]evok.Command{
+		{Dev: act.Pump.Dev, Circuit: act.Pump.Circuit, Value: 1},
+		{Dev: act.Switch.Dev, Circuit: act.Switch.Circuit, Value: 1},
+	}))
+	if err != nil {
 		log.Println(err)
+		startInterrupted = true
 		return
 	}
+	startInterrupted = false
 
 	circuitRunning = true
+	runningSince = time.Now()
+	if soft {
+		softStartedAt = runningSince
+	}
+	pumpStartsTotal.Inc()
 	circuitRunningMetric.Set(1)
-	time.Sleep(1 * time.Second)
+
+	if fillPhaseEnabled() {
+		startFillPhase()
+	}
+}
+
+// startFillPhase runs flow at maximum to prime drainback collector. Computed flow is used once the phase ends.
+func startFillPhase() {
+	log.Printf("Filling drainback collector for %s", controllerCfg().Drainback.FillDuration)
+	if err := setFlow(hass().GetSettings().Flow.DutyMax.Value); err != nil {
+		log.Println(err)
+	}
+	filling = true
+	fillEnd = time.Now().Add(controllerCfg().Drainback.FillDuration)
+	drainbackFillTotal.Inc()
 }
 
 // flow can range from 0 to 10.
@@ -138,8 +343,11 @@ func calculateFlow(delta float64) float64 {
 	// |____/
 	// |                  [ΔT]
 	// +------------------->
-	flowConfig := hass.GetSettings().Flow
+	return flowCurve(hass().GetSettings().Flow, delta)
+}
 
+// flowCurve returns flow duty for temperature delta with given flow settings.
+func flowCurve(flowConfig homeassistant.FlowSettings, delta float64) float64 {
 	if delta <= flowConfig.TempMin.Value {
 		return flowConfig.DutyMin.Value
 	}
@@ -160,7 +368,71 @@ func calculateFlow(delta float64) float64 {
 	return flow
 }
 
+// tankMaxFor returns the tank temperature limit. In cooling season the lower of TankMax and CoolingTankMax is used.
+// With smart tank max enabled the limit is raised when no more sun is expected today and lowered before that.
+func tankMaxFor(cfg homeassistant.Settings) float64 {
+	tankMax := cfg.TankMax.Value
+	if cfg.CoolingSeason.Value != 0 && cfg.CoolingTankMax.EntityID != "" && cfg.CoolingTankMax.Value < tankMax {
+		tankMax = cfg.CoolingTankMax.Value
+	}
+
+	if cfg.SmartTankMax.Value != 0 {
+		if noMoreSunToday(cfg, time.Now()) {
+			tankMax += cfg.TankMaxOvershoot.Value
+		} else {
+			tankMax -= cfg.TankMaxMorningReduction.Value
+		}
+	}
+
+	tankMaxMetric.Set(tankMax)
+	return tankMax
+}
+
+// noMoreSunToday uses solar forecast entity, if available, or SmartTankMaxHour to decide if harvest is over for today.
+func noMoreSunToday(cfg homeassistant.Settings, now time.Time) bool {
+	if featureEnabled(config.FeatureForecast) && cfg.SunRemaining.EntityID != "" && cfg.SunRemaining.Value <= 0 {
+		return true
+	}
+	return cfg.SmartTankMaxHour.Value > 0 && float64(now.Hour()) >= cfg.SmartTankMaxHour.Value
+}
+
+// pipeDelayed reports if water which stood in the pipe between collector outlet and SolarOut sensor may still be
+// passing the sensor after start.
+func pipeDelayed(now time.Time) bool {
+	return now.Sub(runningSince) < controllerCfg().PipeDelay
+}
+
+// inStartGrace reports if running circuit was started recently enough to be kept running despite low or negative
+// delta.
+func inStartGrace(now time.Time) bool {
+	return circuitRunning && now.Sub(runningSince) < controllerCfg().StartGrace
+}
+
+// nightCooldownEnabled reports if tank may be cooled down through the collector. Cooling season enables it by default.
+func nightCooldownEnabled(cfg homeassistant.Settings) bool {
+	return systemProfile().StagnationHandling && featureEnabled(config.FeatureNightCooldown) && (cfg.CoolingSeason.Value != 0 || cfg.NightCooldown.Value != 0)
+}
+
+// boostFlowForDHW raises flow while domestic hot water recirculation pump draws down the tank top, which improves
+// tank recovery after showers. Boosted flow never exceeds DutyMax.
+func boostFlowForDHW(flow float64, cfg homeassistant.Settings) float64 {
+	if cfg.DHWRecirculation.Value == 0 {
+		dhwBoostMetric.Set(0)
+		return flow
+	}
+
+	dhwBoostMetric.Set(1)
+	flow += cfg.DHWFlowBoost.Value
+	if flow > cfg.Flow.DutyMax.Value {
+		flow = cfg.Flow.DutyMax.Value
+	}
+	return flow
+}
+
 func setFlow(value float64) error {
+	requestedFlow = value
+	value = rampFlow(value, time.Now())
+
 	// FIXME: this is a workaround to scale down the flow to 0 - 10 range. Workaround is necessary as EVOK accepts only
 	// values from this range.
 	value = value / 10.0
@@ -174,11 +446,19 @@ func setFlow(value float64) error {
 		value = 10.0 - value
 	}
 
-	flowConfig := evokClient.GetActuators().Flow
-	if err := evokClient.SetValue(flowConfig.Dev, flowConfig.Circuit, value); err != nil {
+	// Flow valve locked out for maintenance stays where it was left.
+	if evokClient().IsLockedOut("flow") {
+		return nil
+	}
+
+	logging.Debugf("Setting flow to %.2f V, requested duty %.1f", value, requestedFlow)
+	flowConfig := evokClient().GetActuators().Flow
+	if err := evokClient().SetValue(flowConfig.Dev, flowConfig.Circuit, value); err != nil {
 		log.Println(err)
+		flowFailed = true
 		return err
 	}
+	flowFailed = false
 
 	systemStatus.Flow = value
 	flowRate.Set(value)
@@ -186,9 +466,87 @@ func setFlow(value float64) error {
 	return nil
 }
 
-func setStatus(s string) {
-	systemStatus.Mode = s
+// swapWarning is shown in status while SolarIn and SolarOut sensors are suspected swapped.
+const swapWarning = "SolarIn and SolarOut sensors are probably swapped"
+
+// checkSensorWiring flags physically implausible readings. With pump running in steady state the collector outlet
+// cannot be consistently colder than its inlet, so such readings indicate swapped SolarIn and SolarOut sensors. The
+// suspicion is cleared once readings are plausible for the same time in steady state, e.g. after rewiring.
+func checkSensorWiring(s *evok.Sensors) {
+	if !circuitRunning || coolingDown || preCirculating || time.Since(runningSince) < swapSteadyStateTime {
+		swapSuspectedFrom, swapPlausibleFrom = time.Time{}, time.Time{}
+		return
+	}
+
+	if s.SolarIn.Value <= s.SolarOut.Value+swapMargin {
+		swapSuspectedFrom = time.Time{}
+		if swapPlausibleFrom.IsZero() {
+			swapPlausibleFrom = time.Now()
+		}
+		if swapSuspected && time.Since(swapPlausibleFrom) >= swapDetectionTime {
+			log.Printf("SolarIn (%f) is no longer hotter than SolarOut (%f), sensors are no longer suspected swapped", s.SolarIn.Value, s.SolarOut.Value)
+			swapSuspected = false
+			sensorSwapMetric.Set(0)
+			removeWarning(swapWarning)
+		}
+		return
+	}
+
+	swapPlausibleFrom = time.Time{}
+	if swapSuspectedFrom.IsZero() {
+		swapSuspectedFrom = time.Now()
+	}
+	if time.Since(swapSuspectedFrom) >= swapDetectionTime && !swapSuspected {
+		log.Printf("SolarIn (%f) is consistently hotter than SolarOut (%f), sensors are probably swapped", s.SolarIn.Value, s.SolarOut.Value)
+		swapSuspected = true
+		sensorSwapMetric.Set(1)
+		addWarning(swapWarning)
+		notifyEvent(config.EventSensorSwap)
+	}
+}
+
+// addWarning shows warning in status unless it is already shown.
+func addWarning(warning string) {
+	for _, w := range systemStatus.Warnings {
+		if w == warning {
+			return
+		}
+	}
+	systemStatus.Warnings = append(systemStatus.Warnings, warning)
+}
+
+// removeWarning stops showing warning in status.
+func removeWarning(warning string) {
+	var warnings []string
+	for _, w := range systemStatus.Warnings {
+		if w != warning {
+			warnings = append(warnings, w)
+		}
+	}
+	systemStatus.Warnings = warnings
+}
+
+// setStatus switches reported mode, a stable identifier accompanied by display text. Reason explains the decision with the numbers it was based on. Mode changes are
+// also fired as Home Assistant events.
+func setStatus(m mode, reason string) {
+	changed := systemStatus.Mode != m
+	systemStatus.Mode = m
+	systemStatus.ModeText = m.text()
+	systemStatus.Reason = reason
 	systemStatus.Since = time.Now().Unix()
+	if !changed {
+		return
+	}
+
+	log.Printf("Mode changed to %s: %s", m, reason)
+	recordEvent("mode:"+string(m), reason)
+	sendToHA("fire mode change event", func(c *homeassistant.Client) error {
+		return c.FireEvent(modeChangedEventType, map[string]interface{}{
+			"mode":      m,
+			"mode_text": m.text(),
+			"reason":    reason,
+		})
+	})
 }
 
 func httpStatus(w http.ResponseWriter, r *http.Request) {
@@ -213,7 +571,36 @@ func httpHealthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// newHassClient creates Home Assistant client for configuration. Emergency entities which are unavailable are
+// handled according to configured policy.
+func newHassClient(cfg *config.Config) *homeassistant.Client {
+	client := homeassistant.NewClient(hassAddress, currentToken(), layeredSettings(cfg))
+	client.SetBounds(config.SettingBounds)
+
+	emergency := 1.0
+	if cfg.Controller.EmergencyUnavailable == config.EmergencyFailOpen {
+		emergency = 0
+	}
+	client.SetFallback("solarEmergency", emergency)
+	client.SetFallback("solarEmergencySoft", emergency)
+	if s := cfg.Controller.TankMaxSchedule; !s.Empty() {
+		client.SetSchedule("tankMax", s)
+	}
+	return client
+}
+
 func init() {
+	// Subcommands run instead of the controller
+	if len(os.Args) > 1 && os.Args[1] == "curve" {
+		os.Exit(runCurve(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tune" {
+		os.Exit(runTune(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
 	circuitRunning = false
 
 	configFile := flag.String("config", "", "Provide configuration file with MQTT topic mappings")
@@ -221,152 +608,632 @@ func init() {
 	eaddr := flag.String("evok-address", "localhost:8080", "EVOK API address (default: localhost:8080)")
 	haddr := flag.String("homeassistant-address", "localhost:8123", "HomeAssistant API address (default: localhost:8123)")
 	htoken := flag.String("homeassistant-token", "", "HomeAssistant API token")
+	htokenFile := flag.String("homeassistant-token-file", "", "File with HomeAssistant API token, re-read periodically so the token can be rotated at runtime")
+	stateFile := flag.String("state-file", "/var/lib/solar/state.json", "File used to persist controller state across restarts")
+	faults := flag.Bool("fault-injection", false, "Enable fault injection admin endpoint /debug/faults for chaos testing")
+	simulate := flag.Bool("simulate", false, "Run without EVOK, sensors are set over /sim/sensors and actuator commands are only recorded")
+	flag.DurationVar(&serverOptions.readTimeout, "http-read-timeout", 10*time.Second, "Maximum duration for reading HTTP request")
+	flag.DurationVar(&serverOptions.writeTimeout, "http-write-timeout", 30*time.Second, "Maximum duration for writing HTTP response")
+	flag.DurationVar(&serverOptions.idleTimeout, "http-idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on keep-alive connection")
+	flag.IntVar(&serverOptions.maxHeaderBytes, "http-max-header-bytes", 16<<10, "Maximum size of HTTP request headers")
+	flag.BoolVar(&serverOptions.logRequests, "http-log-requests", false, "Log every HTTP request")
+	flag.StringVar(&publicAddress, "public-address", "", "Address of read-only status and sensors for display devices, e.g. :7002, empty disables it")
+	flag.Float64Var(&publicRate, "public-rate-limit", 5, "Requests per second served to each client on public address")
+	corsOrigins := flag.String("cors-origins", "", "Comma separated origins allowed to read status and sensors from browser, \"*\" allows any")
+	flag.StringVar(&trendDir, "trend-dir", "", "Directory for monthly CSV files with hourly aggregates, empty disables them")
+	flag.DurationVar(&trendRetention, "trend-retention", 2*365*24*time.Hour, "How long trend files are kept, 0 keeps them forever")
+	algorithmName := flag.String("algorithm", algorithmAdaptive, "Control algorithm: legacy or adaptive. Home Assistant algorithm entity takes precedence")
+	logLevel := flag.String("log-level", logging.LevelInfo, "Log verbosity: info or debug, can be changed at runtime over /debug/loglevel")
+	language := flag.String("status-language", defaultLanguage, "Language of mode display text in status and events: en or pl")
+	flag.StringVar(&backupKeyFile, "backup-key-file", "", "File with passphrase encrypting backups served on /api/v1/backup, empty disables backups")
+	flag.StringVar(&crashDir, "crash-dir", "/var/lib/solar", "Directory for crash reports written when the controller panics, empty disables them")
+	flag.Var(flagSettings, "setting", "Set value of a setting as name=value, can be repeated. Home Assistant entities take precedence")
 	flag.Parse()
 
+	if err := logging.SetLevel(*logLevel, 0); err != nil {
+		log.Fatal(err)
+	}
+	if err := setStatusLanguage(*language); err != nil {
+		log.Fatal(err)
+	}
+	if *corsOrigins != "" {
+		serverOptions.corsOrigins = strings.Split(*corsOrigins, ",")
+	}
+	if publicAddress != "" && publicRate <= 0 {
+		log.Fatal("public-rate-limit must be positive")
+	}
+
 	invertFlow = *invert
 	if invertFlow {
 		log.Println("Setting inverted mode for actuator - higher voltage causes less flow")
 	}
 
 	// Load configuration
+	configPath = config.Path(configFile)
 	configClient, err := config.NewConfig(configFile)
 	if err != nil {
 		log.Fatalf("Error synthesizing configuration: %v", err)
 	}
+	envSettings, err = config.EnvLayer(os.Environ())
+	if err != nil {
+		log.Fatalf("Error reading settings from environment: %v", err)
+	}
 
 	// Set Home Assistant address, token, and entities configuration
-	hass = homeassistant.NewClient(*haddr, *htoken, *configClient.GetSettingsConfig())
+	hassAddress, hassToken, evokAddress = *haddr, *htoken, *eaddr
+	if *htokenFile != "" {
+		hassTokenFile = *htokenFile
+		if hassToken, err = readTokenFile(); err != nil {
+			log.Fatalf("Error reading HomeAssistant token: %v", err)
+		}
+	}
+	newHass := newHassClient(configClient)
+
+	// Set EVOK address and entities configuration
+	if *faults {
+		fault.Enable()
+	}
+
+	simulation = *simulate
+	var newEvok *evok.Client
+	if simulation {
+		log.Println("Running in simulation mode")
+		newEvok = evok.NewSimulatedClient(*configClient.GetSensorsConfig(), *configClient.GetActuatorsConfig())
+	} else {
+		newEvok = evok.NewClient(*eaddr, *configClient.GetSensorsConfig(), *configClient.GetActuatorsConfig())
+	}
+
+	running.Store(newRuntimeConfig(configClient, newHass, newEvok))
+	log.Printf("Using system profile %#v", systemProfile())
+
+	// Home Assistant is optional, settings from other configuration layers are used until it becomes reachable
+	if err := syncSettings(hass()); err != nil {
+		log.Printf("Error getting settings from HomeAssistant, continuing with configured values: %v", err)
+	}
 
-	// Initialize configuration values
-	err = hass.UpdateAll()
+	stateStore, err = state.NewStore(*stateFile)
 	if err != nil {
-		log.Fatalf("Error getting settings from HomeAssistant: %v", err)
+		log.Fatalf("Error loading controller state: %v", err)
+	}
+	loadPumpRuntime()
+	loadLastPumpRun()
+	loadWarmUp()
+	loadLastValveExercise()
+	loadCounters()
+	loadBaseline()
+	loadHeatUp()
+	if err := checkTrendDir(); err != nil {
+		log.Fatal(err)
 	}
 
-	// Set EVOK address and entities configuration
-	evokClient = evok.NewClient(*eaddr, *configClient.GetSensorsConfig(), *configClient.GetActuatorsConfig())
+	exportOnUpdate(evokClient())
+	recoverClientCrash(evokClient())
 
 	// Initialize sensors values
-	err = evokClient.InitializeSensorsValues()
+	// EVOK is the only required dependency, the controller can't protect the installation without sensors
+	err = evokClient().InitializeSensorsValues()
+	markSync(dependencyEVOK, err)
 	if err != nil {
 		log.Fatalf("Error initializing sensors: %v", err)
 	}
 
-	setStatus("startup")
+	if err := setProfile(defaultProfile); err != nil {
+		log.Println(err)
+	}
+	syncProfileFromHA()
+	if err := setAlgorithm(*algorithmName); err != nil {
+		log.Fatal(err)
+	}
+	syncAlgorithmFromHA()
+	syncLockoutFromHA()
+	syncFeaturesFromHA()
+
+	setStatus(modeStartup, "controller started")
 
 	//circuitRunning = true
 	//stop("SYSTEM RESET")
 }
 
 func main() {
+	defer recoverCrash("control loop")
+
 	go func() {
 		// Expose metrics
-		http.Handle("/metrics", promhttp.Handler())
-		// Expose config
-		http.HandleFunc("/config", hass.ExposeSettingsOnHTTP)
+		// OpenMetrics format is needed to expose exemplars of safety event counters
+		handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+		// Expose config. Clients can be swapped when new configuration is applied, so handlers are resolved per request.
+		handleFunc("/config", func(w http.ResponseWriter, r *http.Request) { hass().ExposeSettingsOnHTTP(w, r) })
+		// Change runtime settings with write-through to HomeAssistant
+		handleFunc("/api/v1/settings", func(w http.ResponseWriter, r *http.Request) { hass().HandleSettingsAPI(w, r) })
+		handleFunc("/api/v1/settings/history", func(w http.ResponseWriter, r *http.Request) { hass().ExposeHistoryOnHTTP(w, r) })
+		handleFunc("/api/v1/settings/rollback", func(w http.ResponseWriter, r *http.Request) { hass().HandleRollbackAPI(w, r) })
+		// Re-read settings of a single entity when Home Assistant reports its change
+		handleFunc("/api/v1/settings/refresh", func(w http.ResponseWriter, r *http.Request) { hass().HandleRefreshAPI(w, r) })
+		// Switch operating profile
+		handleFunc("/api/v1/profile", httpProfile)
+		// Lock actuators out for maintenance
+		handleFunc("/api/v1/lockout", httpLockout)
+		// Override flow manually for a limited time
+		handleFunc("/api/v1/override", httpOverride)
+		// Recent events, also used by ctl subcommand
+		handleFunc("/api/v1/events", httpEvents)
+		// Validate and apply new configuration
+		handleFunc("/api/v1/config/preview", httpConfigPreview)
+		handleFunc("/api/v1/config/apply", httpConfigApply)
+		handleFunc("/config/effective", httpConfigEffective)
+		// Download encrypted backup of configuration and state or restore it
+		handleFunc("/api/v1/backup", httpBackup)
 		// Report current status
-		http.HandleFunc("/status", httpStatus)
+		handle("/status", allowCORS(http.HandlerFunc(httpStatus), serverOptions.corsOrigins))
 		// Expose current sensors data
-		http.HandleFunc("/sensors", evokClient.ExposeSensorsOnHTTP)
+		handle("/sensors", allowCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			evokClient().ExposeSensorsOnHTTP(w, r)
+		}), serverOptions.corsOrigins))
+		// Relay EVOK device updates to other services
+		handleFunc("/api/v1/evok/stream", func(w http.ResponseWriter, r *http.Request) {
+			evokClient().StreamUpdates(w, r, streamDuration())
+		})
+		// Bench testing endpoints
+		if simulation {
+			handleFunc("/sim/sensors", func(w http.ResponseWriter, r *http.Request) { evokClient().HandleSimulatedSensors(w, r) })
+			handleFunc("/sim/actuators", func(w http.ResponseWriter, r *http.Request) { evokClient().ExposeSimulatedActuatorsOnHTTP(w, r) })
+		}
+		// Fault injection admin endpoint, disabled unless enabled by flag
+		handleFunc("/debug/faults", fault.HandleHTTP)
+		// Show order of control loop steps and the last decision
+		handleFunc("/debug/decision", httpDecision)
+		// Change log verbosity without restart
+		handleFunc("/debug/loglevel", logging.HandleHTTP)
 		// Expose healthcheck
-		http.HandleFunc("/health", httpHealthCheck)
-		err := http.ListenAndServe(":7001", nil)
+		handleFunc("/health", httpHealthCheck)
+		// Show synchronization status of external dependencies
+		handleFunc("/dependencies", httpDependencies)
+		// Download diagnostics bundle for bug reports
+		handleFunc("/diagnostics", httpDiagnostics)
+		err := newServer(httpAddress, http.DefaultServeMux).ListenAndServe()
 		if err != nil {
 			panic("HTTP Server for metrics exposition failed: " + err.Error())
 		}
 	}()
 
-	// periodically refresh settings
-	go func() {
-		for {
-			time.Sleep(2 * time.Minute)
-			err := hass.UpdateAll()
-			if err != nil {
-				log.Printf("Error getting settings from HomeAssistant: %v", err)
-			}
-		}
-	}()
+	// Subsystems are restarted by supervisor on failure without stopping the control loop
+	if publicAddress != "" {
+		go servePublic()
+	}
 
-	go evokClient.HandleWebsocketConnection()
+	go supervise(settingsSubsystem())
+	go supervise(websocketSubsystem())
+	go driveStatusLED()
+	go petWatchdog()
 
 	// reductionDuration := time.Duration(config.ReducedTime) * time.Minute
 	reductionDuration := 30 * time.Minute
 	reducedTill := time.Now()
 	reducedMode := false
 	delta := 0.0
+
+	// Ticker keeps consistent cadence of decisions regardless of how long an iteration takes. Loop body ends with
+	// continue in many places, so iteration duration is measured when control gets back to the top of the loop.
+	ticker := time.NewTicker(controlInterval)
+	defer ticker.Stop()
+	var iterationStart time.Time
 	for {
-		time.Sleep(5 * time.Second)
+		if !iterationStart.IsZero() {
+			loopDuration.Observe(time.Since(iterationStart).Seconds())
+		}
+		now := <-ticker.C
+		if !iterationStart.IsZero() {
+			drift := now.Sub(iterationStart) - controlInterval
+			loopDrift.Set(drift.Seconds())
+			if drift >= controlInterval {
+				log.Printf("Control loop is late by %s, previous iteration took too long", drift)
+			}
+		}
+		iterationStart = now
+		newIterationID()
+		checkClock(now)
+		debounceTick()
+		observeReducedMode(reducedMode, reducedTill, now)
+
+		addPumpRuntime(time.Since(lastPass))
 		lastPass = time.Now()
+		persistState(false)
+		applyPendingConfig()
+		handleExternalChanges()
 
-		s := evokClient.GetSensors()
+		s := evokClient().GetSensors()
 
-		cfg := hass.GetSettings()
+		cfg := hass().GetSettings()
+		systemStatus.StaleSettings = cfg.Stale()
+		systemStatus.TokenInvalid = hass().TokenInvalid()
 
-		if cfg.SolarEmergency.Value != 0 && circuitRunning {
-			setStatus("emergency shutoff")
-			stop("Emergency shutoff")
-			emergencyTotal.Inc()
+		if cfg.SolarEmergency.Value != 0 {
+			if !hardEmergency {
+				hardEmergency = true
+				emergencyTotal.incWithExemplar()
+				setStatus(modeEmergencyShutoff, fmt.Sprintf("solarEmergency %s is on", cfg.SolarEmergency.EntityID))
+				notifyEvent(config.EventEmergency)
+				deenergizeAll(fmt.Sprintf("Hard emergency shutoff in iteration %s", iterationID))
+			}
+			decide(stepEmergency)
+			continue
+		}
+		if hardEmergency {
+			log.Println("Hard emergency cleared, accepting actuator commands again")
+			hardEmergency = false
+			evokClient().SetInhibited(false)
+			setStatus(modeStopped, fmt.Sprintf("solarEmergency %s is off", cfg.SolarEmergency.EntityID))
+		}
+
+		systemStatus.Degraded = degradedCapabilities()
+		if sensorFaultHold(s) {
+			decide(stepSensorFault)
 			continue
 		}
 
-		delta = (s.SolarUp.Value+s.SolarOut.Value)/2 - s.SolarIn.Value
+		endPumpKick(time.Now())
+		continueValveExercise(time.Now())
+		continueRamp()
+		alg := currentAlgorithm()
+
+		sensors := sensorValues(s)
+		delta = rawDelta(s, sensors)
+		window := time.Duration(cfg.DeltaWindow.Value * float64(time.Second))
+		if !alg.smoothing {
+			window = 0
+		}
+		delta = smoothDelta(delta, window, time.Now())
 		systemStatus.Delta = delta
 		controlDelta.Set(delta)
+		observeHarvest(delta, time.Now())
+		observeDay(s, time.Now())
+		observeTrends(s, delta, time.Now())
+
+		checkSensorWiring(s)
+		observeTankSensor(s, delta, time.Now())
+		observeHeatUp(s, time.Now())
+		observeAir(delta, cfg.MeasuredFlow, time.Now())
+		observeValve(delta, time.Now())
+		scaldDetected := scalding(s)
+		updateTankEnergy(s, tankMaxFor(cfg))
+		coordinateBackupHeater(s, cfg, time.Now())
+
+		// Purge after failsafe stop. Safety event which caused it is handled once the circuit stops.
+		if continuePurge(time.Now()) {
+			decide(stepPurge)
+			continue
+		}
+
+		// Single bad sample doesn't trip failsafe when critical is debounced, unless it is far above the limit.
+		critical := s.SolarUp.Value >= cfg.SolarCritical.Value
+		if circuitRunning && (confirmed(config.TransitionCritical, critical) ||
+			critical && beyond(s.SolarUp.Value, cfg.SolarCritical.Value, controllerCfg().DebounceBypass.Critical)) {
+			if failsafe(config.EventCritical, modeFailsafeShutdown, fmt.Sprintf("solarUp %.1f ≥ solarCritical %.1f", s.SolarUp.Value, cfg.SolarCritical.Value)) {
+				failsafeTotal.incWithExemplar()
+			}
+			decide(stepCritical)
+			continue
+		}
+
+		// Lockout is handled after critical temperature, so a running circuit is stopped by failsafe first.
+		if name, locked := circuitLockedOut(); locked {
+			reason := fmt.Sprintf("%s is locked out for maintenance", name)
+			setStatus(modeMaintenanceLockout, reason)
+			if circuitRunning {
+				stop(reason)
+			}
+			decide(stepLockout)
+			continue
+		}
+
+		// Soft emergency parks the system in min-flow standby. Only critical temperature is still handled.
+		if cfg.SolarEmergencySoft.Value != 0 {
+			if !softEmergency {
+				softEmergency = true
+				softEmergencyTotal.incWithExemplar()
+				log.Printf("Soft emergency in iteration %s, parking the system in min-flow standby", iterationID)
+				setStatus(modeEmergencyStandby, fmt.Sprintf("solarEmergencySoft %s is on", cfg.SolarEmergencySoft.EntityID))
+				coolingDown = false
+				preCirculating = false
+				filling = false
+				frostProtecting = false
+				if circuitRunning {
+					if err := setFlow(cfg.Flow.DutyMin.Value); err != nil {
+						log.Println(err)
+					}
+				}
+			}
+			decide(stepSoftEmergency)
+			continue
+		}
+		if softEmergency {
+			log.Println("Soft emergency cleared, resuming normal operation")
+			softEmergency = false
+		}
+
+		// Drainback fill phase. Collector readings are meaningless until the loop is primed.
+		if filling {
+			if time.Now().Before(fillEnd) {
+				decide(stepFill)
+				continue
+			}
+			filling = false
+			log.Println("Drainback fill phase finished")
+		}
+
+		tankMax := tankMaxFor(cfg)
+		coolingSeasonMetric.Set(cfg.CoolingSeason.Value)
+
+		// Night cooldown. Tank is above its limit and collector is colder than the tank, so the heat is dumped
+		// through the collector. This runs until tank gets back to its limit or collector is no longer colder.
+		// High stagnation risk arms it with a lower limit to make room in the tank before the next hot day.
+		// Pump rest applies to it as well, the heat can be dumped once the rest is over.
+		cooldownMax, cooldownEnabled := cooldownLimit(cfg, tankMax, time.Now())
+		if coolingDown {
+			if pumpRest(time.Now()) {
+				coolingDown = false
+				preempt(stepPumpRest, stepNightCooldown)
+				continue
+			}
+			if !cooldownEnabled || s.TankUp.Value <= cooldownMax || s.SolarUp.Value >= s.TankUp.Value {
+				reason := fmt.Sprintf("night cooldown finished, tankUp %.1f, limit %.1f, solarUp %.1f", s.TankUp.Value, cooldownMax, s.SolarUp.Value)
+				setStatus(modeStopped, reason)
+				stop(reason)
+			}
+			decide(stepNightCooldown)
+			continue
+		}
+
+		if cooldownEnabled && !circuitRunning && !resting(time.Now()) && confirmed(config.TransitionNightCooldown, s.TankUp.Value > cooldownMax && s.TankUp.Value-s.SolarUp.Value >= cfg.SolarOn.Value) {
+			log.Printf("Tank above limit (%f > %f) and collector is colder, starting night cooldown", s.TankUp.Value, cooldownMax)
+			setStatus(modeNightCooldown, fmt.Sprintf("tankUp %.1f > limit %.1f and tankUp - solarUp %.1f ≥ solarOn %.1f", s.TankUp.Value, cooldownMax, s.TankUp.Value-s.SolarUp.Value, cfg.SolarOn.Value))
+			start()
+			if err := setFlow(cfg.Flow.DutyMax.Value); err != nil {
+				log.Println(err)
+			}
+			coolingDown = circuitRunning
+			nightCooldownTotal.Inc()
+			decide(stepNightCooldown)
+			continue
+		}
+
+		// Frost protection. Warm tank water is circulated until collector gets safely above freezing point.
+		if systemProfile().FrostProtection {
+			frostTemperature := controllerCfg().GetFrostTemperature()
+			if frostProtecting {
+				if s.SolarUp.Value >= frostTemperature+frostHysteresis {
+					reason := fmt.Sprintf("frost protection finished, solarUp %.1f ≥ %.1f", s.SolarUp.Value, frostTemperature+frostHysteresis)
+					setStatus(modeStopped, reason)
+					stop(reason)
+				}
+				decide(stepFrost)
+				continue
+			}
+			// Frost protection preempts reduced mode, which would stop the pump once reduction period ends.
+			if reducedMode && s.SolarUp.Value <= frostTemperature {
+				reducedMode = false
+				reducedModeMetric.Set(0)
+				setStatus(modeFrostProtection, fmt.Sprintf("solarUp %.1f ≤ frostTemperature %.1f", s.SolarUp.Value, frostTemperature))
+				if err := setFlow(cfg.Flow.DutyMin.Value); err != nil {
+					log.Println(err)
+				}
+				frostProtecting = true
+				frostProtectionTotal.Inc()
+				preempt(stepFrost, stepReduced)
+				continue
+			}
+			if !circuitRunning && confirmed(config.TransitionFrost, s.SolarUp.Value <= frostTemperature) {
+				log.Printf("Collector temperature %f is close to freezing, starting frost protection", s.SolarUp.Value)
+				setStatus(modeFrostProtection, fmt.Sprintf("solarUp %.1f ≤ frostTemperature %.1f", s.SolarUp.Value, frostTemperature))
+				start()
+				if err := setFlow(cfg.Flow.DutyMin.Value); err != nil {
+					log.Println(err)
+				}
+				frostProtecting = circuitRunning
+				frostProtectionTotal.Inc()
+				decide(stepFrost)
+				continue
+			}
+		}
+
+		if circuitRunning && confirmed(config.TransitionTankFull, s.TankUp.Value > tankMax) {
+			if reducedMode {
+				reducedMode = false
+				reducedModeMetric.Set(0)
+				preempt(stepTankFull, stepReduced)
+			}
+			if failsafe(config.EventTankFull, modeTankFull, fmt.Sprintf("tankUp %.1f > tankMax %.1f", s.TankUp.Value, tankMax)) {
+				tankfullTotal.incWithExemplar()
+			}
+			decide(stepTankFull)
+			continue
+		}
 
-		if s.SolarUp.Value >= cfg.SolarCritical.Value && circuitRunning {
-			setStatus("failsafe shutdown")
-			stop(fmt.Sprintf("Critical Solar Temperature reached: %f degrees", s.SolarUp.Value))
-			failsafeTotal.Inc()
+		if tankSensorHold(time.Now()) {
+			if reducedMode {
+				reducedMode = false
+				reducedModeMetric.Set(0)
+				preempt(stepTankSensor, stepReduced)
+			}
+			decide(stepTankSensor)
 			continue
 		}
 
-		if s.TankUp.Value > cfg.TankMax.Value && circuitRunning {
-			setStatus("tank filled")
-			stop(fmt.Sprintf("Tank filled with hot water: %f degrees", s.TankUp.Value))
-			tankfullTotal.Inc()
+		if scaldDetected && controllerCfg().AntiScald.Action == config.AntiScaldCutCharge {
+			if circuitRunning {
+				reason := fmt.Sprintf("dhwOutlet %.1f > scald threshold %.1f, mixing valve failed", s.DHWOutlet.Value, controllerCfg().AntiScald.Threshold)
+				setStatus(modeScaldProtection, reason)
+				stop(reason)
+			}
+			decide(stepScald)
+			continue
+		}
+
+		if pumpRest(time.Now()) {
+			if reducedMode {
+				reducedMode = false
+				reducedModeMetric.Set(0)
+				preempt(stepPumpRest, stepReduced)
+			}
+			decide(stepPumpRest)
 			continue
 		}
 
 		// heat escape prevention. If delta is less than 0, then system is heating up solar panel
 		// calculation need to be based on formula: (solar+out)/2 - in
-		if delta < 0 && circuitRunning {
-			setStatus("heat escape prevention mode")
-			stop(fmt.Sprintf("Heat escape prevention, delta: %f < 0", delta))
-			heatEscapeTotal.Inc()
+		heatEscape := delta < 0 && !pipeDelayed(time.Now()) && !inStartGrace(time.Now())
+		if circuitRunning && (confirmed(config.TransitionHeatEscape, heatEscape) ||
+			heatEscape && beyond(-delta, 0, controllerCfg().DebounceBypass.HeatEscape)) {
+			if failsafe(config.EventHeatEscape, modeHeatEscape, fmt.Sprintf("delta %.1f < 0", delta)) {
+				heatEscapeTotal.incWithExemplar()
+			}
+			decide(stepHeatEscape)
+			continue
+		}
+
+		if activeFailsafe != "" {
+			clearFailsafe()
+		}
+
+		// User-defined rules can't override safety handling above.
+		vars := ruleVariables(sensors, cfg, delta)
+		rulesOutcome := evaluateRules(vars)
+		if rulesOutcome.stop != "" {
+			if circuitRunning {
+				reason := fmt.Sprintf("rule %s condition holds", rulesOutcome.stop)
+				setStatus(modeStopped, reason)
+				stop(reason)
+			}
+			decide(stepRules)
 			continue
 		}
 
-		if delta > cfg.SolarOff.Value {
+		// Pre-circulation pulse brings real collector outlet temperature to the SolarOut sensor. Once it is done,
+		// start condition is evaluated again with fresh readings.
+		if preCirculating {
+			if time.Now().Before(preCirculationEnd) {
+				decide(stepPreCirculation)
+				continue
+			}
+			preCirculating = false
+			canStart, why := startCondition(vars, s, cfg, delta)
+			if !canStart {
+				reason := "pre-circulation did not confirm start, " + why
+				setStatus(modeStopped, reason)
+				stop(reason)
+				decide(stepPreCirculation)
+				continue
+			}
+			log.Println("Pre-circulation confirmed start conditions")
+			setStatus(modeWorking, "pre-circulation confirmed "+why)
+		}
+
+		// Fallback thermostat keeps harvesting without regulated flow. Flow rules and reduced mode rely on flow
+		// regulation, so they are not used.
+		if reason, ok := thermostatReason(cfg); ok {
+			if reducedMode {
+				reducedMode = false
+				reducedModeMetric.Set(0)
+			}
+			runThermostat(s, reason)
+			if !kickIdlePump(time.Now()) && !exerciseIdleValves(time.Now()) {
+				decide(stepThermostat)
+			}
+			continue
+		}
+		leaveThermostat()
+
+		// Running circuit keeps working with calculated flow until low delta is confirmed.
+		lowDelta := delta <= cfg.SolarOff.Value
+		if reducedMode {
+			// Returning to working mode needs delta above the deadband, so delta hovering at solarOff doesn't toggle
+			// between modes.
+			lowDelta = delta <= cfg.SolarOff.Value+cfg.SolarOffDeadband.Value
+		}
+		if circuitRunning && !reducedMode {
+			lowDelta = confirmed(config.TransitionReduced, lowDelta && !inStartGrace(time.Now()))
+		}
+		if !lowDelta {
+			firstStart := false
 			// if sensors.SolarUp.Value-sensors.SolarOut.Value > settings.SolarOn.Value {
-			if delta >= cfg.SolarOn.Value && s.SolarUp.Value > s.SolarOut.Value && !circuitRunning {
-				setStatus("working")
+			canStart, why := startCondition(vars, s, cfg, delta)
+			if !circuitRunning && confirmed(config.TransitionStart, canStart) {
+				today := time.Now().Format("2006-01-02")
+				// Drainback fill phase already brings collector outlet temperature to the sensor.
+				if controllerCfg().PreCirculation > 0 && !fillPhaseEnabled() && lastStartDay != today {
+					lastStartDay = today
+					log.Printf("First start of the day, running pre-circulation for %s", controllerCfg().PreCirculation)
+					setStatus(modePreCirculation, "first start of the day, "+why)
+					start()
+					if err := setFlow(cfg.Flow.DutyMin.Value); err != nil {
+						log.Println(err)
+					}
+					preCirculating = circuitRunning
+					preCirculationEnd = time.Now().Add(controllerCfg().PreCirculation)
+					preCirculationTotal.Inc()
+					decide(stepPreCirculation)
+					continue
+				}
+				firstStart = lastStartDay != today
+				lastStartDay = today
+				setStatus(modeWorking, why)
 				start()
+				if filling {
+					decide(stepFill)
+					continue
+				}
 			}
 			flow := calculateFlow(delta)
+			if alg.dhwBoost {
+				flow = boostFlowForDHW(flow, cfg)
+			}
+			if rulesOutcome.flowRule != "" {
+				flow = rulesOutcome.flow
+			}
+			if override, ok := flowOverride(now); ok {
+				flow = override
+			}
 			if err := setFlow(flow); err != nil {
 				log.Println(err)
 			}
+			if firstStart && circuitRunning {
+				recordWarmUp(now, flow)
+			}
 			reducedTill = time.Now().Add(reductionDuration)
+			decide(stepWorking)
 		} else if time.Now().Before(reducedTill) {
-			// Reduced heat exchange. Set Flow to minimal value.
+			// Reduced heat exchange. Flow goes down to minimal value.
 			if !reducedMode {
 				log.Println("Entering reduced heat exchange mode")
-				setStatus("reduced mode")
-				if err := setFlow(cfg.Flow.DutyMin.Value); err != nil {
+				setStatus(modeReduced, fmt.Sprintf("delta %.1f ≤ solarOff %.1f, keeping minimal flow until %s", delta, cfg.SolarOff.Value, wallTime(reducedTill).Format("15:04")))
+				startFlowDecay(time.Now())
+				if err := setFlow(decayedFlow(cfg.Flow.DutyMin.Value, time.Now())); err != nil {
 					log.Println(err)
 				} else {
 					reducedMode = true
 					reducedModeMetric.Set(1)
 				}
+			} else if flowDecaying() {
+				if err := setFlow(decayedFlow(cfg.Flow.DutyMin.Value, time.Now())); err != nil {
+					log.Println(err)
+				}
 			}
+			decide(stepReduced)
 		} else {
 			// Delta SolarIn - SolarOut is too low.
 			reducedMode = false
 			reducedModeMetric.Set(0)
-			if circuitRunning {
-				setStatus("stopped")
-				stop(fmt.Sprintf("Temperature delta too low: %f", delta))
+			if circuitRunning || startInterrupted {
+				reason := fmt.Sprintf("delta %.1f ≤ solarOff %.1f for %s", delta, cfg.SolarOff.Value+cfg.SolarOffDeadband.Value, reductionDuration)
+				setStatus(modeStopped, reason)
+				stop(reason)
+			}
+			if kickIdlePump(time.Now()) || exerciseIdleValves(time.Now()) {
+				continue
 			}
+			warmUpValve(now)
+			decide(stepStopped)
 		}
 	}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+const (
+	pumpRuntimeKey     = "pumpRuntimeSeconds"
+	statePersistPeriod = 5 * time.Minute
+)
+
+var (
+	pumpRuntime      time.Duration
+	lastStatePersist time.Time
+)
+
+var (
+	pumpRuntimeTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "pump_runtime_seconds_total",
+		Help:      "Cumulative pump run time, persisted across restarts",
+	})
+	maintenanceDueMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "pump_maintenance_due",
+		Help:      "Set when pump run hours exceeded configured maintenance interval",
+	})
+)
+
+// loadPumpRuntime restores pump run time from the state store.
+func loadPumpRuntime() {
+	var seconds float64
+	if _, err := stateStore.Get(pumpRuntimeKey, &seconds); err != nil {
+		log.Println(err)
+		return
+	}
+	pumpRuntime = time.Duration(seconds * float64(time.Second))
+	pumpRuntimeTotal.Add(seconds)
+	systemStatus.PumpHours = pumpRuntime.Hours()
+	log.Printf("Restored pump run time: %.1f hours", pumpRuntime.Hours())
+}
+
+// addPumpRuntime accounts elapsed time when the pump is running.
+func addPumpRuntime(elapsed time.Duration) {
+	if !circuitRunning || elapsed <= 0 {
+		return
+	}
+	pumpRuntime += elapsed
+	lastPumpRun = time.Now()
+	lastValveExercise = lastPumpRun
+	pumpRuntimeTotal.Add(elapsed.Seconds())
+	systemStatus.PumpHours = pumpRuntime.Hours()
+}
+
+// maintenanceDue reports if pump run hours exceeded configured maintenance interval.
+func maintenanceDue() bool {
+	hours := controllerCfg().Maintenance.Hours
+	return hours > 0 && pumpRuntime.Hours() >= hours
+}
+
+// persistState writes state to disk and publishes maintenance flag. It is rate limited unless forced.
+func persistState(force bool) {
+	if atomic.LoadInt32(&stateFrozen) == 1 || (!force && time.Since(lastStatePersist) < statePersistPeriod) {
+		return
+	}
+	lastStatePersist = time.Now()
+
+	if err := stateStore.Set(pumpRuntimeKey, pumpRuntime.Seconds()); err != nil {
+		log.Println(err)
+	}
+	storeLastPumpRun()
+	storeLastValveExercise()
+	storeWarmUp()
+	storeCounters()
+	storeBaseline()
+	storeHeatUp()
+	if err := stateStore.Save(); err != nil {
+		log.Printf("Could not persist controller state: %v", err)
+	}
+
+	due := maintenanceDue()
+	if due {
+		maintenanceDueMetric.Set(1)
+	} else {
+		maintenanceDueMetric.Set(0)
+	}
+
+	entity := controllerCfg().Maintenance.EntityID
+	if entity == "" {
+		return
+	}
+	state := "off"
+	if due {
+		state = "on"
+	}
+	attributes := map[string]interface{}{
+		"friendly_name":     "Solar pump maintenance due",
+		"pump_hours":        fmt.Sprintf("%.1f", pumpRuntime.Hours()),
+		"maintenance_hours": controllerCfg().Maintenance.Hours,
+	}
+	sendToHA("publish maintenance state", func(c *homeassistant.Client) error {
+		return c.PublishState(entity, state, attributes)
+	})
+}
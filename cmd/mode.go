@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// mode is a stable machine-readable identifier of controller mode, reported in status and Home Assistant events.
+// Values must not change, as automations depend on them. Human-readable text comes from modeTexts.
+type mode string
+
+const (
+	modeStartup            mode = "startup"
+	modeStopped            mode = "stopped"
+	modeWorking            mode = "working"
+	modeReduced            mode = "reduced"
+	modeEmergencyShutoff   mode = "emergency_shutoff"
+	modeEmergencyStandby   mode = "emergency_standby"
+	modeMaintenanceLockout mode = "maintenance_lockout"
+	modeFailsafeShutdown   mode = "failsafe_shutdown"
+	modeTankFull           mode = "tank_full"
+	modeHeatEscape         mode = "heat_escape"
+	modeNightCooldown      mode = "night_cooldown"
+	modeFrostProtection    mode = "frost_protection"
+	modeScaldProtection    mode = "scald_protection"
+	modePreCirculation     mode = "pre_circulation"
+	modeFallbackThermostat mode = "fallback_thermostat"
+	modePumpKick           mode = "pump_kick"
+	modeValveExercise      mode = "valve_exercise"
+	modePumpRest           mode = "pump_rest"
+	modeTankSensorFault    mode = "tank_sensor_fault"
+	modeSensorFault        mode = "sensor_fault"
+)
+
+// defaultLanguage is used for display text of modes not translated to selected language.
+const defaultLanguage = "en"
+
+// modeTexts holds display text of modes per language.
+var modeTexts = map[string]map[mode]string{
+	"en": {
+		modeStartup:            "startup",
+		modeStopped:            "stopped",
+		modeWorking:            "working",
+		modeReduced:            "reduced mode",
+		modeEmergencyShutoff:   "emergency shutoff",
+		modeEmergencyStandby:   "emergency standby",
+		modeMaintenanceLockout: "maintenance lockout",
+		modeFailsafeShutdown:   "failsafe shutdown",
+		modeTankFull:           "tank filled",
+		modeHeatEscape:         "heat escape prevention mode",
+		modeNightCooldown:      "night cooldown",
+		modeFrostProtection:    "frost protection",
+		modeScaldProtection:    "scald protection",
+		modePreCirculation:     "pre-circulation",
+		modeFallbackThermostat: "fallback thermostat",
+		modePumpKick:           "pump kick",
+		modeValveExercise:      "valve exercise",
+		modePumpRest:           "pump rest",
+		modeTankSensorFault:    "tank sensor fault",
+		modeSensorFault:        "sensor fault",
+	},
+	"pl": {
+		modeStartup:            "uruchamianie",
+		modeStopped:            "zatrzymany",
+		modeWorking:            "praca",
+		modeReduced:            "tryb ograniczony",
+		modeEmergencyShutoff:   "wyłączenie awaryjne",
+		modeEmergencyStandby:   "awaryjne czuwanie",
+		modeMaintenanceLockout: "blokada serwisowa",
+		modeFailsafeShutdown:   "wyłączenie bezpieczeństwa",
+		modeTankFull:           "zasobnik pełny",
+		modeHeatEscape:         "ochrona przed ucieczką ciepła",
+		modeNightCooldown:      "nocne chłodzenie",
+		modeFrostProtection:    "ochrona przed zamarzaniem",
+		modeScaldProtection:    "ochrona przed poparzeniem",
+		modePreCirculation:     "cyrkulacja wstępna",
+		modeFallbackThermostat: "termostat awaryjny",
+		modePumpKick:           "rozruch kontrolny pompy",
+		modeValveExercise:      "przestawienie kontrolne zaworów",
+		modePumpRest:           "przerwa w pracy pompy",
+		modeTankSensorFault:    "awaria czujnika zasobnika",
+		modeSensorFault:        "awaria czujnika",
+	},
+}
+
+// statusLanguage selects language of mode display text.
+var statusLanguage = defaultLanguage
+
+// setStatusLanguage selects language of mode display text.
+func setStatusLanguage(language string) error {
+	if _, ok := modeTexts[language]; !ok {
+		var known []string
+		for l := range modeTexts {
+			known = append(known, l)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown status language %s, available: %v", language, known)
+	}
+	statusLanguage = language
+	return nil
+}
+
+// text returns display text of the mode in selected language.
+func (m mode) text() string {
+	if t, ok := modeTexts[statusLanguage][m]; ok {
+		return t
+	}
+	if t, ok := modeTexts[defaultLanguage][m]; ok {
+		return t
+	}
+	return string(m)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+const (
+	notificationTitle = "Solar controller"
+	defaultAlertCount = 1
+	defaultAlertSpan  = time.Hour
+)
+
+// alertOccurrences holds times of recent events per alert index in running configuration.
+var alertOccurrences = make(map[int][]time.Time)
+
+// notifyEvent records an event and sends notification for every alert which fired. Occurrences are cleared once an
+// alert fires, so it fires again only after the event repeats Count more times.
+func notifyEvent(event string) {
+	notifications := runningConfig().Notifications
+	now := time.Now()
+	recordEvent(event, "")
+
+	for i, alert := range notifications.Alerts {
+		if alert.Event != event {
+			continue
+		}
+
+		count, within := alert.Count, alert.Within
+		if count <= 0 {
+			count = defaultAlertCount
+		}
+		if within <= 0 {
+			within = defaultAlertSpan
+		}
+
+		var recent []time.Time
+		for _, t := range append(alertOccurrences[i], now) {
+			if now.Sub(t) < within {
+				recent = append(recent, t)
+			}
+		}
+		alertOccurrences[i] = recent
+		if len(recent) < count {
+			continue
+		}
+		delete(alertOccurrences, i)
+
+		message, err := renderAlert(alert.Message, event, len(recent))
+		if err != nil {
+			log.Printf("Could not render %s alert: %v", event, err)
+			continue
+		}
+		log.Printf("Sending %s alert: %s", event, message)
+		sendToHA("send notification", func(c *homeassistant.Client) error {
+			return c.Notify(notifications.Service, notificationTitle, message)
+		})
+	}
+}
+
+// renderAlert fills alert message template with current readings.
+func renderAlert(text, event string, count int) (string, error) {
+	tmpl, err := template.New(event).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := make(map[string]interface{})
+	for name, value := range evokClient().GetSensors().Values() {
+		data[name] = value
+	}
+	data["delta"] = systemStatus.Delta
+	data["mode"] = systemStatus.Mode
+	data["modeText"] = systemStatus.ModeText
+	data["event"] = event
+	data["count"] = count
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxOverrideDuration bounds manual flow override, so a forgotten one doesn't replace the flow curve for good.
+const maxOverrideDuration = 24 * time.Hour
+
+type overrideStatus struct {
+	Active bool    `json:"active"`
+	Flow   float64 `json:"flow,omitempty"`
+	Until  int64   `json:"until,omitempty"`
+}
+
+var (
+	overrideMu    sync.Mutex
+	overrideFlow  float64
+	overrideUntil time.Time
+)
+
+// flowOverride returns manually set flow duty while it is in effect. It replaces calculated flow while harvesting,
+// safety and protective modes are not affected.
+func flowOverride(now time.Time) (float64, bool) {
+	overrideMu.Lock()
+	defer overrideMu.Unlock()
+	if overrideUntil.IsZero() {
+		return 0, false
+	}
+	if !now.Before(overrideUntil) {
+		log.Println("Manual flow override expired")
+		overrideUntil = time.Time{}
+		return 0, false
+	}
+	return overrideFlow, true
+}
+
+func overrideExpiry() time.Time {
+	overrideMu.Lock()
+	defer overrideMu.Unlock()
+	return overrideUntil
+}
+
+// httpOverride shows manual flow override on GET, sets it from {"flow": 60, "for": "15m"} on PUT and clears it on
+// DELETE. Flow is duty in percent.
+func httpOverride(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Flow float64 `json:"flow"`
+			For  string  `json:"for"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(req.For)
+		if err != nil || duration <= 0 || duration > maxOverrideDuration {
+			http.Error(w, fmt.Sprintf("for must be a duration up to %s", maxOverrideDuration), http.StatusBadRequest)
+			return
+		}
+		if req.Flow < 0 || req.Flow > 100 {
+			http.Error(w, "flow must be within [0, 100]", http.StatusBadRequest)
+			return
+		}
+		overrideMu.Lock()
+		overrideFlow, overrideUntil = req.Flow, time.Now().Add(duration)
+		overrideMu.Unlock()
+		log.Printf("Manual flow override to %.1f for %s", req.Flow, duration)
+	case http.MethodDelete:
+		overrideMu.Lock()
+		overrideUntil = time.Time{}
+		overrideMu.Unlock()
+		log.Println("Manual flow override cleared")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp overrideStatus
+	if flow, ok := flowOverride(time.Now()); ok {
+		resp = overrideStatus{Active: true, Flow: flow, Until: overrideExpiry().Unix()}
+	}
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	panelTick     = 250 * time.Millisecond
+	buzzerPulse   = 1 * time.Second
+	slowBlinkTick = 4 // LED toggles every 4 panel ticks
+)
+
+// ledPattern returns LED state for given mode at a panel tick. Harvesting modes light the LED steadily, reduced
+// mode blinks slowly and safety modes blink fast.
+func ledPattern(m mode, tick int) bool {
+	switch m {
+	case modeWorking, modePreCirculation, modeNightCooldown, modeFrostProtection:
+		return true
+	case modeReduced:
+		return (tick/slowBlinkTick)%2 == 0
+	case modeEmergencyStandby, modeFailsafeShutdown, modeHeatEscape, modeTankFull:
+		return tick%2 == 0
+	default:
+		return false
+	}
+}
+
+// driveStatusLED blinks status LED according to current mode. Output is written only when its state changes.
+func driveStatusLED() {
+	defer recoverCrash("status LED")
+	lit := false
+	first := true
+	for tick := 0; ; tick++ {
+		led := evokClient().GetActuators().StatusLED
+		if led.Dev == "" || evokClient().Inhibited() || evokClient().IsLockedOut("statusLed") {
+			first = true
+			time.Sleep(panelTick)
+			continue
+		}
+
+		on := ledPattern(systemStatus.Mode, tick)
+		if on != lit || first {
+			value := 0.0
+			if on {
+				value = 1
+			}
+			if err := evokClient().SetValue(led.Dev, led.Circuit, value); err != nil {
+				log.Println(err)
+			} else {
+				lit = on
+				first = false
+			}
+		}
+		time.Sleep(panelTick)
+	}
+}
+
+// soundBuzzer emits a short buzzer pulse, used on safety events.
+func soundBuzzer() {
+	buzzer := evokClient().GetActuators().Buzzer
+	if buzzer.Dev == "" || evokClient().IsLockedOut("buzzer") {
+		return
+	}
+
+	go func() {
+		if err := evokClient().SetValue(buzzer.Dev, buzzer.Circuit, 1); err != nil {
+			log.Println(err)
+			return
+		}
+		time.Sleep(buzzerPulse)
+		if err := evokClient().SetValue(buzzer.Dev, buzzer.Circuit, 0); err != nil {
+			log.Println(err)
+		}
+	}()
+}
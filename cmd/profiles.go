@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultProfile means no profile overrides, settings come from Home Assistant only.
+const defaultProfile = "default"
+
+var activeProfile = defaultProfile
+
+var profileActiveMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "solar",
+	Name:      "profile_active",
+	Help:      "Operating profile which is currently active",
+}, []string{"profile"})
+
+// setProfile activates named operating profile. Settings values from the profile replace the ones from Home Assistant.
+func setProfile(name string) error {
+	var values map[string]float64
+	if name != defaultProfile {
+		var ok bool
+		values, ok = runningConfig().Profiles[name]
+		if !ok {
+			return fmt.Errorf("unknown profile %s", name)
+		}
+	}
+
+	hass().SetOverrides(values)
+	if name != activeProfile {
+		log.Printf("Switching operating profile from %s to %s", activeProfile, name)
+		profileActiveMetric.WithLabelValues(activeProfile).Set(0)
+	}
+	activeProfile = name
+	systemStatus.Profile = name
+	profileActiveMetric.WithLabelValues(name).Set(1)
+	return nil
+}
+
+// syncProfileFromHA follows the profile selected in Home Assistant.
+func syncProfileFromHA() {
+	entity := controllerCfg().ProfileEntity
+	if entity == "" {
+		return
+	}
+
+	selected, err := hass().GetState(entity)
+	if err != nil {
+		log.Printf("Could not get operating profile from HomeAssistant: %v", err)
+		return
+	}
+	if selected == activeProfile {
+		return
+	}
+	if err := setProfile(selected); err != nil {
+		log.Printf("Could not switch to profile selected in HomeAssistant: %v", err)
+	}
+}
+
+type profilesResponse struct {
+	Active    string   `json:"active"`
+	Available []string `json:"available"`
+}
+
+// httpProfile shows active and available profiles on GET and switches profile passed as {"name": "..."} on PUT.
+// The choice is written back to Home Assistant profile entity, if one is configured.
+func httpProfile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := setProfile(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if entity := controllerCfg().ProfileEntity; entity != "" {
+			if err := hass().SelectOption(entity, req.Name); err != nil {
+				log.Printf("Could not write operating profile to HomeAssistant: %v", err)
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := profilesResponse{Active: activeProfile, Available: []string{defaultProfile}}
+	for name := range runningConfig().Profiles {
+		resp.Available = append(resp.Available, name)
+	}
+	sort.Strings(resp.Available[1:])
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// publicAddress serves read-only subset of the API for display devices, e.g. a kitchen tablet.
+	publicAddress string
+	// publicRate is the number of requests per second served to each client on public address.
+	publicRate float64
+)
+
+// idleBucketExpiry is how long a client's bucket is kept after its last request. Expired bucket would be full again
+// anyway, so dropping it doesn't change limits.
+const idleBucketExpiry = time.Minute
+
+// bucket holds tokens of a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client, so a client polling too often can't starve others. Burst is a second
+// worth of requests.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, buckets: make(map[string]*bucket)}
+}
+
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := math.Max(l.rate, 1)
+	if now.Sub(l.swept) >= idleBucketExpiry {
+		for c, b := range l.buckets {
+			if now.Sub(b.last) >= idleBucketExpiry {
+				delete(l.buckets, c)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: burst}
+		l.buckets[client] = b
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientHost returns host of request's remote address, so all connections of a client share its bucket.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// readOnly serves only GET and HEAD requests within rate limit.
+func readOnly(limiter *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !limiter.allow(clientHost(r), time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// servePublic serves status and sensors without anything else of the API on a separate address, so display devices
+// can be allowed to reach it while the full API stays reachable only from trusted networks.
+func servePublic() {
+	limiter := newRateLimiter(publicRate)
+	mux := http.NewServeMux()
+	mux.Handle("/status", instrument("public:/status", allowCORS(readOnly(limiter, http.HandlerFunc(httpStatus)), serverOptions.corsOrigins)))
+	mux.Handle("/sensors", instrument("public:/sensors", allowCORS(readOnly(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		evokClient().ExposeSensorsOnHTTP(w, r)
+	})), serverOptions.corsOrigins)))
+
+	log.Printf("Serving read-only status on %s", publicAddress)
+	if err := newServer(publicAddress, mux).ListenAndServe(); err != nil {
+		log.Printf("Public status server failed: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const lastPumpRunKey = "lastPumpRun"
+
+var (
+	// lastPumpRun is the last time the pump was seen running.
+	lastPumpRun time.Time
+	kicking     bool
+	kickEnd     time.Time
+
+	pumpKickTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "pump_kick_total",
+		Help:      "Increase when pump is run for maintenance after a long idle period",
+	})
+)
+
+// loadLastPumpRun restores time of the last pump run from the state store. Without it idle time is counted from
+// startup, so a fresh installation is not kicked right away.
+func loadLastPumpRun() {
+	var unix int64
+	found, err := stateStore.Get(lastPumpRunKey, &unix)
+	if err != nil {
+		log.Println(err)
+	}
+	if !found || err != nil {
+		lastPumpRun = time.Now()
+		return
+	}
+	lastPumpRun = time.Unix(unix, 0)
+}
+
+// storeLastPumpRun puts time of the last pump run into the state store.
+func storeLastPumpRun() {
+	if err := stateStore.Set(lastPumpRunKey, wallTime(lastPumpRun).Unix()); err != nil {
+		log.Println(err)
+	}
+}
+
+// pumpKickDue reports if the idle pump should be kicked.
+func pumpKickDue(now time.Time) bool {
+	kick := controllerCfg().Maintenance.Kick
+	return kick.Duration > 0 && !circuitRunning && !kicking && !exercising && now.Sub(lastPumpRun) >= kick.GetInterval()
+}
+
+// kickIdlePump kicks the pump if it is due and reports if it did.
+func kickIdlePump(now time.Time) bool {
+	if !pumpKickDue(now) {
+		return false
+	}
+	setStatus(modePumpKick, fmt.Sprintf("pump idle since %s", wallTime(lastPumpRun).Format("2006-01-02 15:04")))
+	startPumpKick(now)
+	decide(stepPumpKick)
+	return true
+}
+
+// startPumpKick energizes the pump alone for configured duration. It is switched off by endPumpKick.
+func startPumpKick(now time.Time) {
+	idle := now.Sub(lastPumpRun).Round(time.Hour)
+	log.Printf("Pump was idle for %s, running it for %s to keep it from seizing", idle, controllerCfg().Maintenance.Kick.Duration)
+
+	pump := evokClient().GetActuators().Pump
+	if err := evokClient().SetValue(pump.Dev, pump.Circuit, 1); err != nil {
+		log.Println(err)
+		return
+	}
+	kicking = true
+	kickEnd = now.Add(controllerCfg().Maintenance.Kick.Duration)
+	lastPumpRun = now
+	pumpKickTotal.Inc()
+	persistState(true)
+}
+
+// endPumpKick switches the pump off once the kick is over. A circuit started in the meantime keeps the pump.
+func endPumpKick(now time.Time) {
+	if !kicking || now.Before(kickEnd) {
+		return
+	}
+	if circuitRunning {
+		kicking = false
+		return
+	}
+
+	pump := evokClient().GetActuators().Pump
+	if err := evokClient().SetValue(pump.Dev, pump.Circuit, 0); err != nil {
+		log.Println(err)
+		return
+	}
+	kicking = false
+	setStatus(modeStopped, "pump kick finished")
+}
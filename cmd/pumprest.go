@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// restUntil is the end of enforced pump rest.
+	restUntil time.Time
+
+	pumpRestTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "pump_rest_total",
+		Help:      "Increase when the circuit was stopped for a rest after pump ran continuously for the maximal time",
+	})
+)
+
+// resting reports if the pump rest is in progress.
+func resting(now time.Time) bool {
+	return now.Before(restUntil)
+}
+
+// pumpRest stops the circuit once the pump ran continuously for maximal time and keeps it stopped until the rest is
+// over. It reports if the iteration is decided by the rest. Stop which failed is repeated in the next iteration.
+func pumpRest(now time.Time) bool {
+	limit := controllerCfg().PumpRest
+	if limit.MaxRun <= 0 {
+		return false
+	}
+	if resting(now) {
+		return true
+	}
+	if !restUntil.IsZero() {
+		restUntil = time.Time{}
+		setStatus(modeStopped, "pump rest finished")
+	}
+	if !circuitRunning || now.Sub(runningSince) < limit.MaxRun {
+		return false
+	}
+
+	until := now.Add(limit.GetRest())
+	reason := fmt.Sprintf("pump ran continuously for %s, resting until %s", limit.MaxRun, wallTime(until).Format("15:04"))
+	setStatus(modePumpRest, reason)
+	stop(reason)
+	if !circuitRunning {
+		restUntil = until
+		pumpRestTotal.Inc()
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+var (
+	purging    bool
+	purgeEnd   time.Time
+	purgeAfter string
+)
+
+// startPurge keeps the circuit circulating at minimal flow after a failsafe stop, so residual collector heat is
+// moved out of exposed piping. It returns false when purge is disabled and the circuit has to be stopped at once.
+func startPurge(reason string) bool {
+	purge := controllerCfg().Purge
+	if purge.Duration <= 0 || !circuitRunning {
+		return false
+	}
+
+	log.Printf("Purging collector piping for %s before stop", purge.Duration)
+	if purge.Bypass {
+		act := evokClient().GetActuators()
+		if err := evokClient().SetValue(act.Switch.Dev, act.Switch.Circuit, 0); err != nil && !errors.Is(err, evok.ErrLockedOut) {
+			log.Println(err)
+		}
+	}
+	if err := setFlow(hass().GetSettings().Flow.DutyMin.Value); err != nil {
+		log.Println(err)
+	}
+	purging = true
+	purgeEnd = time.Now().Add(purge.Duration)
+	purgeAfter = reason
+	return true
+}
+
+// continuePurge stops the circuit once purge is over. It reports if purge is still running.
+func continuePurge(now time.Time) bool {
+	if !purging {
+		return false
+	}
+	if now.Before(purgeEnd) {
+		return true
+	}
+	purging = false
+	log.Println("Purge finished")
+	stop(purgeAfter)
+	return false
+}
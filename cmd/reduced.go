@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// reducedPublishPeriod limits how often the countdown is published to Home Assistant while reduced mode lasts.
+const reducedPublishPeriod = 1 * time.Minute
+
+var (
+	reducedPublished      bool
+	lastReducedPublish    time.Time
+	reducedRemainingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "reduced_mode_remaining_seconds",
+		Help:      "Seconds remaining until reduced mode ends and the circuit is stopped, 0 outside of reduced mode",
+	})
+)
+
+// observeReducedMode exports time remaining in reduced heat exchange window. Countdown is published to Home
+// Assistant on startup, when reduced mode starts or ends and periodically while it lasts.
+func observeReducedMode(active bool, till, now time.Time) {
+	remaining := till.Sub(now)
+	if !active || remaining < 0 {
+		active, remaining = false, 0
+	}
+
+	reducedRemainingGauge.Set(remaining.Seconds())
+	systemStatus.ReducedUntil = 0
+	if active {
+		systemStatus.ReducedUntil = wallTime(till).Unix()
+	}
+
+	entity := controllerCfg().ReducedCountdownEntity
+	unchanged := !lastReducedPublish.IsZero() && active == reducedPublished
+	if entity == "" || (unchanged && (!active || now.Sub(lastReducedPublish) < reducedPublishPeriod)) {
+		return
+	}
+	reducedPublished = active
+	lastReducedPublish = now
+
+	attributes := map[string]interface{}{
+		"friendly_name":       "Solar reduced mode remaining",
+		"unit_of_measurement": "s",
+		"device_class":        "duration",
+	}
+	if active {
+		attributes["until"] = wallTime(till).Format(time.RFC3339)
+	}
+	state := fmt.Sprintf("%.0f", remaining.Seconds())
+	sendToHA("publish reduced mode countdown", func(c *homeassistant.Client) error {
+		return c.PublishState(entity, state, attributes)
+	})
+}
+
+var (
+	// Duty and time reduced mode started with, zero time when flow is not decaying.
+	decayFrom  float64
+	decayStart time.Time
+)
+
+// startFlowDecay remembers flow reduced mode starts with, which then decays towards DutyMin.
+func startFlowDecay(now time.Time) {
+	decayStart = time.Time{}
+	if controllerCfg().ReducedDecay > 0 {
+		decayFrom, decayStart = requestedFlow, now
+	}
+}
+
+// flowDecaying reports if flow is still decaying towards DutyMin.
+func flowDecaying() bool {
+	return !decayStart.IsZero()
+}
+
+// decayedFlow returns flow decaying exponentially from the one reduced mode started with towards dutyMin. Decay ends
+// once flow is within half a percent of dutyMin.
+func decayedFlow(dutyMin float64, now time.Time) float64 {
+	if decayStart.IsZero() || decayFrom <= dutyMin {
+		decayStart = time.Time{}
+		return dutyMin
+	}
+	flow := dutyMin + (decayFrom-dutyMin)*math.Exp(-now.Sub(decayStart).Seconds()/controllerCfg().ReducedDecay.Seconds())
+	if flow-dutyMin < 0.5 {
+		decayStart = time.Time{}
+		return dutyMin
+	}
+	return flow
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// maxConfigSize limits size of configuration accepted over HTTP.
+const maxConfigSize = 1 << 20
+
+// pendingConfig carries validated configuration with initialized clients to the control loop, which swaps them
+// between iterations.
+type pendingConfig struct {
+	config *config.Config
+	hass   *homeassistant.Client
+	evok   *evok.Client
+}
+
+var pendingConfigs = make(chan pendingConfig, 1)
+
+type configPreview struct {
+	Valid   bool                `json:"valid"`
+	Error   string              `json:"error,omitempty"`
+	Diff    []config.Difference `json:"diff"`
+	Applied bool                `json:"applied"`
+}
+
+// readCandidateConfig parses and validates configuration from request body and compares it with running one.
+func readCandidateConfig(w http.ResponseWriter, r *http.Request) (*config.Config, configPreview, error) {
+	var preview configPreview
+
+	if r.Method != http.MethodPost {
+		return nil, preview, fmt.Errorf("method not allowed")
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		return nil, preview, fmt.Errorf("could not read request: %w", err)
+	}
+
+	candidate, err := config.Parse(data)
+	if err != nil {
+		preview.Error = err.Error()
+		return nil, preview, nil
+	}
+
+	preview.Diff, err = config.Diff(runningConfig(), candidate)
+	if err != nil {
+		return nil, preview, err
+	}
+	preview.Valid = true
+	return candidate, preview, nil
+}
+
+func writePreview(w http.ResponseWriter, preview configPreview) {
+	js, err := json.Marshal(preview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !preview.Valid {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// httpConfigPreview validates candidate YAML configuration and shows differences from the running one.
+func httpConfigPreview(w http.ResponseWriter, r *http.Request) {
+	_, preview, err := readCandidateConfig(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writePreview(w, preview)
+}
+
+// httpConfigApply validates candidate configuration, initializes new clients and hands them over to the control
+// loop. Running configuration is kept when any of the clients fails to initialize.
+func httpConfigApply(w http.ResponseWriter, r *http.Request) {
+	candidate, preview, err := readCandidateConfig(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !preview.Valid {
+		writePreview(w, preview)
+		return
+	}
+
+	newHass := newHassClient(candidate)
+	if err := syncSettings(newHass); err != nil {
+		log.Printf("Could not get settings from HomeAssistant, applying configuration with configured values: %v", err)
+	}
+
+	newEvok := evok.NewClient(evokAddress, *candidate.GetSensorsConfig(), *candidate.GetActuatorsConfig())
+	if simulation {
+		newEvok = evok.NewSimulatedClient(*candidate.GetSensorsConfig(), *candidate.GetActuatorsConfig())
+	}
+	exportOnUpdate(newEvok)
+	recoverClientCrash(newEvok)
+	if err := newEvok.InitializeSensorsValues(); err != nil {
+		http.Error(w, fmt.Sprintf("could not initialize sensors: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	select {
+	case pendingConfigs <- pendingConfig{config: candidate, hass: newHass, evok: newEvok}:
+	default:
+		http.Error(w, "another configuration is being applied", http.StatusConflict)
+		return
+	}
+
+	preview.Applied = true
+	writePreview(w, preview)
+}
+
+// applyPendingConfig swaps configuration and clients if a new configuration is waiting. It is called by the control
+// loop between iterations, so decisions are never made with a mix of old and new configuration.
+func applyPendingConfig() {
+	var pending pendingConfig
+	select {
+	case pending = <-pendingConfigs:
+	default:
+		return
+	}
+
+	if circuitRunning && !reflect.DeepEqual(evokClient().GetActuators(), pending.evok.GetActuators()) {
+		setStatus(modeStopped, "actuators configuration changed")
+		stop("Actuators configuration changed")
+	}
+
+	oldEvok := evokClient()
+	// New client doesn't know which actuators are energized, so pending lockouts are completed before the swap.
+	if len(oldEvok.PendingLockouts()) > 0 && circuitRunning {
+		setStatus(modeMaintenanceLockout, "actuator lockout is pending")
+		stop("Actuator lockout is pending")
+	}
+	for _, name := range oldEvok.LockedOut() {
+		if err := pending.evok.SetLockedOut(name, true); err != nil {
+			log.Println(err)
+		}
+	}
+	running.Store(newRuntimeConfig(pending.config, pending.hass, pending.evok))
+
+	if err := setProfile(activeProfile); err != nil {
+		log.Printf("%v, switching to %s profile", err, defaultProfile)
+		if err := setProfile(defaultProfile); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Supervisor connects websocket of the new client once the old one is closed.
+	oldEvok.Close()
+	evokClient().SetInhibited(hardEmergency)
+
+	log.Printf("Applied new configuration, using system profile %#v", systemProfile())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// dailyReport summarizes a day of operation. It is published as attributes of Home Assistant sensor at local
+// midnight.
+type dailyReport struct {
+	start time.Time
+	// partial is set for the day controller started in.
+	partial     bool
+	harvest     harvestMeter
+	runtime     time.Duration
+	cycles      float64
+	counters    map[string]float64
+	maxSolarUp  float64
+	maxTankUp   float64
+	initialized bool
+}
+
+var (
+	report dailyReport
+	// previousDayScore is harvest anomaly score of the last finished day.
+	previousDayScore float64
+)
+
+// observeDay accumulates data of the daily report and publishes it when the day changes.
+func observeDay(s *evok.Sensors, now time.Time) {
+	energy := 0.0
+	if controllerCfg().Tank.Volume > 0 {
+		energy = tankEnergy(s)
+	}
+
+	if !report.initialized {
+		report.reset(now)
+		report.partial = true
+	}
+	if day := startOfDay(now); !day.Equal(report.start) {
+		report.publish()
+		report.reset(day)
+	}
+
+	report.harvest.observe(energy)
+	report.maxSolarUp = math.Max(report.maxSolarUp, s.SolarUp.Value)
+	report.maxTankUp = math.Max(report.maxTankUp, s.TankUp.Value)
+}
+
+// reset starts a new day with snapshots of cumulative values.
+func (r *dailyReport) reset(start time.Time) {
+	counters := make(map[string]float64, len(persistentCounters))
+	for name, c := range persistentCounters {
+		counters[name] = c.get()
+	}
+	*r = dailyReport{
+		start:       startOfDay(start),
+		runtime:     pumpRuntime,
+		cycles:      pumpStartsTotal.get(),
+		counters:    counters,
+		maxSolarUp:  math.Inf(-1),
+		maxTankUp:   math.Inf(-1),
+		initialized: true,
+	}
+}
+
+// attributes returns the report as Home Assistant sensor attributes.
+func (r *dailyReport) attributes() map[string]interface{} {
+	events := make(map[string]float64)
+	for name, c := range persistentCounters {
+		if n := c.get() - r.counters[name]; n > 0 {
+			events[strings.TrimSuffix(strings.TrimPrefix(name, "solar_"), "_total")] = n
+		}
+	}
+
+	return map[string]interface{}{
+		"friendly_name":         "Solar daily report",
+		"partial":               r.partial,
+		"energy_kwh":            math.Round(r.harvest.total*100) / 100,
+		"runtime_hours":         math.Round((pumpRuntime-r.runtime).Hours()*100) / 100,
+		"cycles":                pumpStartsTotal.get() - r.cycles,
+		"events":                events,
+		"harvest_anomaly_score": math.Round(previousDayScore*100) / 100,
+		"max_solar_up":          r.maxSolarUp,
+		"max_tank_up":           r.maxTankUp,
+	}
+}
+
+// publish logs the report and sends it to Home Assistant, if report entity is configured.
+func (r *dailyReport) publish() {
+	date := r.start.Format("2006-01-02")
+	attributes := r.attributes()
+	log.Printf("Daily report for %s: %v", date, attributes)
+
+	entity := controllerCfg().Report.EntityID
+	if entity == "" {
+		return
+	}
+	sendToHA("publish daily report", func(c *homeassistant.Client) error {
+		return c.PublishState(entity, date, attributes)
+	})
+}
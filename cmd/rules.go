@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/expr"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// ruleEventType is Home Assistant event fired by rules with event action.
+const ruleEventType = "solar_rule"
+
+type compiledRule struct {
+	config.Rule
+	condition *expr.Expr
+	active    bool
+}
+
+// ruleOutcome collects actions of all rules whose conditions hold.
+type ruleOutcome struct {
+	// stop is the name of a rule keeping the circuit stopped.
+	stop string
+	flow float64
+	// flowRule is the name of a rule overriding flow.
+	flowRule string
+}
+
+var (
+	rules         []*compiledRule
+	rulesCompiled *config.Config
+
+	ruleActiveMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "rule_active",
+		Help:      "Whether condition of a user-defined rule holds",
+	}, []string{"rule"})
+)
+
+// compileRules prepares rules of running configuration. Rules are compiled again only when configuration changes.
+func compileRules() {
+	if rulesCompiled == runningConfig() {
+		return
+	}
+	rulesCompiled = runningConfig()
+
+	ruleActiveMetric.Reset()
+	rules = nil
+	for _, rule := range runningConfig().Rules {
+		// Configuration is validated when loaded, so this can't fail.
+		condition, err := expr.Parse(rule.When)
+		if err != nil {
+			log.Printf("Skipping rule %s: %v", rule.Name, err)
+			continue
+		}
+		rules = append(rules, &compiledRule{Rule: rule, condition: condition})
+		ruleActiveMetric.WithLabelValues(rule.Name).Set(0)
+	}
+}
+
+// ruleVariables returns values which can be referenced in rule conditions. Sensors include computed ones.
+func ruleVariables(sensors map[string]float64, cfg homeassistant.Settings, delta float64) map[string]float64 {
+	vars := cfg.Values()
+	for name, value := range sensors {
+		vars[name] = value
+	}
+	vars["delta"] = delta
+	vars["running"] = 0
+	if circuitRunning {
+		vars["running"] = 1
+	}
+	return vars
+}
+
+// evaluateRules checks conditions of all rules. Events are fired only when a condition becomes true.
+func evaluateRules(vars map[string]float64) ruleOutcome {
+	compileRules()
+
+	var outcome ruleOutcome
+	for _, rule := range rules {
+		v, err := rule.condition.Eval(vars)
+		if err != nil {
+			log.Printf("Could not evaluate rule %s: %v", rule.Name, err)
+			continue
+		}
+
+		active := v != 0
+		if active != rule.active {
+			log.Printf("Rule %s condition %q changed to %t", rule.Name, rule.When, active)
+			rule.active = active
+			if active && rule.Action == config.RuleEvent {
+				data := map[string]interface{}{"rule": rule.Name, "condition": rule.When}
+				sendToHA("fire rule event", func(c *homeassistant.Client) error {
+					return c.FireEvent(ruleEventType, data)
+				})
+			}
+		}
+		if !active {
+			ruleActiveMetric.WithLabelValues(rule.Name).Set(0)
+			continue
+		}
+		ruleActiveMetric.WithLabelValues(rule.Name).Set(1)
+
+		switch rule.Action {
+		case config.RuleStop:
+			if outcome.stop == "" {
+				outcome.stop = rule.Name
+			}
+		case config.RuleFlow:
+			if outcome.flowRule == "" {
+				outcome.flow, outcome.flowRule = rule.Value, rule.Name
+			}
+		}
+	}
+	return outcome
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// runtimeConfig is configuration together with clients created for it. Applying new configuration replaces it as a
+// whole, so goroutines reading it never see a mix of old and new configuration.
+type runtimeConfig struct {
+	config     *config.Config
+	controller config.Controller
+	profile    config.Profile
+	hass       *homeassistant.Client
+	evok       *evok.Client
+}
+
+// running holds *runtimeConfig in use.
+var running atomic.Value
+
+func newRuntimeConfig(cfg *config.Config, hassClient *homeassistant.Client, evokClient *evok.Client) *runtimeConfig {
+	controller := *cfg.GetControllerConfig()
+	return &runtimeConfig{
+		config:     cfg,
+		controller: controller,
+		profile:    controller.Profile(),
+		hass:       hassClient,
+		evok:       evokClient,
+	}
+}
+
+// current returns configuration in use. It is empty until the controller is initialized.
+func current() *runtimeConfig {
+	if rc, ok := running.Load().(*runtimeConfig); ok {
+		return rc
+	}
+	return &runtimeConfig{}
+}
+
+func runningConfig() *config.Config     { return current().config }
+func controllerCfg() *config.Controller { return &current().controller }
+func systemProfile() config.Profile     { return current().profile }
+func hass() *homeassistant.Client       { return current().hass }
+func evokClient() *evok.Client          { return current().evok }
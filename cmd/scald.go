@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+const (
+	scaldEventType = "solar_scald"
+	// scaldHysteresis is how much DHW outlet temperature must drop below threshold to clear scald condition.
+	scaldHysteresis = 2.0
+)
+
+var (
+	scald bool
+
+	scaldMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "dhw_scald",
+		Help:      "Set when DHW outlet temperature is above scald threshold, indicating failed mixing valve",
+	})
+	scaldTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "scald_total",
+		Help:      "Increase when DHW outlet temperature exceeds scald threshold",
+	})
+)
+
+// scalding supervises DHW outlet temperature and reports if it is above scald threshold. Crossing the threshold is
+// notified and fired as Home Assistant event.
+func scalding(s *evok.Sensors) bool {
+	threshold := controllerCfg().AntiScald.Threshold
+	if threshold <= 0 || s.DHWOutlet.Dev == "" {
+		return false
+	}
+
+	outlet := s.DHWOutlet.Value
+	if !scald && outlet > threshold {
+		scald = true
+		scaldMetric.Set(1)
+		scaldTotal.incWithExemplar()
+		log.Printf("DHW outlet temperature %.1f is above scald threshold %.1f, mixing valve probably failed", outlet, threshold)
+		notifyEvent(config.EventScald)
+		sendToHA("fire scald event", func(c *homeassistant.Client) error {
+			return c.FireEvent(scaldEventType, map[string]interface{}{"temperature": outlet, "threshold": threshold})
+		})
+		soundBuzzer()
+	} else if scald && outlet <= threshold-scaldHysteresis {
+		scald = false
+		scaldMetric.Set(0)
+		log.Printf("DHW outlet temperature %.1f is below scald threshold again", outlet)
+	}
+	return scald
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+var sensorFaulted bool
+
+// sensorFaultHold keeps the circuit stopped while any configured sensor reports readings which can't be converted to
+// a valid temperature, like an open or shorted PT1000. Safety checks compare readings against limits and would
+// silently pass on such a sensor, so the circuit doesn't run until all readings are valid again. It reports if the
+// iteration is decided by it.
+func sensorFaultHold(s *evok.Sensors) bool {
+	faults := s.Faults()
+	if len(faults) == 0 {
+		if sensorFaulted {
+			sensorFaulted = false
+			systemStatus.SensorFaults = nil
+			log.Println("All sensors report valid readings again")
+			if !circuitRunning {
+				setStatus(modeStopped, "sensors report valid readings again")
+			}
+		}
+		return false
+	}
+
+	var names []string
+	for name, fault := range faults {
+		names = append(names, fmt.Sprintf("%s: %s", name, fault))
+	}
+	sort.Strings(names)
+	reason := "sensor fault, " + strings.Join(names, ", ")
+
+	systemStatus.SensorFaults = faults
+	if !sensorFaulted {
+		sensorFaulted = true
+		log.Printf("Stopping the circuit until sensors recover, %s", reason)
+		notifyEvent(config.EventSensorFault)
+	}
+	setStatus(modeSensorFault, reason)
+	if circuitRunning {
+		stop(reason)
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const httpAddress = ":7001"
+
+// serverOptions limit resources a single client can hold, so API can't be easily exhausted.
+var serverOptions struct {
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	maxHeaderBytes int
+	logRequests    bool
+	// corsOrigins are origins allowed to read status and sensors from browser. "*" allows any origin. Without any,
+	// browsers enforce same-origin policy.
+	corsOrigins []string
+}
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests by handler, method and status code",
+	}, []string{"handler", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "solar",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by handler",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"handler"})
+	httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests being served by handler",
+	}, []string{"handler"})
+)
+
+// handle registers handler on default mux instrumented with request metrics labeled by pattern.
+func handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, instrument(pattern, handler))
+}
+
+// instrument wraps handler with request metrics labeled by name.
+func instrument(name string, handler http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerInFlight(httpRequestsInFlight.With(labels),
+		promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(httpRequestsTotal.MustCurryWith(labels), handler)))
+}
+
+func handleFunc(pattern string, handler http.HandlerFunc) {
+	handle(pattern, handler)
+}
+
+// newServer creates HTTP server listening on addr with configured timeouts and limits.
+func newServer(addr string, handler http.Handler) *http.Server {
+	if serverOptions.logRequests {
+		handler = logRequests(handler)
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       serverOptions.readTimeout,
+		ReadHeaderTimeout: serverOptions.readTimeout,
+		WriteTimeout:      serverOptions.writeTimeout,
+		IdleTimeout:       serverOptions.idleTimeout,
+		MaxHeaderBytes:    serverOptions.maxHeaderBytes,
+	}
+}
+
+// statusRecorder captures response status code for request logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers work with request logging.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamDuration ends streaming responses shortly before write timeout, so they finish cleanly and clients reconnect.
+func streamDuration() time.Duration {
+	if serverOptions.writeTimeout <= 0 {
+		return 0
+	}
+	return serverOptions.writeTimeout * 9 / 10
+}
+
+// logRequests logs every request with its status and duration.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("HTTP %s %s from %s: %d in %s", r.Method, r.URL.Path, r.RemoteAddr, rec.status, time.Since(start))
+	})
+}
+
+// allowCORS adds CORS headers for allowed origins and answers preflight requests, so a dashboard served from
+// another origin can read the handler. Only GET is allowed cross-origin, API which changes anything is left to
+// same-origin policy.
+func allowCORS(next http.Handler, origins []string) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	allowed := make(map[string]bool)
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowOrigin := origin
+		if allowed["*"] {
+			allowOrigin = "*"
+		}
+		switch {
+		case r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "":
+			if r.Header.Get("Access-Control-Request-Method") != http.MethodGet {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case r.Method == http.MethodGet:
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+const (
+	// stopAttempts is the number of attempts to switch actuators off before stop failure is escalated.
+	stopAttempts   = 3
+	stopRetryDelay = 500 * time.Millisecond
+)
+
+var (
+	// stopFailing is set from the first failed stop until the circuit is stopped, so the failure is alerted once.
+	stopFailing bool
+
+	stopFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "stop_failures_total",
+		Help:      "Increase when the circuit could not be switched off",
+	})
+)
+
+// switchOff issues commands, retrying those which failed. Locked out actuators are left to the maintenance.
+func switchOff(commands []evok.Command) error {
+	var err error
+	for attempt := 1; attempt <= stopAttempts; attempt++ {
+		err = evok.Ignoring(evokClient().SetValues(evokClient().Pending(commands)), evok.ErrLockedOut)
+		if err == nil {
+			return nil
+		}
+		if attempt < stopAttempts {
+			log.Printf("Attempt %d of %d to switch off failed: %v", attempt, stopAttempts, err)
+			time.Sleep(stopRetryDelay)
+		}
+	}
+	return err
+}
+
+// stopFailed escalates a stop which left some actuators on. Circuit may keep harvesting into a full tank, so it is
+// alerted once per failing stop.
+func stopFailed(reason string) {
+	stopFailuresTotal.Inc()
+	if stopFailing {
+		return
+	}
+	stopFailing = true
+	log.Printf("Could not stop the circuit (%s), retrying in the next iteration", reason)
+	notifyEvent(config.EventStopFailed)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type deltaSample struct {
+	at    time.Time
+	value float64
+}
+
+var deltaSamples []deltaSample
+
+var rawDeltaMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "solar",
+	Name:      "temperature_delta_raw_celsius",
+	Help:      "Temperature delta before decision smoothing",
+})
+
+// smoothDelta returns mean of delta samples collected within window. Window of 0 disables smoothing.
+func smoothDelta(raw float64, window time.Duration, now time.Time) float64 {
+	rawDeltaMetric.Set(raw)
+
+	deltaSamples = append(deltaSamples, deltaSample{at: now, value: raw})
+
+	cutoff := now.Add(-window)
+	first := 0
+	for first < len(deltaSamples)-1 && !deltaSamples[first].at.After(cutoff) {
+		first++
+	}
+	deltaSamples = deltaSamples[first:]
+
+	sum := 0.0
+	for _, sample := range deltaSamples {
+		sum += sample.value
+	}
+	return sum / float64(len(deltaSamples))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+var (
+	// softStartedAt is the time circuit was started with soft start, zero when flow is not being ramped.
+	softStartedAt time.Time
+	// requestedFlow is the last flow requested before ramp limit.
+	requestedFlow float64
+)
+
+// softStartEnabled reports if the circuit starts with flow valve pre-positioned.
+func softStartEnabled() bool {
+	return controllerCfg().SoftStart.Flow > 0 && !fillPhaseEnabled()
+}
+
+// prepositionFlow sets flow valve to soft start position before the pump is energized.
+func prepositionFlow() {
+	softStartedAt = time.Time{}
+	log.Printf("Soft start, opening flow valve to %.0f before energizing pump", controllerCfg().SoftStart.Flow)
+	if err := setFlow(controllerCfg().SoftStart.Flow); err != nil {
+		log.Println(err)
+	}
+}
+
+// continueRamp raises flow towards the last requested value while it is ramping, as modes which set flow only once
+// would otherwise stay at the ramp limit.
+func continueRamp() {
+	if softStartedAt.IsZero() {
+		return
+	}
+	if !circuitRunning {
+		softStartedAt = time.Time{}
+		return
+	}
+	if err := setFlow(requestedFlow); err != nil {
+		log.Println(err)
+	}
+}
+
+// rampFlow limits flow while it ramps from soft start position to DutyMax after the circuit was started.
+func rampFlow(flow float64, now time.Time) float64 {
+	if softStartedAt.IsZero() {
+		return flow
+	}
+
+	ramp := controllerCfg().SoftStart.Ramp
+	elapsed := now.Sub(softStartedAt)
+	if elapsed >= ramp {
+		softStartedAt = time.Time{}
+		return flow
+	}
+
+	from := controllerCfg().SoftStart.Flow
+	to := hass().GetSettings().Flow.DutyMax.Value
+	limit := from + (to-from)*elapsed.Seconds()/ramp.Seconds()
+	return math.Min(flow, limit)
+}
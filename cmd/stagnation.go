@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// Stagnation risk is highest with strong sun, high outdoor temperature and no wind cooling the collector. Each
+// reading is normalized to [0, 1] between the reference values below.
+const (
+	fullIrradiance   = 1000.0 // W/m²
+	hotOutdoorMin    = 15.0   // °C
+	hotOutdoorMax    = 35.0   // °C
+	coolingWindSpeed = 10.0   // m/s
+	// stagnationMemory is how long the peak score of a day keeps night cooldown armed.
+	stagnationMemory = 24 * time.Hour
+)
+
+var (
+	stagnationPeak   float64
+	stagnationPeakAt time.Time
+	precoolArmed     bool
+
+	stagnationRiskMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "stagnation_risk_score",
+		Help:      "Current stagnation risk from 0 to 1 based on irradiance, outdoor temperature and wind speed",
+	})
+	stagnationArmedMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "stagnation_precool_armed",
+		Help:      "Set when night cooldown is armed by high stagnation risk",
+	})
+)
+
+// stagnationRisk scores current weather. Irradiance weighs the most, temperature and wind are used when their
+// entities are configured. Without irradiance entity the risk is unknown and reported as 0.
+func stagnationRisk(cfg homeassistant.Settings) float64 {
+	if cfg.Irradiance.EntityID == "" {
+		return 0
+	}
+
+	score, weight := 0.6*normalize(cfg.Irradiance.Value, 0, fullIrradiance), 0.6
+	if cfg.OutdoorTemperature.EntityID != "" {
+		score += 0.2 * normalize(cfg.OutdoorTemperature.Value, hotOutdoorMin, hotOutdoorMax)
+		weight += 0.2
+	}
+	if cfg.WindSpeed.EntityID != "" {
+		score += 0.2 * (1 - normalize(cfg.WindSpeed.Value, 0, coolingWindSpeed))
+		weight += 0.2
+	}
+	// Without sun there is no risk regardless of temperature and wind.
+	return score / weight * normalize(cfg.Irradiance.Value, 0, fullIrradiance/4)
+}
+
+func normalize(v, min, max float64) float64 {
+	return math.Max(0, math.Min(1, (v-min)/(max-min)))
+}
+
+// stagnationArmed updates stagnation risk and reports if night cooldown is armed by a high score within the last
+// stagnationMemory.
+func stagnationArmed(cfg homeassistant.Settings, now time.Time) bool {
+	threshold := controllerCfg().Stagnation.Threshold
+	if threshold <= 0 {
+		return false
+	}
+
+	score := stagnationRisk(cfg)
+	stagnationRiskMetric.Set(score)
+	if score >= stagnationPeak || now.Sub(stagnationPeakAt) > stagnationMemory {
+		stagnationPeak, stagnationPeakAt = score, now
+	}
+
+	armed := stagnationPeak >= threshold
+	if armed != precoolArmed {
+		if armed {
+			log.Printf("Stagnation risk %.2f reached threshold %.2f, arming night cooldown", stagnationPeak, threshold)
+			stagnationArmedMetric.Set(1)
+		} else {
+			log.Println("Stagnation risk is low again, disarming night cooldown")
+			stagnationArmedMetric.Set(0)
+		}
+		precoolArmed = armed
+	}
+	return armed
+}
+
+// cooldownLimit returns tank temperature above which night cooldown starts and whether cooldown is enabled.
+// Stagnation risk enables it and lowers the limit by precool margin.
+func cooldownLimit(cfg homeassistant.Settings, tankMax float64, now time.Time) (float64, bool) {
+	if !systemProfile().StagnationHandling {
+		return tankMax, false
+	}
+	if stagnationArmed(cfg, now) {
+		return tankMax - controllerCfg().Stagnation.PrecoolMargin, true
+	}
+	return tankMax, nightCooldownEnabled(cfg)
+}
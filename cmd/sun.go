@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/config"
+)
+
+// sunTimes returns times of sunrise and sunset on the local date of t at location, using NOAA approximation
+// accurate to a few minutes. It returns false when location is not set or the sun doesn't rise or set on that day.
+func sunTimes(t time.Time, location config.Location) (time.Time, time.Time, bool) {
+	if !location.Set() {
+		return time.Time{}, time.Time{}, false
+	}
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+	// Fractional year in radians
+	g := 2 * math.Pi / 365 * float64(midnight.YearDay()-1)
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) - 0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl := 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) - 0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+
+	// Zenith of 90.833° accounts for atmospheric refraction and size of solar disc
+	lat := location.Latitude * math.Pi / 180
+	cosHA := math.Cos(90.833*math.Pi/180)/(math.Cos(lat)*math.Cos(decl)) - math.Tan(lat)*math.Tan(decl)
+	if cosHA < -1 || cosHA > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	ha := math.Acos(cosHA) * 180 / math.Pi
+
+	at := func(minutes float64) time.Time {
+		return midnight.Add(time.Duration(minutes * float64(time.Minute))).In(t.Location())
+	}
+	return at(720 - 4*(location.Longitude+ha) - eqTime), at(720 - 4*(location.Longitude-ha) - eqTime), true
+}
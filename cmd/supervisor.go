@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	supervisorCheckPeriod = 30 * time.Second
+	restartBackoffMin     = 1 * time.Second
+	restartBackoffMax     = 1 * time.Minute
+	// websocketStaleTimeout is a time without any EVOK message after which websocket connection is considered dead.
+	websocketStaleTimeout = 10 * time.Minute
+	settingsRefreshPeriod = 2 * time.Minute
+	// settingsMaxFailures is a number of consecutive failed refreshes after which refresher is restarted.
+	settingsMaxFailures = 3
+)
+
+// subsystem is a long running part of the controller restarted by supervisor whenever it fails, so the control
+// loop keeps running without whole-process restart.
+type subsystem struct {
+	name string
+	// start is optionally called before run, while health of the subsystem isn't watched yet.
+	start func()
+	// run blocks until subsystem stops. Nil error means deliberate stop, e.g. when client was swapped after
+	// configuration reload.
+	run func() error
+	// healthy is polled while subsystem runs. When it reports false, reset is called to make run return.
+	healthy func() bool
+	reset   func()
+}
+
+var (
+	subsystemRestartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "subsystem_restarts_total",
+		Help:      "Total number of subsystem restarts after failure",
+	}, []string{"subsystem"})
+	subsystemUpMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "subsystem_up",
+		Help:      "Whether subsystem is running",
+	}, []string{"subsystem"})
+)
+
+// supervise runs subsystem forever, restarting it with exponential backoff when it fails.
+func supervise(s subsystem) {
+	defer recoverCrash("subsystem " + s.name)
+	backoff := restartBackoffMin
+	for {
+		subsystemUpMetric.WithLabelValues(s.name).Set(1)
+		if s.start != nil {
+			s.start()
+		}
+		done := make(chan struct{})
+		go s.watch(done)
+		started := time.Now()
+		err := s.run()
+		close(done)
+		subsystemUpMetric.WithLabelValues(s.name).Set(0)
+
+		if err == nil {
+			backoff = restartBackoffMin
+			continue
+		}
+
+		if time.Since(started) > restartBackoffMax {
+			backoff = restartBackoffMin
+		}
+		log.Printf("Subsystem %s failed: %v, restarting in %s", s.name, err, backoff)
+		subsystemRestartsTotal.WithLabelValues(s.name).Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > restartBackoffMax {
+			backoff = restartBackoffMax
+		}
+	}
+}
+
+// watch resets subsystem when its health degrades until done is closed.
+func (s subsystem) watch(done <-chan struct{}) {
+	defer recoverCrash("subsystem " + s.name + " watch")
+	if s.healthy == nil {
+		return
+	}
+
+	ticker := time.NewTicker(supervisorCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !s.healthy() {
+				log.Printf("Subsystem %s is unhealthy, resetting it", s.name)
+				s.reset()
+				return
+			}
+		}
+	}
+}
+
+// websocketSubsystem receives EVOK updates. Client is resolved on every start, as it is swapped on configuration
+// reload.
+func websocketSubsystem() subsystem {
+	// startedAt is Unix time in nanoseconds of the last start, read by the watch goroutine.
+	var startedAt int64
+	return subsystem{
+		name:  "websocket",
+		start: func() { atomic.StoreInt64(&startedAt, time.Now().UnixNano()) },
+		run: func() error {
+			err := evokClient().HandleWebsocketConnection()
+			if err != nil {
+				markSync(dependencyEVOK, err)
+			}
+			return err
+		},
+		healthy: func() bool {
+			if simulation {
+				return true
+			}
+			started := time.Unix(0, atomic.LoadInt64(&startedAt))
+			last := evokClient().LastMessage()
+			if last.Before(started) {
+				last = started
+			}
+			if time.Since(last) >= websocketStaleTimeout {
+				markSync(dependencyEVOK, fmt.Errorf("no websocket message since %s", last.Format(time.RFC3339)))
+				return false
+			}
+			if last.After(started) {
+				markSync(dependencyEVOK, nil)
+			}
+			return true
+		},
+		reset: func() { evokClient().ResetConnection() },
+	}
+}
+
+// settingsSubsystem periodically refreshes settings from Home Assistant. Last known settings stay in use while
+// it is unreachable. It fails after several consecutive refresh errors, so idle connections are dropped before it is
+// started again.
+func settingsSubsystem() subsystem {
+	return subsystem{
+		name: "settings",
+		run: func() error {
+			failures := 0
+			for {
+				time.Sleep(settingsRefreshPeriod)
+				reloadToken()
+				err := syncSettings(hass())
+				syncProfileFromHA()
+				syncAlgorithmFromHA()
+				syncLockoutFromHA()
+				syncFeaturesFromHA()
+				if err == nil {
+					failures = 0
+					continue
+				}
+				log.Printf("Error getting settings from HomeAssistant: %v", err)
+				if failures++; failures >= settingsMaxFailures {
+					hass().CloseIdleConnections()
+					return fmt.Errorf("%d consecutive refreshes failed", failures)
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+const (
+	// waterHeatCapacity is specific heat of water in kJ/(kg*K). One liter of water is assumed to weigh 1 kg.
+	waterHeatCapacity = 4.186
+	tankPublishPeriod = 1 * time.Minute
+	// harvestWindow is a period over which harvest power is computed from tank heat content changes.
+	harvestWindow = 15 * time.Minute
+)
+
+type energySample struct {
+	at     time.Time
+	energy float64
+}
+
+var (
+	lastTankPublish time.Time
+	energySamples   []energySample
+	// lastChargePower is harvest power while the tank was last charged, used to predict surplus once it is full.
+	lastChargePower float64
+	// harvested accumulates energy for the harvested energy counter.
+	harvested harvestMeter
+)
+
+// harvestMeter accumulates energy harvested into the tank from successive heat content readings. Increases are only
+// counted while the circuit runs, so that heat from other sources is not attributed to the collector.
+type harvestMeter struct {
+	total    float64
+	last     float64
+	observed bool
+}
+
+// observe records current heat content and returns energy harvested since the previous reading.
+func (m *harvestMeter) observe(energy float64) float64 {
+	gain := 0.0
+	if circuitRunning && m.observed && energy > m.last {
+		gain = energy - m.last
+	}
+	m.total += gain
+	m.last, m.observed = energy, true
+	return gain
+}
+
+var (
+	tankEnergyMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "tank_energy_kwh",
+		Help:      "Estimated heat stored in the tank above reference temperature",
+	})
+	harvestPowerMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "harvest_power_kw",
+		Help:      "Harvest power computed from tank heat content changes",
+	})
+	timeToFullMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "tank_full_in_seconds",
+		Help:      "Predicted time until tank reaches its limit, -1 when tank is not being charged",
+	})
+	surplusAvailableMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "surplus_heat_available",
+		Help:      "Set when tank is full, or predicted to be full, well before sunset",
+	})
+	surplusEnergyMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "surplus_heat_kwh",
+		Help:      "Heat expected to be available after tank is full until sunset",
+	})
+	showerReadyInMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "shower_ready_in_seconds",
+		Help:      "Predicted time until tank is warm enough for a shower, 0 when it is and -1 when it is not being charged",
+	})
+	harvestedEnergyTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "harvested_energy_kwh_total",
+		Help:      "Heat added to the tank while the circuit was running",
+	})
+)
+
+// heatContent returns heat in kWh stored in the tank at mean temperature.
+func heatContent(mean float64) float64 {
+	energy := controllerCfg().Tank.Volume * waterHeatCapacity * (mean - controllerCfg().Tank.ReferenceTemperature) / 3600
+	if energy < 0 {
+		return 0
+	}
+	return energy
+}
+
+// tankEnergy estimates heat stored in the tank in kWh. Tank sensors are assumed to measure layers of equal volume.
+func tankEnergy(s *evok.Sensors) float64 {
+	tank := s.Tank()
+	if len(tank) == 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, sensor := range tank {
+		sum += sensor.Value
+	}
+	return heatContent(sum / float64(len(tank)))
+}
+
+// harvestPower returns mean power in kW by which tank heat content grew over harvestWindow.
+func harvestPower(energy float64, now time.Time) float64 {
+	energySamples = append(energySamples, energySample{at: now, energy: energy})
+	cutoff := now.Add(-harvestWindow)
+	for len(energySamples) > 1 && energySamples[0].at.Before(cutoff) {
+		energySamples = energySamples[1:]
+	}
+
+	oldest := energySamples[0]
+	elapsed := now.Sub(oldest.at).Hours()
+	if elapsed <= 0 {
+		return 0
+	}
+	return (energy - oldest.energy) / elapsed
+}
+
+// timeToFull predicts time until tank heat content reaches the value corresponding to tankMax. It returns -1 when
+// tank is not being charged.
+func timeToFull(energy, power, tankMax float64) time.Duration {
+	if !circuitRunning || power <= 0 {
+		return -1
+	}
+	remaining := heatContent(tankMax) - energy
+	if remaining <= 0 {
+		return 0
+	}
+	return time.Duration(remaining / power * float64(time.Hour))
+}
+
+// showerReadyIn returns 0 when tank top is at shower temperature, otherwise predicted time until harvest brings the
+// tank there or -1 when it is not being charged. Prediction assumes mixed tank, so stratified tank is ready sooner.
+func showerReadyIn(s *evok.Sensors, energy, power float64) time.Duration {
+	temperature := controllerCfg().Tank.ShowerTemperature
+	if s.TankUp.Value >= temperature {
+		return 0
+	}
+	return timeToFull(energy, power, temperature)
+}
+
+// surplusHeat predicts heat in kWh which could be harvested after tank gets full and before sunset. Surplus is
+// signalled only when tank is full, or predicted to be full, at least margin before sunset.
+func surplusHeat(full bool, fullIn time.Duration, power float64, now time.Time) (bool, float64) {
+	_, sunset, ok := sunTimes(now, controllerCfg().Location)
+	if !ok {
+		return false, 0
+	}
+	if full {
+		fullIn, power = 0, lastChargePower
+	}
+	untilSunset := sunset.Sub(now)
+	if fullIn < 0 || power <= 0 || fullIn+controllerCfg().Tank.GetSurplusMargin() > untilSunset {
+		return false, 0
+	}
+	return true, power * (untilSunset - fullIn).Hours()
+}
+
+// updateTankEnergy exports tank heat content with charging prediction and periodically publishes them to
+// Home Assistant.
+func updateTankEnergy(s *evok.Sensors, tankMax float64) {
+	if controllerCfg().Tank.Volume <= 0 {
+		return
+	}
+
+	now := time.Now()
+	energy := tankEnergy(s)
+	power := harvestPower(energy, now)
+	fullIn := timeToFull(energy, power, tankMax)
+	if circuitRunning && power > 0 {
+		lastChargePower = power
+	}
+	harvestedEnergyTotal.Add(harvested.observe(energy))
+	available, surplus := surplusHeat(energy >= heatContent(tankMax), fullIn, power, now)
+	showerIn := time.Duration(-1)
+	if controllerCfg().Tank.ShowerTemperature > 0 {
+		showerIn = showerReadyIn(s, energy, power)
+	}
+
+	tankEnergyMetric.Set(energy)
+	harvestPowerMetric.Set(power)
+	systemStatus.TankEnergy = energy
+	systemStatus.HarvestPower = power
+	if fullIn < 0 {
+		timeToFullMetric.Set(-1)
+		systemStatus.TankFullAt = 0
+	} else {
+		timeToFullMetric.Set(fullIn.Seconds())
+		systemStatus.TankFullAt = now.Add(fullIn).Unix()
+	}
+	if showerIn < 0 {
+		showerReadyInMetric.Set(-1)
+	} else {
+		showerReadyInMetric.Set(showerIn.Seconds())
+	}
+	surplusEnergyMetric.Set(surplus)
+	systemStatus.SurplusHeat = surplus
+	if available {
+		surplusAvailableMetric.Set(1)
+	} else {
+		surplusAvailableMetric.Set(0)
+	}
+
+	if time.Since(lastTankPublish) < tankPublishPeriod {
+		return
+	}
+	lastTankPublish = now
+
+	if entity := controllerCfg().Tank.EntityID; entity != "" {
+		attributes := map[string]interface{}{
+			"friendly_name":       "Solar tank heat content",
+			"unit_of_measurement": "kWh",
+			"device_class":        "energy",
+		}
+		sendToHA("publish tank heat content", func(c *homeassistant.Client) error {
+			return c.PublishState(entity, fmt.Sprintf("%.2f", energy), attributes)
+		})
+	}
+
+	// Total increasing energy sensor can be added to Home Assistant Energy dashboard as solar thermal contribution.
+	if entity := controllerCfg().Tank.HarvestedEnergyEntity; entity != "" {
+		attributes := map[string]interface{}{
+			"friendly_name":       "Solar harvested energy",
+			"unit_of_measurement": "kWh",
+			"device_class":        "energy",
+			"state_class":         "total_increasing",
+		}
+		harvested := harvestedEnergyTotal.get()
+		sendToHA("publish harvested energy", func(c *homeassistant.Client) error {
+			return c.PublishState(entity, fmt.Sprintf("%.3f", harvested), attributes)
+		})
+	}
+
+	if entity := controllerCfg().Tank.TimeToFullEntity; entity != "" {
+		state := "unknown"
+		if fullIn >= 0 {
+			state = now.Add(fullIn).Format(time.RFC3339)
+		}
+		attributes := map[string]interface{}{
+			"friendly_name":    "Solar tank full at",
+			"device_class":     "timestamp",
+			"harvest_power_kw": fmt.Sprintf("%.2f", power),
+		}
+		sendToHA("publish tank full prediction", func(c *homeassistant.Client) error {
+			return c.PublishState(entity, state, attributes)
+		})
+	}
+
+	// Readiness for people rather than raw temperatures. Ready tank is published with the current time.
+	if entity := controllerCfg().Tank.ShowerEntity; entity != "" {
+		state := "unknown"
+		if showerIn >= 0 {
+			state = now.Add(showerIn).Format(time.RFC3339)
+		}
+		attributes := map[string]interface{}{
+			"friendly_name": "Solar shower ready at",
+			"device_class":  "timestamp",
+			"ready":         showerIn == 0,
+			"temperature":   controllerCfg().Tank.ShowerTemperature,
+			"tank_up":       fmt.Sprintf("%.1f", s.TankUp.Value),
+		}
+		sendToHA("publish shower readiness", func(c *homeassistant.Client) error {
+			return c.PublishState(entity, state, attributes)
+		})
+	}
+
+	if entity := controllerCfg().Tank.SurplusEntity; entity != "" {
+		state := "off"
+		if available {
+			state = "on"
+		}
+		attributes := map[string]interface{}{
+			"friendly_name": "Solar surplus heat available",
+			"surplus_kwh":   fmt.Sprintf("%.2f", surplus),
+		}
+		sendToHA("publish surplus heat signal", func(c *homeassistant.Client) error {
+			return c.PublishState(entity, state, attributes)
+		})
+	}
+
+	if entity := controllerCfg().Tank.SurplusEnergyEntity; entity != "" {
+		attributes := map[string]interface{}{
+			"friendly_name":       "Solar expected surplus heat",
+			"unit_of_measurement": "kWh",
+			"device_class":        "energy",
+		}
+		sendToHA("publish expected surplus heat", func(c *homeassistant.Client) error {
+			return c.PublishState(entity, fmt.Sprintf("%.2f", surplus), attributes)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+// tankSensorResolution is the smallest change of TankUp reading which shows the sensor responds.
+const tankSensorResolution = 0.1
+
+var (
+	tankUpLast      float64
+	tankUpChangedAt time.Time
+	// harvestingSince is the start of the current period of running with high delta.
+	harvestingSince time.Time
+	tankSensorFault bool
+	tankFaultAt     time.Time
+
+	tankSensorFaultMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "tank_sensor_fault",
+		Help:      "Set when TankUp reading didn't change while the circuit was clearly harvesting, which suggests faulty sensor",
+	})
+)
+
+// observeTankSensor infers TankUp sensor fault from physics. Running circuit with high delta has to warm the tank, so
+// reading which doesn't change meanwhile is likely frozen. Fault is cleared as soon as the reading changes.
+func observeTankSensor(s *evok.Sensors, delta float64, now time.Time) {
+	check := controllerCfg().TankSensorCheck
+	if check.Delta == 0 {
+		return
+	}
+
+	if tankUpChangedAt.IsZero() || math.Abs(s.TankUp.Value-tankUpLast) >= tankSensorResolution {
+		tankUpLast, tankUpChangedAt = s.TankUp.Value, now
+		if tankSensorFault {
+			clearTankSensorFault()
+		}
+	}
+
+	if !circuitRunning || delta < check.Delta {
+		harvestingSince = time.Time{}
+		return
+	}
+	if harvestingSince.IsZero() {
+		harvestingSince = now
+	}
+	window := check.GetWindow()
+	if tankSensorFault || now.Sub(harvestingSince) < window || now.Sub(tankUpChangedAt) < window {
+		return
+	}
+
+	tankSensorFault, tankFaultAt = true, now
+	systemStatus.TankSensorFault = true
+	tankSensorFaultMetric.Set(1)
+	log.Printf("TankUp reading %.1f didn't change for %s while harvesting with delta ≥ %.1f, sensor is probably faulty. Harvesting stops in %s",
+		s.TankUp.Value, window, check.Delta, check.GetMaxHarvest())
+	notifyEvent(config.EventTankSensorFault)
+}
+
+func clearTankSensorFault() {
+	tankSensorFault = false
+	systemStatus.TankSensorFault = false
+	tankSensorFaultMetric.Set(0)
+	log.Println("TankUp reading changed, tank sensor is no longer suspected faulty")
+	if !circuitRunning {
+		setStatus(modeStopped, "tank sensor responds again")
+	}
+}
+
+// tankSensorHold stops harvesting once it continued for the allowed time after TankUp sensor fault was inferred, as
+// tank could overheat without reaching tankMax on a frozen reading. It reports if the iteration is decided by it.
+func tankSensorHold(now time.Time) bool {
+	if !tankSensorFault || now.Sub(tankFaultAt) < controllerCfg().TankSensorCheck.GetMaxHarvest() {
+		return false
+	}
+	if circuitRunning {
+		reason := fmt.Sprintf("tankUp %.1f hasn't changed since %s while harvesting, sensor is probably faulty", tankUpLast, wallTime(tankUpChangedAt).Format("15:04"))
+		setStatus(modeTankSensorFault, reason)
+		stop(reason)
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// thermostatSettings are settings without which flow can't be calculated.
+var thermostatSettings = []string{"solarOn", "solarOff", "tankMax", "flow.dutyMin", "flow.dutyMax", "flow.tempMin", "flow.tempMax"}
+
+var (
+	thermostatActive bool
+	// flowFailed is set when the last flow valve command failed.
+	flowFailed bool
+
+	thermostatMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "fallback_thermostat_active",
+		Help:      "Harvesting is controlled by fallback differential thermostat",
+	})
+)
+
+// thermostatReason tells why the fallback thermostat has to take over, if it has to. Settings which are stale or
+// were never read from Home Assistant and only have built-in defaults are treated as unavailable.
+func thermostatReason(cfg homeassistant.Settings) (string, bool) {
+	if controllerCfg().Thermostat.On <= 0 {
+		return "", false
+	}
+	if evokClient().IsLockedOut("flow") {
+		return "flow valve is locked out", true
+	}
+	if flowFailed {
+		return "flow valve does not respond", true
+	}
+	for _, name := range thermostatSettings {
+		entity, _ := cfg.Lookup(name)
+		if entity.Stale || (entity.EntityID != "" && entity.Source == config.SourceDefault) {
+			return fmt.Sprintf("setting %s is unavailable", name), true
+		}
+	}
+	return "", false
+}
+
+// runThermostat switches the circuit on and off by collector to inlet difference and keeps flow fixed. While the
+// flow valve does not respond it is commanded even with the circuit stopped, so control is handed back as soon as
+// it recovers.
+func runThermostat(s *evok.Sensors, reason string) {
+	t := controllerCfg().Thermostat
+	if !thermostatActive {
+		log.Printf("Fallback thermostat takes over: %s", reason)
+		thermostatActive = true
+		thermostatMetric.Set(1)
+		preCirculating = false
+	}
+
+	diff := s.SolarUp.Value - s.SolarIn.Value
+	if circuitRunning {
+		if diff <= t.Off || s.TankUp.Value >= t.TankMax {
+			status := fmt.Sprintf("%s, solarUp - solarIn %.1f ≤ off %.1f or tankUp %.1f ≥ tankMax %.1f", reason, diff, t.Off, s.TankUp.Value, t.TankMax)
+			setStatus(modeFallbackThermostat, status)
+			stop(status)
+			return
+		}
+		if err := setFlow(t.Flow); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if diff >= t.On && s.TankUp.Value < t.TankMax {
+		setStatus(modeFallbackThermostat, fmt.Sprintf("%s, solarUp - solarIn %.1f ≥ on %.1f", reason, diff, t.On))
+		start()
+		if err := setFlow(t.Flow); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	setStatus(modeFallbackThermostat, fmt.Sprintf("%s, waiting for solarUp - solarIn %.1f ≥ on %.1f", reason, diff, t.On))
+	if flowFailed {
+		if err := setFlow(t.Flow); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// leaveThermostat hands control back to the regular control loop.
+func leaveThermostat() {
+	if !thermostatActive {
+		return
+	}
+	log.Println("Flow valve and settings are available again, fallback thermostat hands over control")
+	thermostatActive = false
+	thermostatMetric.Set(0)
+}
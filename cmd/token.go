@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+// hassTokenFile allows rotating Home Assistant token without restarting the controller. Empty when token is
+// given by flag.
+var hassTokenFile string
+
+// tokenMu guards hassToken, which is replaced on reload while other goroutines create Home Assistant clients.
+var tokenMu sync.Mutex
+
+// currentToken returns Home Assistant token in use.
+func currentToken() string {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	return hassToken
+}
+
+// readTokenFile returns token stored in hassTokenFile.
+func readTokenFile() (string, error) {
+	data, err := ioutil.ReadFile(hassTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// reloadToken switches Home Assistant client to a token which changed in hassTokenFile.
+func reloadToken() {
+	if hassTokenFile == "" {
+		return
+	}
+
+	token, err := readTokenFile()
+	if err != nil {
+		log.Printf("Could not read Home Assistant token: %v", err)
+		return
+	}
+	tokenMu.Lock()
+	changed := token != hassToken
+	hassToken = token
+	tokenMu.Unlock()
+	if !changed {
+		return
+	}
+
+	log.Printf("Home Assistant token changed in %s, reloading", hassTokenFile)
+	hass().SetToken(token)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+// Hourly aggregates are appended to one CSV file per month, e.g. trends-2026-10.csv, so seasons can be compared
+// without keeping long Prometheus retention.
+const (
+	trendFilePrefix = "trends-"
+	trendFileLayout = "2006-01"
+)
+
+var trendHeader = []string{"hour", "delta_mean", "solar_up_mean", "solar_up_max", "tank_up_mean", "runtime_minutes", "pump_starts", "energy_kwh"}
+
+var (
+	// trendDir is a directory for trend files. Empty disables trend storage.
+	trendDir string
+	// trendRetention is how long trend files are kept.
+	trendRetention time.Duration
+
+	trend hourAggregate
+)
+
+type hourAggregate struct {
+	start      time.Time
+	count      int
+	delta      float64
+	solarUp    float64
+	solarUpMax float64
+	tankUp     float64
+	runtime    time.Duration
+	starts     float64
+	harvest    harvestMeter
+}
+
+// observeTrends accumulates samples of the current hour and writes the aggregate once the hour is over.
+func observeTrends(s *evok.Sensors, delta float64, now time.Time) {
+	if trendDir == "" {
+		return
+	}
+
+	energy := 0.0
+	if controllerCfg().Tank.Volume > 0 {
+		energy = tankEnergy(s)
+	}
+
+	hour := now.Truncate(time.Hour)
+	if !trend.start.Equal(hour) {
+		if !trend.start.IsZero() && trend.count > 0 {
+			if err := writeTrend(trend); err != nil {
+				log.Printf("Could not write hourly trend: %v", err)
+			}
+		}
+		trend = hourAggregate{
+			start:      hour,
+			solarUpMax: math.Inf(-1),
+			runtime:    pumpRuntime,
+			starts:     pumpStartsTotal.get(),
+		}
+	}
+
+	trend.count++
+	trend.delta += delta
+	trend.solarUp += s.SolarUp.Value
+	trend.solarUpMax = math.Max(trend.solarUpMax, s.SolarUp.Value)
+	trend.tankUp += s.TankUp.Value
+	trend.harvest.observe(energy)
+}
+
+// writeTrend appends aggregate to the file of its month. Expired files are removed whenever a new file is started.
+func writeTrend(a hourAggregate) error {
+	path := filepath.Join(trendDir, trendFilePrefix+a.start.Format(trendFileLayout)+".csv")
+	_, err := os.Stat(path)
+	newFile := os.IsNotExist(err)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n := float64(a.count)
+	w := csv.NewWriter(f)
+	if newFile {
+		if err := w.Write(trendHeader); err != nil {
+			return err
+		}
+	}
+	err = w.Write([]string{
+		a.start.Format(time.RFC3339),
+		formatTrend(a.delta / n),
+		formatTrend(a.solarUp / n),
+		formatTrend(a.solarUpMax),
+		formatTrend(a.tankUp / n),
+		formatTrend((pumpRuntime - a.runtime).Minutes()),
+		formatTrend(pumpStartsTotal.get() - a.starts),
+		formatTrend(a.harvest.total),
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	if newFile {
+		removeExpiredTrends(a.start)
+	}
+	return nil
+}
+
+func formatTrend(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// removeExpiredTrends deletes files of months which ended more than trendRetention before now.
+func removeExpiredTrends(now time.Time) {
+	if trendRetention <= 0 {
+		return
+	}
+
+	files, err := ioutil.ReadDir(trendDir)
+	if err != nil {
+		log.Printf("Could not list trend files: %v", err)
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, trendFilePrefix) || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		month, err := time.ParseInLocation(trendFileLayout, strings.TrimSuffix(strings.TrimPrefix(name, trendFilePrefix), ".csv"), now.Location())
+		if err != nil {
+			continue
+		}
+		if month.AddDate(0, 1, 0).Add(trendRetention).Before(now) {
+			if err := os.Remove(filepath.Join(trendDir, name)); err != nil {
+				log.Printf("Could not remove expired trend file: %v", err)
+				continue
+			}
+			log.Printf("Removed expired trend file %s", name)
+		}
+	}
+}
+
+// checkTrendDir makes sure trend directory exists.
+func checkTrendDir() error {
+	if trendDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(trendDir, 0755); err != nil {
+		return fmt.Errorf("could not create trend directory: %w", err)
+	}
+	return nil
+}
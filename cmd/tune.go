@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// transferScale is flow duty at which heat transfer from the collector reaches 63% of its maximum. Heat transfer
+// saturates with flow, so doubling flow gains less than double the energy.
+const transferScale = 30.0
+
+// curveParameters are settings searched by tune subcommand, in order of tuneVector.
+var curveParameters = []string{"flow.dutyMin", "flow.dutyMax", "flow.tempMin", "flow.tempMax"}
+
+// trendHour is an hour of recorded history used for tuning.
+type trendHour struct {
+	start   time.Time
+	delta   float64
+	runtime float64
+	starts  float64
+	energy  float64
+}
+
+type tuneEstimate struct {
+	Settings     map[string]float64 `json:"settings"`
+	EnergyKWh    float64            `json:"energyKwh"`
+	StartsPerDay float64            `json:"startsPerDay"`
+}
+
+type tuneReport struct {
+	Hours       int          `json:"hours"`
+	Days        int          `json:"days"`
+	MaxStarts   float64      `json:"maxStartsPerDay"`
+	Current     tuneEstimate `json:"current"`
+	Recommended tuneEstimate `json:"recommended"`
+	// Feasible is false when no curve was found within the limit of pump starts.
+	Feasible bool `json:"feasible"`
+}
+
+// runTune implements "tune" subcommand. It replays hourly trends recorded by the controller with candidate flow
+// curves and searches by simulated annealing for the curve with the most harvested energy whose pump starts per day
+// stay within the limit. Flow of recorded hours is taken from the configured curve, so trends should be recorded
+// with the same settings. Energy of a running hour is scaled by saturating heat transfer at candidate flow and pump
+// starts proportionally to flow, as higher flow cools the collector down sooner. It is a rough model, recommended
+// settings should be verified on the installation. Exit code is 1 when no curve meets the limit.
+func runTune(args []string) int {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	configFile := fs.String("config", "", "Configuration file with settings, defaults to SOLAR_CONFIG_JSON or /config.yaml")
+	dir := fs.String("trend-dir", "", "Directory with trend files recorded by the controller")
+	maxStarts := fs.Float64("max-starts", 0, "Highest acceptable mean pump starts per day, defaults to the recorded one")
+	iterations := fs.Int("iterations", 20000, "Number of annealing iterations")
+	seed := fs.Int64("seed", 1, "Seed of random search, the same seed gives the same result")
+	asJSON := fs.Bool("json", false, "Print JSON instead of the table")
+	overrides := settingFlags{}
+	fs.Var(overrides, "setting", "Set value of a setting as name=value, can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || *iterations <= 0 || *maxStarts < 0 {
+		fmt.Fprintln(os.Stderr, "trend-dir is required, iterations must be positive and max-starts can't be negative")
+		return 2
+	}
+
+	settings, err := offlineSettings(configFile, overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if !vectorOf(settings.Flow).valid() {
+		fmt.Fprintln(os.Stderr, "Configured flow curve is invalid, check it with curve subcommand")
+		return 2
+	}
+	history, err := readTrends(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read trends: %v\n", err)
+		return 2
+	}
+	if len(history) == 0 {
+		fmt.Fprintf(os.Stderr, "No recorded hours in %s\n", *dir)
+		return 2
+	}
+
+	report := tuneCurve(history, settings.Flow, *maxStarts, *iterations, rand.New(rand.NewSource(*seed)))
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		printTune(os.Stdout, report)
+	}
+
+	if !report.Feasible {
+		return 1
+	}
+	return 0
+}
+
+// readTrends reads hourly aggregates from all trend files in dir. Columns are looked up by header, so files written
+// by other versions can be read as long as they have the needed ones.
+func readTrends(dir string) ([]trendHour, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []trendHour
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, trendFilePrefix) || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		hours, err := readTrendFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		history = append(history, hours...)
+	}
+	return history, nil
+}
+
+func readTrendFile(path string) ([]trendHour, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"hour", "delta_mean", "runtime_minutes", "pump_starts", "energy_kwh"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	var hours []trendHour
+	for line, record := range records[1:] {
+		field := func(name string) (float64, error) {
+			i := columns[name]
+			if i >= len(record) {
+				return 0, fmt.Errorf("line %d: missing %s", line+2, name)
+			}
+			return strconv.ParseFloat(record[i], 64)
+		}
+		var h trendHour
+		if h.start, err = time.Parse(time.RFC3339, record[columns["hour"]]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line+2, err)
+		}
+		for name, v := range map[string]*float64{"delta_mean": &h.delta, "runtime_minutes": &h.runtime, "pump_starts": &h.starts, "energy_kwh": &h.energy} {
+			if *v, err = field(name); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line+2, err)
+			}
+		}
+		hours = append(hours, h)
+	}
+	return hours, nil
+}
+
+// tuneVector holds curve parameters in order of curveParameters.
+type tuneVector [4]float64
+
+func vectorOf(flow homeassistant.FlowSettings) tuneVector {
+	return tuneVector{flow.DutyMin.Value, flow.DutyMax.Value, flow.TempMin.Value, flow.TempMax.Value}
+}
+
+func (v tuneVector) flow() homeassistant.FlowSettings {
+	var flow homeassistant.FlowSettings
+	flow.DutyMin.Value, flow.DutyMax.Value, flow.TempMin.Value, flow.TempMax.Value = v[0], v[1], v[2], v[3]
+	return flow
+}
+
+// valid reports if curve rises with delta and keeps flow valve open while the pump runs.
+func (v tuneVector) valid() bool {
+	return v[0] > 0 && v[0] <= v[1] && v[2] < v[3]
+}
+
+// simulate estimates energy and total pump starts of recorded history with candidate curve.
+func simulate(history []trendHour, recorded, candidate homeassistant.FlowSettings) (energy, starts float64) {
+	for _, h := range history {
+		if h.runtime <= 0 {
+			continue
+		}
+		before, after := flowCurve(recorded, h.delta), flowCurve(candidate, h.delta)
+		if before <= 0 {
+			energy += h.energy
+			starts += h.starts
+			continue
+		}
+		energy += h.energy * transfer(after) / transfer(before)
+		starts += h.starts * after / before
+	}
+	return energy, starts
+}
+
+// transfer returns relative heat transfer from the collector at flow duty.
+func transfer(duty float64) float64 {
+	return 1 - math.Exp(-duty/transferScale)
+}
+
+// tuneCurve searches curve parameters within setting bounds for the most energy with mean pump starts per day not
+// above maxStarts. Zero maxStarts keeps the recorded mean.
+func tuneCurve(history []trendHour, current homeassistant.FlowSettings, maxStarts float64, iterations int, rnd *rand.Rand) tuneReport {
+	days := make(map[string]bool)
+	for _, h := range history {
+		days[h.start.Format("2006-01-02")] = true
+	}
+	report := tuneReport{Hours: len(history), Days: len(days)}
+	n := float64(len(days))
+
+	energy, starts := simulate(history, current, current)
+	report.Current = estimate(vectorOf(current), energy, starts/n)
+	if maxStarts == 0 {
+		maxStarts = starts / n
+	}
+	report.MaxStarts = maxStarts
+
+	// Score penalizes starts above the limit, so the search can pass through infeasible curves.
+	score := func(v tuneVector) (float64, float64, float64) {
+		e, s := simulate(history, current, v.flow())
+		return e - energy*math.Max(0, s/n-maxStarts), e, s / n
+	}
+
+	state := vectorOf(current)
+	stateScore, _, _ := score(state)
+	best, found := report.Current, report.Current.StartsPerDay <= maxStarts
+	for i := 0; i < iterations; i++ {
+		temperature := (1 - float64(i)/float64(iterations)) * math.Max(energy, 1) / 10
+
+		next := state
+		k := rnd.Intn(len(next))
+		b := config.SettingBounds[curveParameters[k]]
+		next[k] = math.Round(math.Max(b.Min, math.Min(b.Max, next[k]+rnd.NormFloat64()*(b.Max-b.Min)/20)))
+		if !next.valid() {
+			continue
+		}
+
+		nextScore, e, s := score(next)
+		if nextScore >= stateScore || rnd.Float64() < math.Exp((nextScore-stateScore)/temperature) {
+			state, stateScore = next, nextScore
+		}
+		if s <= maxStarts && (!found || e > best.EnergyKWh) {
+			best, found = estimate(next, e, s), true
+		}
+	}
+	report.Recommended, report.Feasible = best, found
+	return report
+}
+
+func estimate(v tuneVector, energy, startsPerDay float64) tuneEstimate {
+	settings := make(map[string]float64, len(curveParameters))
+	for i, name := range curveParameters {
+		settings[name] = v[i]
+	}
+	return tuneEstimate{
+		Settings:     settings,
+		EnergyKWh:    math.Round(energy*100) / 100,
+		StartsPerDay: math.Round(startsPerDay*100) / 100,
+	}
+}
+
+// printTune writes comparison of current and recommended curve followed by settings flags of the recommended one.
+func printTune(w io.Writer, report tuneReport) {
+	fmt.Fprintf(w, "%d hour(s) of %d day(s), at most %.1f pump starts per day\n\n", report.Hours, report.Days, report.MaxStarts)
+	fmt.Fprintf(w, "%-14s %10s %12s\n", "", "current", "recommended")
+	for _, name := range curveParameters {
+		fmt.Fprintf(w, "%-14s %10g %12g\n", name, report.Current.Settings[name], report.Recommended.Settings[name])
+	}
+	fmt.Fprintf(w, "%-14s %10.2f %12.2f\n", "energy kWh", report.Current.EnergyKWh, report.Recommended.EnergyKWh)
+	fmt.Fprintf(w, "%-14s %10.2f %12.2f\n\n", "starts/day", report.Current.StartsPerDay, report.Recommended.StartsPerDay)
+	if !report.Feasible {
+		fmt.Fprintln(w, "WARNING: no curve keeps pump starts within the limit")
+		return
+	}
+	for _, name := range curveParameters {
+		fmt.Fprintf(w, "--setting %s=%g ", name, report.Recommended.Settings[name])
+	}
+	fmt.Fprintln(w)
+}
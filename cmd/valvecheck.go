@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/config"
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+type valveSample struct {
+	at    time.Time
+	flow  float64
+	delta float64
+}
+
+// valveProbe follows delta after flow was raised by at least a step.
+type valveProbe struct {
+	raised time.Time
+	// flow and delta before the raise.
+	flow  float64
+	delta float64
+	// lowest is the lowest delta seen since the raise.
+	lowest float64
+}
+
+var (
+	valveSamples []valveSample
+	flowProbe    *valveProbe
+	valveMisses  int
+	valveStuck   bool
+
+	valveStuckMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "flow_valve_stuck",
+		Help:      "Set when raising commanded flow repeatedly didn't lower collector delta, which suggests stuck flow valve",
+	})
+)
+
+// observeValve checks that raising commanded flow lowers collector delta while working in steady state. Flow
+// raised by a step within response time starts a probe, which passes when delta drops enough within response time
+// after the raise. Probes interrupted by lowering flow back are dropped. Delta follows the sun as well, so the valve is
+// reported stuck only after several probes in a row failed and cleared by the first passed one.
+func observeValve(delta float64, now time.Time) {
+	check := controllerCfg().Maintenance.ValveCheck
+	if check.Step == 0 {
+		return
+	}
+	if !circuitRunning || systemStatus.Mode != modeWorking || flowFailed || evokClient().IsLockedOut("flow") ||
+		time.Since(runningSince) < airSettleTime {
+		valveSamples, flowProbe = valveSamples[:0], nil
+		return
+	}
+
+	response := check.GetResponse()
+	if flowProbe != nil {
+		if requestedFlow < flowProbe.flow+check.Step {
+			flowProbe = nil
+			valveSamples = valveSamples[:0]
+			return
+		}
+		flowProbe.lowest = math.Min(flowProbe.lowest, delta)
+		if now.Sub(flowProbe.raised) >= response {
+			judgeValveProbe(check)
+			flowProbe = nil
+			valveSamples = valveSamples[:0]
+		}
+		return
+	}
+
+	valveSamples = append(valveSamples, valveSample{at: now, flow: requestedFlow, delta: delta})
+	for len(valveSamples) > 0 && now.Sub(valveSamples[0].at) > response {
+		valveSamples = valveSamples[1:]
+	}
+	for _, s := range valveSamples {
+		if requestedFlow-s.flow >= check.Step {
+			flowProbe = &valveProbe{raised: now, flow: s.flow, delta: s.delta, lowest: delta}
+			return
+		}
+	}
+}
+
+// judgeValveProbe counts probes in a row in which delta didn't follow raised flow and updates stuck valve alert.
+func judgeValveProbe(check config.ValveCheck) {
+	drop := flowProbe.delta - flowProbe.lowest
+	reason := fmt.Sprintf("flow raised from %.0f to %.0f lowered delta by %.1f within %s", flowProbe.flow, requestedFlow, drop, check.GetResponse())
+	if drop >= check.GetMinDrop() {
+		valveMisses = 0
+	} else {
+		valveMisses++
+		log.Printf("Delta didn't follow flow, %s (%d/%d)", reason, valveMisses, check.GetMisses())
+	}
+
+	stuck := valveMisses >= check.GetMisses()
+	if stuck == valveStuck {
+		return
+	}
+	valveStuck = stuck
+	systemStatus.ValveStuck = stuck
+
+	state := "off"
+	if stuck {
+		state = "on"
+		valveStuckMetric.Set(1)
+		log.Printf("Flow valve suspected stuck, %s. Check flow valve actuator", reason)
+		notifyEvent(config.EventValveStuck)
+	} else {
+		valveStuckMetric.Set(0)
+		log.Println("Delta follows flow again, flow valve is no longer suspected stuck")
+	}
+
+	entity := check.EntityID
+	if entity == "" {
+		return
+	}
+	attributes := map[string]interface{}{
+		"friendly_name": "Solar flow valve stuck",
+		"reason":        reason,
+	}
+	sendToHA("publish stuck flow valve state", func(c *homeassistant.Client) error {
+		return c.PublishState(entity, state, attributes)
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+const (
+	lastValveExerciseKey = "lastValveExercise"
+	// valveExerciseEventType is Home Assistant event fired when valve exercise completes.
+	valveExerciseEventType = "solar_valve_exercise"
+)
+
+// valvePosition is a position of switching valve and flow actuator held during valve exercise.
+type valvePosition struct {
+	Switch float64
+	Flow   float64
+}
+
+// valveExercisePositions move both valves to one end of their travel and then to the other.
+var valveExercisePositions = []valvePosition{{Switch: 1, Flow: 100}, {Switch: 0, Flow: 0}}
+
+var (
+	// lastValveExercise is the last time valves moved through full travel, either exercised or in operation.
+	lastValveExercise time.Time
+	exercising        bool
+	exercisePosition  int
+	exerciseNext      time.Time
+
+	valveExerciseTotal = newPersistentCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "valve_exercise_total",
+		Help:      "Increase when switching valve and flow actuator completed full travel after a long idle period",
+	})
+)
+
+// loadLastValveExercise restores time of the last valve exercise from the state store. Without it idle time is
+// counted from startup.
+func loadLastValveExercise() {
+	var unix int64
+	found, err := stateStore.Get(lastValveExerciseKey, &unix)
+	if err != nil {
+		log.Println(err)
+	}
+	if !found || err != nil {
+		lastValveExercise = time.Now()
+		return
+	}
+	lastValveExercise = time.Unix(unix, 0)
+}
+
+// storeLastValveExercise puts time of the last valve exercise into the state store.
+func storeLastValveExercise() {
+	if err := stateStore.Set(lastValveExerciseKey, wallTime(lastValveExercise).Unix()); err != nil {
+		log.Println(err)
+	}
+}
+
+// exerciseIdleValves starts valve exercise if it is due and reports if it did. Running circuit moves the valves, so
+// idle time is counted from the last time it ran.
+func exerciseIdleValves(now time.Time) bool {
+	interval := controllerCfg().Maintenance.ValveExercise.Interval
+	if interval == 0 || circuitRunning || kicking || exercising || now.Sub(lastValveExercise) < interval {
+		return false
+	}
+
+	log.Printf("Valves were idle since %s, exercising them through full travel", wallTime(lastValveExercise).Format("2006-01-02 15:04"))
+	setStatus(modeValveExercise, fmt.Sprintf("valves idle since %s", wallTime(lastValveExercise).Format("2006-01-02 15:04")))
+	exercising = true
+	exercisePosition = 0
+	moveValves(now)
+	decide(stepValveExercise)
+	return true
+}
+
+// continueValveExercise moves valves to the next position once the current one was held for travel time. Exercise
+// is abandoned when the circuit is started and is retried once it is idle again.
+func continueValveExercise(now time.Time) {
+	if !exercising {
+		return
+	}
+	if circuitRunning {
+		log.Println("Circuit started, valve exercise abandoned")
+		exercising = false
+		return
+	}
+	if now.Before(exerciseNext) {
+		return
+	}
+
+	exercisePosition++
+	if exercisePosition < len(valveExercisePositions) {
+		moveValves(now)
+		return
+	}
+
+	exercising = false
+	if err := setFlow(hass().GetSettings().Flow.DutyMin.Value); err != nil {
+		log.Println(err)
+	}
+	lastValveExercise = now
+	valveExerciseTotal.Inc()
+	persistState(true)
+	setStatus(modeStopped, "valve exercise completed")
+	sendToHA("fire valve exercise event", func(c *homeassistant.Client) error {
+		return c.FireEvent(valveExerciseEventType, map[string]interface{}{"travel": controllerCfg().Maintenance.ValveExercise.GetTravel().String()})
+	})
+}
+
+// moveValves sets valves to the current exercise position. Valves locked out for maintenance are left alone. Failed
+// commands abandon the exercise.
+func moveValves(now time.Time) {
+	position := valveExercisePositions[exercisePosition]
+	log.Printf("Valve exercise, switch to %.0f and flow to %.0f", position.Switch, position.Flow)
+
+	var err error
+	if !evokClient().IsLockedOut("switch") {
+		act := evokClient().GetActuators()
+		err = evokClient().SetValue(act.Switch.Dev, act.Switch.Circuit, position.Switch)
+	}
+	if err == nil {
+		err = setFlow(position.Flow)
+	}
+	if err != nil {
+		log.Printf("Valve exercise abandoned: %v", err)
+		exercising = false
+		return
+	}
+	exerciseNext = now.Add(controllerCfg().Maintenance.ValveExercise.GetTravel())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const warmUpKey = "warmUp"
+
+// warmUpStart describes the first start of a day relative to sunrise.
+type warmUpStart struct {
+	Day string `json:"day"`
+	// AfterSunrise is number of seconds between sunrise and the start.
+	AfterSunrise float64 `json:"afterSunrise"`
+	// Flow computed in the first working iteration.
+	Flow float64 `json:"flow"`
+}
+
+var (
+	lastWarmUpStart warmUpStart
+	// warmUpDay is the day flow valve was pre-positioned on.
+	warmUpDay string
+	// warmUpPositioned is set while flow valve waits in pre-positioned state for the circuit to start.
+	warmUpPositioned bool
+	// warmUpWatchedSince is when the controller started to watch for the first start of a day.
+	warmUpWatchedSince time.Time
+
+	warmUpTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "warm_up_prepositions_total",
+		Help:      "Increase when flow valve was pre-positioned before expected morning start",
+	})
+)
+
+// loadWarmUp restores the last first start of a day from the state store.
+func loadWarmUp() {
+	warmUpWatchedSince = time.Now()
+	if _, err := stateStore.Get(warmUpKey, &lastWarmUpStart); err != nil {
+		log.Println(err)
+	}
+}
+
+// storeWarmUp puts the last first start of a day into the state store.
+func storeWarmUp() {
+	if lastWarmUpStart.Day == "" {
+		return
+	}
+	if err := stateStore.Set(warmUpKey, lastWarmUpStart); err != nil {
+		log.Println(err)
+	}
+}
+
+// warmUpSkipped reports if pre-positioning is not used, as start sets its own flow.
+func warmUpSkipped() bool {
+	return !controllerCfg().WarmUp.Enabled || controllerCfg().PreCirculation > 0 || fillPhaseEnabled()
+}
+
+// recordWarmUp remembers offset from sunrise and flow of the first start of a day. Start is not known to be the
+// first one when the controller was started after sunrise.
+func recordWarmUp(now time.Time, flow float64) {
+	day := now.Format("2006-01-02")
+	if warmUpSkipped() || lastWarmUpStart.Day == day {
+		return
+	}
+	rise, _, ok := sunTimes(now, controllerCfg().Location)
+	if !ok || warmUpWatchedSince.After(rise) {
+		return
+	}
+	lastWarmUpStart = warmUpStart{Day: day, AfterSunrise: now.Sub(rise).Seconds(), Flow: flow}
+	log.Printf("First harvest of the day %s after sunrise at flow %.0f", now.Sub(rise).Round(time.Minute), flow)
+}
+
+// warmUpValve moves flow valve of the stopped circuit to the last first-start flow once the start is expected within
+// lead time. Valve is moved at most once a day and not after the circuit already started that day.
+func warmUpValve(now time.Time) {
+	day := now.Format("2006-01-02")
+	if warmUpDay != day {
+		warmUpPositioned = false
+	}
+	if warmUpSkipped() || lastWarmUpStart.Day == "" || lastWarmUpStart.Day == day || warmUpDay == day {
+		return
+	}
+	rise, _, ok := sunTimes(now, controllerCfg().Location)
+	if !ok {
+		return
+	}
+	expected := rise.Add(time.Duration(lastWarmUpStart.AfterSunrise * float64(time.Second)))
+	if now.Before(expected.Add(-controllerCfg().WarmUp.GetLead())) || now.After(expected.Add(controllerCfg().WarmUp.GetLead())) {
+		return
+	}
+
+	warmUpDay = day
+	log.Printf("Harvest expected at %s, pre-positioning flow valve to %.0f", expected.Format("15:04"), lastWarmUpStart.Flow)
+	if err := setFlow(lastWarmUpStart.Flow); err != nil {
+		log.Println(err)
+		return
+	}
+	warmUpPositioned = true
+	warmUpTotal.Inc()
+}
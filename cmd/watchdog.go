@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/evok"
+)
+
+var (
+	watchdogPulsesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "solar",
+		Name:      "watchdog_pulses_total",
+		Help:      "Increase on every toggle of watchdog output",
+	})
+	watchdogStarvedMetric = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "watchdog_starved",
+		Help:      "Set when watchdog output is not pulsed because control loop stalled",
+	})
+)
+
+// petWatchdog toggles watchdog output while the control loop keeps passing. Once pulses stop, because the loop
+// hangs, the process dies or EVOK stops executing commands, hardware watchdog de-energizes the pump on its own.
+func petWatchdog() {
+	defer recoverCrash("watchdog")
+	level := 0.0
+	starved := true
+	for {
+		cfg := controllerCfg().Watchdog
+		time.Sleep(cfg.GetInterval())
+
+		out := evokClient().GetActuators().Watchdog
+		if out.Dev == "" {
+			continue
+		}
+
+		stalled := time.Since(lastPass) > cfg.GetStall()
+		if stalled != starved {
+			starved = stalled
+			if starved {
+				log.Printf("Control loop did not pass since %s, watchdog is no longer pulsed", lastPass.Format(time.RFC3339))
+			} else {
+				log.Println("Control loop is passing, pulsing watchdog")
+			}
+		}
+		if starved {
+			watchdogStarvedMetric.Set(1)
+			continue
+		}
+		watchdogStarvedMetric.Set(0)
+
+		level = 1 - level
+		err := evokClient().SetValue(out.Dev, out.Circuit, level)
+		switch err {
+		case nil:
+			watchdogPulsesTotal.Inc()
+		case evok.ErrInhibited, evok.ErrLockedOut:
+		default:
+			log.Printf("Could not pulse watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package backup packs controller files into an encrypted archive used to migrate the controller to new hardware.
+// Archive is a gzipped tarball encrypted with AES-256-GCM. Key is derived from a passphrase with PBKDF2-HMAC-SHA256
+// and a random salt, so the same passphrase produces different keys for every backup.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	magic      = "SOLARBK1"
+	saltSize   = 16
+	keySize    = 32
+	iterations = 100000
+	// maxFileSize limits size of a single file unpacked from an archive.
+	maxFileSize = 16 << 20
+	// maxFiles limits number of files unpacked from an archive.
+	maxFiles = 64
+)
+
+// ErrDecrypt is returned when archive can't be decrypted, usually because of a wrong passphrase.
+var ErrDecrypt = errors.New("could not decrypt backup, passphrase is wrong or archive is damaged")
+
+// Write packs files keyed by their names into an archive encrypted with passphrase.
+func Write(w io.Writer, passphrase string, files map[string][]byte) error {
+	if passphrase == "" {
+		return fmt.Errorf("backup passphrase is empty")
+	}
+
+	var plain bytes.Buffer
+	gz := gzip.NewWriter(&plain)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("could not pack %s: %w", name, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return fmt.Errorf("could not pack %s: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("could not pack backup: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("could not compress backup: %w", err)
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("could not generate salt: %w", err)
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	header := append([]byte(magic), salt...)
+	sealed := aead.Seal(nil, nonce, plain.Bytes(), header)
+	for _, part := range [][]byte{header, nonce, sealed} {
+		if _, err := w.Write(part); err != nil {
+			return fmt.Errorf("could not write backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// Read decrypts archive with passphrase and returns files it contains keyed by their names.
+func Read(r io.Reader, passphrase string) (map[string][]byte, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup: %w", err)
+	}
+	if len(data) < len(magic)+saltSize || string(data[:len(magic)]) != magic {
+		return nil, fmt.Errorf("not a controller backup")
+	}
+
+	header, rest := data[:len(magic)+saltSize], data[len(magic)+saltSize:]
+	aead, err := newAEAD(passphrase, header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress backup: %w", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not unpack backup: %w", err)
+		}
+		if len(files) >= maxFiles {
+			return nil, fmt.Errorf("backup contains more than %d files", maxFiles)
+		}
+		if hdr.Size > maxFileSize {
+			return nil, fmt.Errorf("file %s in backup is too large", hdr.Name)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("could not unpack %s: %w", hdr.Name, err)
+		}
+		files[hdr.Name] = content
+	}
+	return files, nil
+}
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(passphrase, salt)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package backup
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+)
+
+// deriveKey derives AES-256 key from passphrase with PBKDF2-HMAC-SHA256 of the standard library. It is kept in its own
+// file, as calling generic pbkdf2.Key needs newer language version than the rest of the module. Older toolchains use
+// the implementation in kdf_legacy.go.
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, iterations, keySize)
+}
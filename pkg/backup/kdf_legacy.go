@@ -0,0 +1,32 @@
+//go:build !go1.24
+
+package backup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// deriveKey derives AES-256 key from passphrase with PBKDF2-HMAC-SHA256 for toolchains without crypto/pbkdf2. Key
+// fits into a single block of the hash, so only the first block is computed.
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	prf := hmac.New(sha256.New, []byte(passphrase))
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, 1)
+	prf.Write(salt)
+	prf.Write(index)
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key[:keySize], nil
+}
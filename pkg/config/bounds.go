@@ -0,0 +1,22 @@
+package config
+
+import "github.com/automatedhome/solar/pkg/homeassistant"
+
+// SettingBounds are absolute safety limits of settings received from Home Assistant. Values outside of them are
+// clamped, so a mistyped slider can't disable the failsafe or command impossible duty.
+var SettingBounds = map[string]homeassistant.Bounds{
+	"solarCritical":  {Min: 0, Max: 150},
+	"solarOn":        {Min: 0, Max: 50},
+	"solarOff":       {Min: 0, Max: 50},
+	"tankMax":        {Min: 0, Max: 95},
+	"coolingTankMax": {Min: 0, Max: 95},
+	"flow.dutyMin":   {Min: 0, Max: 100},
+	"flow.dutyMax":   {Min: 0, Max: 100},
+	"flow.tempMin":   {Min: 0, Max: 150},
+	"flow.tempMax":   {Min: 0, Max: 150},
+	"dhwFlowBoost":   {Min: 0, Max: 100},
+
+	"tankMaxOvershoot":        {Min: 0, Max: 20},
+	"tankMaxMorningReduction": {Min: 0, Max: 50},
+	"solarOffDeadband":        {Min: 0, Max: 10},
+}
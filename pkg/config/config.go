@@ -1,12 +1,17 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/automatedhome/solar/pkg/evok"
+	"github.com/automatedhome/solar/pkg/expr"
 	"github.com/automatedhome/solar/pkg/homeassistant"
 	"gopkg.in/yaml.v2"
 )
@@ -14,34 +19,916 @@ import (
 var internalConfigFile = "/config.yaml"
 
 type Config struct {
-	Settings  homeassistant.Settings
-	Actuators evok.Actuators
-	Sensors   evok.Sensors
+	Settings   homeassistant.Settings
+	Actuators  evok.Actuators
+	Sensors    evok.Sensors
+	Controller Controller
+	// Profiles are named sets of setting values overriding Home Assistant settings while the profile is active.
+	Profiles map[string]map[string]float64 `yaml:"profiles,omitempty"`
+	// Rules are site-specific conditions evaluated every control loop iteration after safety checks.
+	Rules []Rule `yaml:"rules,omitempty"`
+	// Computed are virtual sensors calculated from real sensors. They are evaluated in order, so each one can use
+	// those defined before it.
+	Computed []ComputedSensor `yaml:"computed,omitempty"`
+	// Notifications configures messages sent through Home Assistant notify service when anomalies persist.
+	Notifications Notifications `yaml:"notifications,omitempty"`
+
+	// yamlSettings are setting values given explicitly in the configuration file.
+	yamlSettings map[string]float64
 }
 
-func NewConfig(cfgFile *string) (*Config, error) {
-	configFilePath := internalConfigFile
-	if cfgFile == nil {
-		configFilePath = *cfgFile
+// Notifications sends message through Service (e.g. "notify.family") once an alert fires.
+type Notifications struct {
+	Service string  `yaml:"service,omitempty"`
+	Alerts  []Alert `yaml:"alerts,omitempty"`
+}
+
+// Alert fires when Event happens Count times Within a period. Message is a text/template with sensor values,
+// "delta", "mode", "event" and "count" available, e.g. "Failsafe fired {{.count}} times, collector {{.solarUp}}".
+type Alert struct {
+	Event   string        `yaml:"event"`
+	Count   int           `yaml:"count,omitempty"`
+	Within  time.Duration `yaml:"within,omitempty"`
+	Message string        `yaml:"message"`
+}
+
+// Events which can be used in alerts besides safety events.
+const (
+	EventEmergency       = "emergency"
+	EventExternalChange  = "externalChange"
+	EventSensorSwap      = "sensorSwap"
+	EventHarvestAnomaly  = "harvestAnomaly"
+	EventScald           = "scald"
+	EventHeatUpDegraded  = "heatUpDegraded"
+	EventAirInLoop       = "airInLoop"
+	EventStopFailed      = "stopFailed"
+	EventValveStuck      = "valveStuck"
+	EventTankSensorFault = "tankSensorFault"
+	EventSensorFault     = "sensorFault"
+)
+
+func (n Notifications) validate() error {
+	if len(n.Alerts) > 0 && !strings.HasPrefix(n.Service, "notify.") {
+		return fmt.Errorf("notification service %q is not a notify service", n.Service)
+	}
+	for _, alert := range n.Alerts {
+		switch alert.Event {
+		case EventCritical, EventTankFull, EventHeatEscape, EventEmergency, EventExternalChange, EventSensorSwap,
+			EventHarvestAnomaly, EventScald, EventHeatUpDegraded,
+			EventAirInLoop, EventStopFailed, EventValveStuck, EventTankSensorFault, EventSensorFault:
+		default:
+			return fmt.Errorf("unknown alert event %q", alert.Event)
+		}
+		if _, err := template.New(alert.Event).Parse(alert.Message); err != nil {
+			return fmt.Errorf("alert %s: %w", alert.Event, err)
+		}
+	}
+	return nil
+}
+
+// ComputedSensor is a virtual sensor defined by an expression, e.g. "(solarUp + solarOut) / 2".
+type ComputedSensor struct {
+	Name string `yaml:"name"`
+	Expr string `yaml:"expr"`
+}
+
+// validateComputed checks that computed sensors and delta expression refer only to known sensors, and start
+// condition to known sensors, settings and delta.
+func (c *Config) validateComputed() error {
+	known := c.Sensors.Values()
+	check := func(name, src string) error {
+		e, err := expr.Parse(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for _, v := range e.Vars() {
+			if _, ok := known[v]; !ok {
+				return fmt.Errorf("%s: unknown sensor %s", name, v)
+			}
+		}
+		return nil
+	}
+
+	for _, sensor := range c.Computed {
+		if _, ok := known[sensor.Name]; ok || sensor.Name == "" {
+			return fmt.Errorf("computed sensor name %q is empty or already used", sensor.Name)
+		}
+		if err := check("computed sensor "+sensor.Name, sensor.Expr); err != nil {
+			return err
+		}
+		known[sensor.Name] = 0
+	}
+
+	if c.Controller.Delta != "" {
+		if err := check("delta", c.Controller.Delta); err != nil {
+			return err
+		}
+	}
+
+	if c.Controller.StartCondition != "" {
+		for _, name := range homeassistant.SettingNames() {
+			known[name] = 0
+		}
+		known["delta"], known["running"] = 0, 0
+		if err := check("start condition", c.Controller.StartCondition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Controller holds installation specific parameters of the control loop.
+type Controller struct {
+	// System selects profile of safety subsystems: glycol (default), drainback or direct.
+	System string `yaml:"system,omitempty"`
+	// FrostTemperature is a collector temperature below which frost protection circulates tank water. Defaults to 4°C.
+	FrostTemperature float64 `yaml:"frostTemperature,omitempty"`
+	// PreCirculation is the duration of a low-flow pulse run before the first start of the day. Disabled when 0.
+	PreCirculation time.Duration `yaml:"preCirculation,omitempty"`
+	// Maintenance configures pump maintenance reminder.
+	Maintenance Maintenance `yaml:"maintenance,omitempty"`
+	// AntiScald supervises thermostatic mixing valve with DHW outlet sensor.
+	AntiScald AntiScald `yaml:"antiScald,omitempty"`
+	// Stagnation configures night cooldown armed by weather based stagnation risk.
+	Stagnation Stagnation `yaml:"stagnation,omitempty"`
+	// Report configures daily summary published at local midnight.
+	Report Report `yaml:"report,omitempty"`
+	// Failsafe configures action taken on each safety event.
+	Failsafe Failsafe `yaml:"failsafe,omitempty"`
+	// Tank describes storage tank used for heat content estimation.
+	Tank Tank `yaml:"tank,omitempty"`
+	// ProfileEntity is an input_select entity used to switch operating profiles from Home Assistant.
+	ProfileEntity string `yaml:"profileEntity,omitempty"`
+	// Lockout maps actuator names to input_boolean entities which lock them out for maintenance.
+	Lockout map[string]string `yaml:"lockout,omitempty"`
+	// ReducedCountdownEntity is Home Assistant sensor to publish seconds remaining in reduced mode to.
+	ReducedCountdownEntity string `yaml:"reducedCountdownEntity,omitempty"`
+	// AlgorithmEntity is an input_select entity used to switch control algorithm, e.g. "legacy" or "adaptive".
+	AlgorithmEntity string `yaml:"algorithmEntity,omitempty"`
+	// Drainback configures startup and shutdown of drainback systems.
+	Drainback Drainback `yaml:"drainback,omitempty"`
+	// Purge configures circulation run after failsafe stops.
+	Purge Purge `yaml:"purge,omitempty"`
+	// SoftStart configures flow valve position and ramp on circuit start.
+	SoftStart SoftStart `yaml:"softStart,omitempty"`
+	// ReducedDecay is a time constant of exponential decay of flow towards DutyMin in reduced mode, which spares heat
+	// exchanger a thermal shock. 0 sets DutyMin immediately.
+	ReducedDecay time.Duration `yaml:"reducedDecay,omitempty"`
+	// PipeDelay is transport lag between collector outlet and SolarOut sensor. Heat escape is not evaluated for that
+	// long after start, as cold water standing in the pipe makes delta negative until it passes the sensor.
+	PipeDelay time.Duration `yaml:"pipeDelay,omitempty"`
+	// StartGrace is a period after start during which heat escape and low delta don't stop the circuit, so a fresh
+	// start isn't killed before the loop settles. Critical temperature and emergencies are still handled.
+	StartGrace time.Duration `yaml:"startGrace,omitempty"`
+	// TankSensorCheck configures inference of TankUp sensor fault.
+	TankSensorCheck TankSensorCheck `yaml:"tankSensorCheck,omitempty"`
+	// PumpRest limits continuous pump runtime.
+	PumpRest PumpRest `yaml:"pumpRest,omitempty"`
+	// Location of the collector, used to compute sunrise and sunset.
+	Location Location `yaml:"location,omitempty"`
+	// TankMaxSchedule changes tankMax during the week, e.g. higher before evening showers and lower overnight.
+	TankMaxSchedule homeassistant.Schedule `yaml:"tankMaxSchedule,omitempty"`
+	// BackupHeater configures interlock of electric backup heater.
+	BackupHeater BackupHeater `yaml:"backupHeater,omitempty"`
+	// WarmUp configures pre-positioning of flow valve before morning start.
+	WarmUp WarmUp `yaml:"warmUp,omitempty"`
+	// Features maps feature flags to their state on this installation. Flags not listed keep their default.
+	Features map[string]Feature `yaml:"features,omitempty"`
+	// Debounce maps transitions to number of consecutive control loop iterations their condition has to hold
+	// before the controller acts, e.g. {start: 3}. Transitions not listed act immediately.
+	Debounce map[string]int `yaml:"debounce,omitempty"`
+	// DebounceBypass sets how far beyond their thresholds safety readings trigger without waiting for debounce.
+	DebounceBypass DebounceBypass `yaml:"debounceBypass,omitempty"`
+	// Thermostat configures fallback differential thermostat used when flow valve or settings are unavailable.
+	Thermostat Thermostat `yaml:"thermostat,omitempty"`
+	// Watchdog configures pulsing of watchdog actuator.
+	Watchdog Watchdog `yaml:"watchdog,omitempty"`
+	// Delta is an expression over sensors and computed sensors used as temperature delta. Defaults to
+	// "(solarUp + solarOut) / 2 - solarIn".
+	Delta string `yaml:"delta,omitempty"`
+	// StartCondition is an expression over sensors, computed sensors, settings and delta which starts the circuit
+	// when it holds. Defaults to "delta >= solarOn && solarUp > solarOut".
+	StartCondition string `yaml:"startCondition,omitempty"`
+	// ExternalChange selects reaction to actuator changes made outside of the controller: alert (default) or
+	// reconcile.
+	ExternalChange string `yaml:"externalChange,omitempty"`
+	// EmergencyUnavailable selects how emergency entities are treated while they are unavailable or unknown in
+	// Home Assistant: failSafe (default) as active emergency, failOpen as no emergency.
+	EmergencyUnavailable string `yaml:"emergencyUnavailable,omitempty"`
+}
+
+// Policies of unavailable emergency entities.
+const (
+	EmergencyFailSafe = "failSafe"
+	EmergencyFailOpen = "failOpen"
+)
+
+// Reactions to external actuator changes.
+const (
+	ExternalChangeAlert     = "alert"
+	ExternalChangeReconcile = "reconcile"
+)
+
+// System profiles.
+const (
+	SystemGlycol    = "glycol"
+	SystemDrainback = "drainback"
+	SystemDirect    = "direct"
+)
+
+// Profile describes safety subsystems enabled for a system type.
+type Profile struct {
+	// FrostProtection circulates tank water when collector is close to freezing. Needed only when collector is
+	// filled with water.
+	FrostProtection bool
+	// StagnationHandling allows dumping excess tank heat through the collector. Drained collector can't do that.
+	StagnationHandling bool
+	// FillPhase primes drainback collector on start and de-energizes flow immediately on stop.
+	FillPhase bool
+}
+
+// Profile returns safety subsystems bundle for configured system type.
+func (c Controller) Profile() Profile {
+	switch c.System {
+	case SystemDrainback:
+		return Profile{FrostProtection: false, StagnationHandling: false, FillPhase: true}
+	case SystemDirect:
+		return Profile{FrostProtection: true, StagnationHandling: true, FillPhase: c.Drainback.Enabled}
+	default:
+		return Profile{FrostProtection: false, StagnationHandling: true, FillPhase: c.Drainback.Enabled}
+	}
+}
+
+// Reactions to DHW outlet temperature above scald threshold.
+const (
+	AntiScaldAlert     = "alert"
+	AntiScaldCutCharge = "cutCharge"
+)
+
+// AntiScald reacts when DHW outlet temperature exceeds Threshold, which means the mixing valve failed. Alert only
+// notifies, cutCharge also stops charging the tank until the temperature drops. Threshold of 0 disables it.
+type AntiScald struct {
+	Threshold float64 `yaml:"threshold,omitempty"`
+	Action    string  `yaml:"action,omitempty"`
+}
+
+// Stagnation arms night cooldown after hot, sunny and windless days, so the tank has spare capacity before the
+// collector stagnates. Cooldown then starts PrecoolMargin below tank limit. Threshold of 0 disables it.
+type Stagnation struct {
+	Threshold     float64 `yaml:"threshold,omitempty"`
+	PrecoolMargin float64 `yaml:"precoolMargin,omitempty"`
+}
+
+// GetFrostTemperature returns frost protection threshold.
+func (c Controller) GetFrostTemperature() float64 {
+	if c.FrostTemperature == 0 {
+		return 4
+	}
+	return c.FrostTemperature
+}
+
+// Tank configures heat content estimation. Estimation is disabled when volume is not set.
+type Tank struct {
+	// Volume in liters.
+	Volume float64 `yaml:"volume,omitempty"`
+	// ReferenceTemperature is a temperature of cold water entering the tank. Heat content is counted above it.
+	ReferenceTemperature float64 `yaml:"referenceTemperature,omitempty"`
+	// EntityID of Home Assistant sensor to publish heat content to.
+	EntityID string `yaml:"entity_id,omitempty"`
+	// HarvestedEnergyEntity is Home Assistant sensor to publish total heat harvested into the tank to, which can be
+	// used in Energy dashboard.
+	HarvestedEnergyEntity string `yaml:"harvestedEnergyEntity,omitempty"`
+	// TimeToFullEntity is Home Assistant sensor to publish predicted time until tank is full to.
+	TimeToFullEntity string `yaml:"timeToFullEntity,omitempty"`
+	// SurplusEntity is Home Assistant binary sensor turned on while tank is full, or predicted to be full, at least
+	// SurplusMargin before sunset. SurplusEnergyEntity is a sensor with heat in kWh expected to be available after
+	// tank is full. Both require location, margin defaults to 1 hour.
+	SurplusEntity       string        `yaml:"surplusEntity,omitempty"`
+	SurplusEnergyEntity string        `yaml:"surplusEnergyEntity,omitempty"`
+	SurplusMargin       time.Duration `yaml:"surplusMargin,omitempty"`
+	// ShowerEntity is Home Assistant sensor to publish time at which tank top is, or is predicted to be, at
+	// ShowerTemperature to.
+	ShowerEntity      string  `yaml:"showerEntity,omitempty"`
+	ShowerTemperature float64 `yaml:"showerTemperature,omitempty"`
+}
+
+// GetSurplusMargin returns how long before sunset tank has to be full for surplus heat to be signalled.
+func (t Tank) GetSurplusMargin() time.Duration {
+	if t.SurplusMargin == 0 {
+		return time.Hour
+	}
+	return t.SurplusMargin
+}
+
+// TankSensorCheck infers TankUp sensor fault when its reading doesn't change for Window, 30 minutes by default, while
+// the circuit runs with delta of at least Delta, which has to warm the tank. As tankMax can't be relied on then, the
+// circuit is stopped MaxHarvest after the fault was inferred, 1 hour by default, and kept stopped until the reading
+// changes. Delta of 0 disables it.
+type TankSensorCheck struct {
+	Delta      float64       `yaml:"delta,omitempty"`
+	Window     time.Duration `yaml:"window,omitempty"`
+	MaxHarvest time.Duration `yaml:"maxHarvest,omitempty"`
+}
+
+// GetWindow returns how long TankUp reading has to stay unchanged while harvesting.
+func (t TankSensorCheck) GetWindow() time.Duration {
+	if t.Window == 0 {
+		return 30 * time.Minute
+	}
+	return t.Window
+}
+
+// GetMaxHarvest returns how long harvesting continues after the fault was inferred.
+func (t TankSensorCheck) GetMaxHarvest() time.Duration {
+	if t.MaxHarvest == 0 {
+		return time.Hour
+	}
+	return t.MaxHarvest
+}
+
+// PumpRest stops the circuit once the pump ran continuously for MaxRun and keeps it stopped for Rest, which defaults
+// to 5 minutes, as some pumps require. Night cooldown and fallback thermostat wait for the rest as well, frost
+// protection runs regardless. MaxRun of 0 disables it.
+type PumpRest struct {
+	MaxRun time.Duration `yaml:"maxRun,omitempty"`
+	Rest   time.Duration `yaml:"rest,omitempty"`
+}
+
+// GetRest returns how long the pump rests after reaching MaxRun.
+func (p PumpRest) GetRest() time.Duration {
+	if p.Rest == 0 {
+		return 5 * time.Minute
+	}
+	return p.Rest
+}
+
+// SoftStart opens flow valve to Flow duty before the pump is energized and then lets the flow rise to the computed
+// value over Ramp, which avoids pressure spikes. Flow of 0 disables it. It is not used with drainback fill phase.
+type SoftStart struct {
+	Flow float64       `yaml:"flow,omitempty"`
+	Ramp time.Duration `yaml:"ramp,omitempty"`
+}
+
+// BackupHeater publishes interlock to Home Assistant binary sensor EntityID, which is on while electric backup heater
+// should stay off. Heater is blocked when electricity price is above MaxPrice and solar covers demand: tank top is
+// at DemandTemperature or harvest is predicted to bring it there before sunset. Prediction requires tank volume and
+// location. Empty EntityID disables it.
+type BackupHeater struct {
+	EntityID          string  `yaml:"entity_id,omitempty"`
+	MaxPrice          float64 `yaml:"maxPrice,omitempty"`
+	DemandTemperature float64 `yaml:"demandTemperature,omitempty"`
+}
+
+// Location is geographic position in degrees, north and east being positive.
+type Location struct {
+	Latitude  float64 `yaml:"latitude,omitempty"`
+	Longitude float64 `yaml:"longitude,omitempty"`
+}
+
+// Set reports if location is configured.
+func (l Location) Set() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+// WarmUp moves flow valve to the flow of the last first start of a day Lead before the start is expected again,
+// 10 minutes by default. Start is expected at the same offset from sunrise as the last one, so it requires
+// location. It is skipped with pre-circulation and drainback fill phase, which set their own flow on start.
+type WarmUp struct {
+	Enabled bool          `yaml:"enabled,omitempty"`
+	Lead    time.Duration `yaml:"lead,omitempty"`
+}
+
+// GetLead returns how long before expected start the valve is moved.
+func (w WarmUp) GetLead() time.Duration {
+	if w.Lead == 0 {
+		return 10 * time.Minute
+	}
+	return w.Lead
+}
+
+// DebounceBypass makes debounced safety transitions act on the first reading of an extreme value. Critical is
+// margin above solarCritical and HeatEscape margin below zero delta, in °C. Zero HeatEscape disables the bypass.
+type DebounceBypass struct {
+	Critical   float64 `yaml:"critical,omitempty"`
+	HeatEscape float64 `yaml:"heatEscape,omitempty"`
+}
+
+// Thermostat is a plain on/off differential thermostat with fixed flow. It takes over harvesting while flow valve
+// or core settings are unavailable. Circuit starts when collector is On degrees hotter than its inlet and stops
+// when the difference drops to Off or tank gets to TankMax. On of 0 disables it.
+type Thermostat struct {
+	On      float64 `yaml:"on,omitempty"`
+	Off     float64 `yaml:"off,omitempty"`
+	Flow    float64 `yaml:"flow,omitempty"`
+	TankMax float64 `yaml:"tankMax,omitempty"`
+}
+
+// Watchdog toggles watchdog output every Interval, 5 seconds by default, as long as the control loop passed within
+// Stall, 30 seconds by default. Hardware watchdog timeout has to be longer than Interval.
+type Watchdog struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Stall    time.Duration `yaml:"stall,omitempty"`
+}
+
+// GetInterval returns period of watchdog pulses.
+func (w Watchdog) GetInterval() time.Duration {
+	if w.Interval == 0 {
+		return 5 * time.Second
+	}
+	return w.Interval
+}
+
+// GetStall returns time since the last control loop pass after which watchdog is no longer pulsed.
+func (w Watchdog) GetStall() time.Duration {
+	if w.Stall == 0 {
+		return 30 * time.Second
+	}
+	return w.Stall
+}
+
+// Purge keeps circulating at DutyMin for Duration after a failsafe stops the circuit, which moves residual
+// collector heat out of exposed piping. Bypass switches the switching valve off during purge. Duration of 0 disables
+// it.
+type Purge struct {
+	Duration time.Duration `yaml:"duration,omitempty"`
+	Bypass   bool          `yaml:"bypass,omitempty"`
+}
+
+// Drainback enables high-speed fill phase on start and immediate flow de-energizing on stop.
+type Drainback struct {
+	Enabled      bool          `yaml:"enabled,omitempty"`
+	FillDuration time.Duration `yaml:"fillDuration,omitempty"`
+}
+
+// Feature flags gating optional subsystems, so they can ship disabled and be enabled per installation.
+const (
+	FeatureForecast      = "forecast"
+	FeatureNightCooldown = "nightCooldown"
+	FeatureDrainback     = "drainback"
+)
+
+// FeatureDefaults holds state of feature flags not listed in configuration.
+var FeatureDefaults = map[string]bool{
+	FeatureForecast:      true,
+	FeatureNightCooldown: true,
+	FeatureDrainback:     true,
+}
+
+// Feature sets state of a feature flag. Entity is an input_boolean which overrides Enabled while it can be read
+// from Home Assistant.
+type Feature struct {
+	Enabled bool   `yaml:"enabled"`
+	Entity  string `yaml:"entity,omitempty"`
+}
+
+// Transitions which can be debounced. Emergencies are always handled immediately.
+const (
+	TransitionStart         = "start"
+	TransitionCritical      = "critical"
+	TransitionReduced       = "reduced"
+	TransitionTankFull      = "tankFull"
+	TransitionHeatEscape    = "heatEscape"
+	TransitionFrost         = "frost"
+	TransitionNightCooldown = "nightCooldown"
+)
+
+// Actions which can be taken on a safety event.
+const (
+	ActionStop     = "stop"
+	ActionMinFlow  = "minFlow"
+	ActionMaxFlow  = "maxFlow"
+	ActionHeatDump = "heatDump"
+)
+
+// Safety events.
+const (
+	EventCritical   = "critical"
+	EventTankFull   = "tankFull"
+	EventHeatEscape = "heatEscape"
+)
+
+// Failsafe declares action per safety event. Events without action use ActionStop. Emergency inputs have fixed
+// actions and are not configurable.
+type Failsafe struct {
+	Critical   string `yaml:"critical,omitempty"`
+	TankFull   string `yaml:"tankFull,omitempty"`
+	HeatEscape string `yaml:"heatEscape,omitempty"`
+}
+
+// Action returns action configured for the event.
+func (f Failsafe) Action(event string) string {
+	var action string
+	switch event {
+	case EventCritical:
+		action = f.Critical
+	case EventTankFull:
+		action = f.TankFull
+	case EventHeatEscape:
+		action = f.HeatEscape
+	}
+	if action == "" {
+		return ActionStop
+	}
+	return action
+}
+
+func (f Failsafe) validate() error {
+	for _, event := range []string{EventCritical, EventTankFull, EventHeatEscape} {
+		switch f.Action(event) {
+		case ActionStop, ActionMinFlow, ActionMaxFlow, ActionHeatDump:
+		default:
+			return fmt.Errorf("unknown failsafe action %q for event %s", f.Action(event), event)
+		}
+	}
+	return nil
+}
+
+// Actions which can be taken by a rule.
+const (
+	RuleStop  = "stop"
+	RuleFlow  = "flow"
+	RuleEvent = "event"
+)
+
+// Rule takes an action while its condition holds. Condition is an expression over sensor and setting names,
+// "delta" and "running", e.g. "tankUp > 60 && solarUp < 80".
+type Rule struct {
+	Name string `yaml:"name"`
+	When string `yaml:"when"`
+	// Action is one of stop (keeps circuit stopped), flow (overrides calculated flow with Value) or event
+	// (fires Home Assistant event named solar_rule once the condition becomes true).
+	Action string  `yaml:"action"`
+	Value  float64 `yaml:"value,omitempty"`
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without name")
+	}
+	if _, err := expr.Parse(r.When); err != nil {
+		return fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+	switch r.Action {
+	case RuleStop, RuleFlow, RuleEvent:
+	default:
+		return fmt.Errorf("rule %s: unknown action %q", r.Name, r.Action)
+	}
+	return nil
+}
+
+// Report is published to Home Assistant sensor EntityID with the date as state and the summary as attributes.
+type Report struct {
+	EntityID string `yaml:"entity_id,omitempty"`
+}
+
+// Maintenance sets after how many pump run hours a maintenance-due flag is published to Home Assistant.
+type Maintenance struct {
+	Hours    float64 `yaml:"hours,omitempty"`
+	EntityID string  `yaml:"entity_id,omitempty"`
+	// Kick configures pump runs during long idle periods.
+	Kick PumpKick `yaml:"kick,omitempty"`
+	// ValveExercise configures full travel of valves during long idle periods.
+	ValveExercise ValveExercise `yaml:"valveExercise,omitempty"`
+	// AirDetection configures bleed-the-loop alert.
+	AirDetection AirDetection `yaml:"airDetection,omitempty"`
+	// ValveCheck configures stuck flow valve alert.
+	ValveCheck ValveCheck `yaml:"valveCheck,omitempty"`
+}
+
+// AirDetection recognizes air pockets in the loop of a running circuit. They make temperature delta oscillate, so
+// air is reported when delta reverses direction by at least Amplitude degrees Swings times within Window. When
+// measuredFlow setting is available, relative standard deviation of measured flow has to reach FlowVariation as
+// well. Result is published to Home Assistant binary sensor EntityID. Swings of 0 disables it.
+type AirDetection struct {
+	Swings        int           `yaml:"swings,omitempty"`
+	Amplitude     float64       `yaml:"amplitude,omitempty"`
+	Window        time.Duration `yaml:"window,omitempty"`
+	FlowVariation float64       `yaml:"flowVariation,omitempty"`
+	EntityID      string        `yaml:"entity_id,omitempty"`
+}
+
+// GetAmplitude returns minimal delta swing in degrees.
+func (a AirDetection) GetAmplitude() float64 {
+	if a.Amplitude == 0 {
+		return 2
+	}
+	return a.Amplitude
+}
+
+// GetWindow returns period in which swings are counted.
+func (a AirDetection) GetWindow() time.Duration {
+	if a.Window == 0 {
+		return 10 * time.Minute
+	}
+	return a.Window
+}
+
+// GetFlowVariation returns minimal relative standard deviation of measured flow.
+func (a AirDetection) GetFlowVariation() float64 {
+	if a.FlowVariation == 0 {
+		return 0.15
+	}
+	return a.FlowVariation
+}
+
+// ValveCheck verifies that flow valve follows commanded flow. Raising flow duty by at least Step has to lower
+// collector delta by MinDrop degrees within Response. Valve is reported stuck after Misses consecutive raises without
+// the drop, to Home Assistant binary sensor EntityID as well. Step of 0 disables it.
+type ValveCheck struct {
+	Step     float64       `yaml:"step,omitempty"`
+	Response time.Duration `yaml:"response,omitempty"`
+	MinDrop  float64       `yaml:"minDrop,omitempty"`
+	Misses   int           `yaml:"misses,omitempty"`
+	EntityID string        `yaml:"entity_id,omitempty"`
+}
+
+// GetResponse returns time in which delta has to follow raised flow.
+func (v ValveCheck) GetResponse() time.Duration {
+	if v.Response == 0 {
+		return 3 * time.Minute
+	}
+	return v.Response
+}
+
+// GetMinDrop returns minimal drop of delta after raising flow.
+func (v ValveCheck) GetMinDrop() float64 {
+	if v.MinDrop == 0 {
+		return 0.5
+	}
+	return v.MinDrop
+}
+
+// GetMisses returns number of consecutive raises without response after which valve is reported stuck.
+func (v ValveCheck) GetMisses() int {
+	if v.Misses == 0 {
+		return 3
+	}
+	return v.Misses
+}
+
+// ValveExercise moves switching valve and flow actuator to both end positions once they were idle for Interval.
+// Each position is held for Travel, which defaults to 2 minutes to cover full travel of slow actuators. Interval of
+// 0 disables it.
+type ValveExercise struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Travel   time.Duration `yaml:"travel,omitempty"`
+}
+
+// GetTravel returns time each valve position is held.
+func (v ValveExercise) GetTravel() time.Duration {
+	if v.Travel == 0 {
+		return 2 * time.Minute
+	}
+	return v.Travel
+}
+
+// PumpKick runs the pump for Duration once it was idle for Interval, which keeps it from seizing. Interval defaults
+// to a week. Duration of 0 disables it.
+type PumpKick struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+// GetInterval returns idle time after which the pump is kicked.
+func (k PumpKick) GetInterval() time.Duration {
+	if k.Interval == 0 {
+		return 7 * 24 * time.Hour
+	}
+	return k.Interval
+}
+
+// EnvConfig is environment variable holding the whole configuration as JSON, e.g. injected from a Kubernetes
+// ConfigMap. Keys are the same as in YAML configuration file, which is not read when the variable is set.
+const EnvConfig = "SOLAR_CONFIG_JSON"
+
+// Path returns path of configuration file, which defaults to /config.yaml. It is empty when configuration is given
+// in SOLAR_CONFIG_JSON.
+func Path(cfgFile *string) string {
+	if os.Getenv(EnvConfig) != "" {
+		return ""
+	}
+	if cfgFile != nil && *cfgFile != "" {
+		return *cfgFile
+	}
+	return internalConfigFile
+}
+
+// Read returns raw configuration from SOLAR_CONFIG_JSON or from configuration file, along with its origin. Setting
+// both the variable and a file is ambiguous and rejected.
+func Read(cfgFile *string) ([]byte, string, error) {
+	if blob := os.Getenv(EnvConfig); blob != "" {
+		if cfgFile != nil && *cfgFile != "" {
+			return nil, "", fmt.Errorf("configuration given both in %s and in file %s", EnvConfig, *cfgFile)
+		}
+		if !json.Valid([]byte(blob)) {
+			return nil, "", fmt.Errorf("%s is not valid JSON", EnvConfig)
+		}
+		return []byte(blob), EnvConfig, nil
 	}
 
-	log.Printf("Reading configuration from %s", configFilePath)
+	path := Path(cfgFile)
+	if _, err := os.Stat(path); err != nil {
+		return nil, "", fmt.Errorf("config file %s does not exist", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("file reading error: %w", err)
+	}
+	return data, path, nil
+}
 
-	if _, err := os.Stat(configFilePath); err != nil {
-		log.Fatalf("Config file %s does not exist", configFilePath)
+func NewConfig(cfgFile *string) (*Config, error) {
+	data, origin, err := Read(cfgFile)
+	if err != nil {
+		return nil, err
 	}
 
-	data, err := ioutil.ReadFile(configFilePath)
+	log.Printf("Reading configuration from %s", origin)
+
+	config, err := Parse(data)
 	if err != nil {
-		return nil, fmt.Errorf("file reading error: %w", err)
+		return nil, err
 	}
 
+	log.Printf("Reading following config from config file: %#v", config)
+
+	return config, nil
+}
+
+// Parse decodes and validates configuration from YAML.
+func Parse(data []byte) (*Config, error) {
 	var config Config
 	if err := yaml.UnmarshalStrict(data, &config); err != nil {
 		return nil, fmt.Errorf("error: %w", err)
 	}
 
-	log.Printf("Reading following config from config file: %#v", config)
+	values, err := explicitSettings(data)
+	if err != nil {
+		return nil, fmt.Errorf("error: %w", err)
+	}
+	config.yamlSettings = values
+
+	switch config.Controller.System {
+	case "", SystemGlycol, SystemDrainback, SystemDirect:
+	default:
+		return nil, fmt.Errorf("invalid configuration: unknown system %q", config.Controller.System)
+	}
+
+	for profile, values := range config.Profiles {
+		for name := range values {
+			if !homeassistant.IsSetting(name) {
+				return nil, fmt.Errorf("invalid configuration: unknown setting %s in profile %s", name, profile)
+			}
+		}
+	}
+
+	if err := config.Controller.Failsafe.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	switch config.Controller.ExternalChange {
+	case "", ExternalChangeAlert, ExternalChangeReconcile:
+	default:
+		return nil, fmt.Errorf("invalid configuration: unknown external change reaction %q", config.Controller.ExternalChange)
+	}
+
+	switch config.Controller.EmergencyUnavailable {
+	case "", EmergencyFailSafe, EmergencyFailOpen:
+	default:
+		return nil, fmt.Errorf("invalid configuration: unknown emergency unavailable policy %q", config.Controller.EmergencyUnavailable)
+	}
+
+	if s := config.Controller.SoftStart; s.Flow < 0 || s.Flow > 100 || s.Ramp < 0 {
+		return nil, fmt.Errorf("invalid configuration: soft start flow must be within [0, 100] and ramp can't be negative")
+	}
+
+	if l := config.Controller.Location; l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return nil, fmt.Errorf("invalid configuration: location needs latitude within [-90, 90] and longitude within [-180, 180]")
+	}
+
+	if t := config.Controller.Tank; (t.SurplusEntity != "" || t.SurplusEnergyEntity != "") && (!config.Controller.Location.Set() || t.SurplusMargin < 0) {
+		return nil, fmt.Errorf("invalid configuration: surplus heat signal needs location and non-negative margin")
+	}
+
+	if a := config.Controller.Maintenance.AirDetection; a.Swings < 0 || a.Amplitude < 0 || a.Window < 0 || a.FlowVariation < 0 {
+		return nil, fmt.Errorf("invalid configuration: air detection parameters can't be negative")
+	}
+	if v := config.Controller.Maintenance.ValveCheck; v.Step < 0 || v.Step > 100 || v.Response < 0 || v.MinDrop < 0 || v.Misses < 0 {
+		return nil, fmt.Errorf("invalid configuration: valve check step must be within [0, 100] and other parameters can't be negative")
+	}
+
+	if config.Controller.ReducedDecay < 0 {
+		return nil, fmt.Errorf("invalid configuration: reducedDecay can't be negative")
+	}
+
+	if config.Controller.PipeDelay < 0 || config.Controller.StartGrace < 0 {
+		return nil, fmt.Errorf("invalid configuration: pipeDelay and startGrace can't be negative")
+	}
+
+	if t := config.Controller.TankSensorCheck; t.Delta < 0 || t.Window < 0 || t.MaxHarvest < 0 {
+		return nil, fmt.Errorf("invalid configuration: tank sensor check parameters can't be negative")
+	}
+
+	if r := config.Controller.PumpRest; r.MaxRun < 0 || r.Rest < 0 {
+		return nil, fmt.Errorf("invalid configuration: pump rest durations can't be negative")
+	}
+
+	if config.Controller.Purge.Duration < 0 {
+		return nil, fmt.Errorf("invalid configuration: purge duration can't be negative")
+	}
+
+	if err := config.Controller.TankMaxSchedule.Validate(SettingBounds["tankMax"]); err != nil {
+		return nil, fmt.Errorf("invalid configuration: tankMaxSchedule: %w", err)
+	}
+
+	if t := config.Controller.Tank; t.ShowerEntity != "" && (t.ShowerTemperature <= 0 || t.Volume <= 0) {
+		return nil, fmt.Errorf("invalid configuration: shower readiness needs showerTemperature and tank volume")
+	}
+
+	if h := config.Controller.BackupHeater; h.EntityID != "" && (h.DemandTemperature <= 0 || config.Settings.ElectricityPrice.EntityID == "") {
+		return nil, fmt.Errorf("invalid configuration: backup heater interlock needs demandTemperature and electricityPrice setting")
+	}
+
+	if w := config.Controller.WarmUp; w.Enabled && (!config.Controller.Location.Set() || w.Lead < 0) {
+		return nil, fmt.Errorf("invalid configuration: warm up needs location and non-negative lead")
+	}
+
+	if k := config.Controller.Maintenance.Kick; k.Interval < 0 || k.Duration < 0 || k.Duration > time.Minute {
+		return nil, fmt.Errorf("invalid configuration: pump kick interval can't be negative and duration must be within [0, 1m]")
+	}
+
+	if v := config.Controller.Maintenance.ValveExercise; v.Interval < 0 || v.Travel < 0 {
+		return nil, fmt.Errorf("invalid configuration: valve exercise interval and travel can't be negative")
+	}
+
+	for transition, n := range config.Controller.Debounce {
+		switch transition {
+		case TransitionStart, TransitionCritical, TransitionReduced, TransitionTankFull, TransitionHeatEscape, TransitionFrost, TransitionNightCooldown:
+		default:
+			return nil, fmt.Errorf("invalid configuration: unknown transition %q in debounce", transition)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid configuration: debounce of %s can't be negative", transition)
+		}
+	}
+	if b := config.Controller.DebounceBypass; b.Critical < 0 || b.HeatEscape < 0 {
+		return nil, fmt.Errorf("invalid configuration: debounce bypass margins can't be negative")
+	}
+	// Critical temperature can't wait for confirmation without a limit.
+	if config.Controller.Debounce[TransitionCritical] > 1 && config.Controller.DebounceBypass.Critical <= 0 {
+		return nil, fmt.Errorf("invalid configuration: debounce of critical needs debounceBypass.critical margin")
+	}
+
+	if t := config.Controller.Thermostat; t.On > 0 && (t.Off < 0 || t.Off >= t.On || t.Flow < 0 || t.Flow > 100 || t.TankMax <= 0) {
+		return nil, fmt.Errorf("invalid configuration: thermostat needs 0 ≤ off < on, flow within [0, 100] and tankMax")
+	}
+
+	if w := config.Controller.Watchdog; w.Interval < 0 || w.Stall < 0 || w.GetStall() <= w.GetInterval() {
+		return nil, fmt.Errorf("invalid configuration: watchdog interval and stall can't be negative and stall must be longer than interval")
+	}
+
+	for name := range config.Controller.Lockout {
+		if !evok.IsActuator(name) {
+			return nil, fmt.Errorf("invalid configuration: unknown actuator %s in lockout", name)
+		}
+	}
+
+	for name := range config.Controller.Features {
+		if _, ok := FeatureDefaults[name]; !ok {
+			return nil, fmt.Errorf("invalid configuration: unknown feature %s", name)
+		}
+	}
+
+	switch config.Controller.AntiScald.Action {
+	case "", AntiScaldAlert, AntiScaldCutCharge:
+	default:
+		return nil, fmt.Errorf("invalid configuration: unknown anti-scald action %q", config.Controller.AntiScald.Action)
+	}
+	if err := config.Sensors.ValidateConversions(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if config.Controller.AntiScald.Threshold > 0 && config.Sensors.DHWOutlet.Dev == "" {
+		return nil, fmt.Errorf("invalid configuration: anti-scald requires dhwOutlet sensor")
+	}
+
+	if s := config.Controller.Stagnation; s.Threshold < 0 || s.Threshold > 1 || s.PrecoolMargin < 0 {
+		return nil, fmt.Errorf("invalid configuration: stagnation threshold must be within [0, 1] and precool margin can't be negative")
+	}
+
+	if err := config.Notifications.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := config.validateComputed(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	for _, rule := range config.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
 
 	return &config, nil
 }
@@ -57,3 +944,7 @@ func (c *Config) GetActuatorsConfig() *evok.Actuators {
 func (c *Config) GetSettingsConfig() *homeassistant.Settings {
 	return &c.Settings
 }
+
+func (c *Config) GetControllerConfig() *Controller {
+	return &c.Controller
+}
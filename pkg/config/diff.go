@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Difference describes a single configuration value which differs between two configurations. Missing values are
+// represented by an empty string.
+type Difference struct {
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Diff returns differences between old and new configuration, sorted by path.
+func Diff(old, new *Config) ([]Difference, error) {
+	oldValues, err := flatten(old)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := flatten(new)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []Difference
+	for path, value := range oldValues {
+		if newValues[path] != value {
+			diff = append(diff, Difference{Path: path, Old: value, New: newValues[path]})
+		}
+	}
+	for path, value := range newValues {
+		if _, ok := oldValues[path]; !ok {
+			diff = append(diff, Difference{Path: path, New: value})
+		}
+	}
+
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Path < diff[j].Path })
+	return diff, nil
+}
+
+// flatten converts configuration to a map of dot separated paths and values.
+func flatten(c *Config) (map[string]string, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode configuration: %w", err)
+	}
+
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("could not decode configuration: %w", err)
+	}
+
+	values := make(map[string]string)
+	flattenInto(values, "", tree)
+	return values, nil
+}
+
+func flattenInto(values map[string]string, prefix string, node interface{}) {
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range n {
+			path := fmt.Sprint(key)
+			if prefix != "" {
+				path = prefix + "." + path
+			}
+			flattenInto(values, path, value)
+		}
+	case []interface{}:
+		for i, value := range n {
+			flattenInto(values, fmt.Sprintf("%s[%d]", prefix, i), value)
+		}
+	default:
+		values[prefix] = fmt.Sprint(n)
+	}
+}
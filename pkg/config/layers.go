@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/automatedhome/solar/pkg/homeassistant"
+)
+
+// Sources of setting values in increasing order of precedence. Values received from Home Assistant and those of
+// active profile are applied by Home Assistant client on top of them.
+const (
+	SourceDefault = "default"
+	SourceYAML    = "yaml"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// SettingEnvPrefix starts names of environment variables setting values, e.g. SOLAR_SETTING_FLOW_DUTYMIN.
+const SettingEnvPrefix = "SOLAR_SETTING_"
+
+// Layer holds setting values coming from a single source.
+type Layer struct {
+	Source string
+	Values map[string]float64
+}
+
+// Effective is a setting value together with the source it came from and values provided by every layer.
+type Effective struct {
+	Value  float64            `json:"value"`
+	Source string             `json:"source"`
+	Layers map[string]float64 `json:"layers"`
+}
+
+// settingDefaults are conservative values of core settings, so the controller can protect the installation even
+// if Home Assistant was never reachable. Other settings default to zero, which disables optional features.
+var settingDefaults = map[string]float64{
+	"solarCritical": 120,
+	"solarOn":       7,
+	"solarOff":      3,
+	"tankMax":       60,
+	"flow.dutyMin":  20,
+	"flow.dutyMax":  100,
+	"flow.tempMin":  5,
+	"flow.tempMax":  20,
+}
+
+// DefaultLayer holds built-in values of all settings.
+func DefaultLayer() Layer {
+	values := make(map[string]float64)
+	for _, name := range homeassistant.SettingNames() {
+		values[name] = settingDefaults[name]
+	}
+	return Layer{Source: SourceDefault, Values: values}
+}
+
+// YAMLLayer holds setting values given explicitly in settings section of configuration file.
+func (c *Config) YAMLLayer() Layer {
+	return Layer{Source: SourceYAML, Values: c.yamlSettings}
+}
+
+// EnvLayer parses setting values from environment variables in "key=value" form. Variable name is setting name
+// upper-cased with dots replaced by underscores and SettingEnvPrefix prepended.
+func EnvLayer(environ []string) (Layer, error) {
+	names := make(map[string]string)
+	for _, name := range homeassistant.SettingNames() {
+		names[strings.ToUpper(strings.Replace(name, ".", "_", -1))] = name
+	}
+
+	values := make(map[string]float64)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, SettingEnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, SettingEnvPrefix), "=", 2)
+		name, ok := names[parts[0]]
+		if !ok || len(parts) != 2 {
+			return Layer{}, fmt.Errorf("unknown setting in environment variable %s%s", SettingEnvPrefix, parts[0])
+		}
+		v, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return Layer{}, fmt.Errorf("invalid value of %s%s: %w", SettingEnvPrefix, parts[0], err)
+		}
+		values[name] = v
+	}
+	return Layer{Source: SourceEnv, Values: values}, nil
+}
+
+// Merge combines layers ordered by increasing precedence. Later layers replace values of earlier ones. Resulting
+// value is clamped to SettingBounds, values of layers are kept as given.
+func Merge(layers ...Layer) map[string]Effective {
+	merged := make(map[string]Effective)
+	for _, layer := range layers {
+		for name, v := range layer.Values {
+			e := merged[name]
+			if e.Layers == nil {
+				e.Layers = make(map[string]float64)
+			}
+			e.Value, e.Source = v, layer.Source
+			e.Layers[layer.Source] = v
+			merged[name] = e
+		}
+	}
+	for name, e := range merged {
+		if b, ok := SettingBounds[name]; ok {
+			e.Value = b.Clamp(e.Value)
+			merged[name] = e
+		}
+	}
+	return merged
+}
+
+// explicitSettings returns setting values present in settings section of YAML document. Unlike decoded
+// configuration, it tells settings set to zero apart from those not set at all.
+func explicitSettings(data []byte) (map[string]float64, error) {
+	var doc struct {
+		Settings map[string]interface{} `yaml:"settings"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64)
+	var walk func(prefix string, tree map[string]interface{})
+	walk = func(prefix string, tree map[string]interface{}) {
+		for key, v := range tree {
+			name := prefix + key
+			node, ok := toStringMap(v)
+			if !ok {
+				continue
+			}
+			if homeassistant.IsSetting(name) {
+				if value, ok := node["value"]; ok {
+					if f, ok := toFloat(value); ok {
+						values[name] = f
+					}
+				}
+				continue
+			}
+			walk(name+".", node)
+		}
+	}
+	walk("", doc.Settings)
+	return values, nil
+}
+
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[fmt.Sprint(k)] = v
+	}
+	return out, true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
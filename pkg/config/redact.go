@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "**REDACTED**"
+
+// sensitiveKeys are configuration keys whose values are replaced by Redacted. Location reveals where the
+// installation is.
+var sensitiveKeys = []string{"latitude", "longitude", "token", "password", "secret", "passphrase"}
+
+// Redacted returns configuration in YAML with sensitive values replaced, so it can be attached to bug reports.
+func Redacted(c *Config) ([]byte, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode configuration: %w", err)
+	}
+
+	var tree yaml.MapSlice
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("could not decode configuration: %w", err)
+	}
+
+	data, err = yaml.Marshal(redact(tree))
+	if err != nil {
+		return nil, fmt.Errorf("could not encode configuration: %w", err)
+	}
+	return data, nil
+}
+
+func redact(node interface{}) interface{} {
+	switch n := node.(type) {
+	case yaml.MapSlice:
+		for i, item := range n {
+			if sensitive(fmt.Sprint(item.Key)) {
+				n[i].Value = redacted
+				continue
+			}
+			n[i].Value = redact(item.Value)
+		}
+	case []interface{}:
+		for i, item := range n {
+			n[i] = redact(item)
+		}
+	}
+	return node
+}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Package errs defines error categories shared by controller clients. Every categorized error is counted in
+// solar_errors_total metric labeled with component and kind.
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Kind is an error category.
+type Kind string
+
+const (
+	// Transport errors happen when a remote service can't be reached or its response can't be read.
+	Transport Kind = "transport"
+	// Parse errors happen when a response can't be decoded.
+	Parse Kind = "parse"
+	// Validation errors happen when data is well formed but unusable, e.g. non-numeric entity state.
+	Validation Kind = "validation"
+	// Actuator errors happen when a command to an actuator fails.
+	Actuator Kind = "actuator"
+)
+
+var errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "solar",
+	Name:      "errors_total",
+	Help:      "Total number of errors by component and kind",
+}, []string{"component", "kind"})
+
+var errorResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "solar",
+	Name:      "error_responses_total",
+	Help:      "Total number of non-2xx responses by component and status code",
+}, []string{"component", "code"})
+
+// Error is an error annotated with component which produced it and its category.
+type Error struct {
+	Component string
+	Kind      Kind
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New categorizes err and records it in metrics.
+func New(component string, kind Kind, err error) error {
+	errorsTotal.WithLabelValues(component, string(kind)).Inc()
+	if code := StatusCodeOf(err); code != 0 {
+		errorResponsesTotal.WithLabelValues(component, strconv.Itoa(code)).Inc()
+	}
+	return &Error{Component: component, Kind: kind, Err: err}
+}
+
+// KindOf returns category of err or an empty string when err is not categorized.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ""
+}
+
+// maxBodyLength limits response body kept in StatusError.
+const maxBodyLength = 256
+
+// StatusError is returned when a remote service responds with non-2xx status code.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+// CheckResponse returns StatusError for non-2xx responses. Response body is consumed in that case.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodyLength))
+	return &StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+// StatusCodeOf returns HTTP status code carried by err or 0 when there is none.
+func StatusCodeOf(err error) int {
+	var e *StatusError
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package evok
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Command sets an actuator circuit to Value.
+type Command struct {
+	Dev     string
+	Circuit string
+	Value   float64
+}
+
+// BatchError aggregates errors of commands issued together by SetValues.
+type BatchError struct {
+	// Errors of failed commands, each one wraps error returned by SetValue.
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Ignoring drops failures matching target from err, e.g. locked out actuators, so other failures are still seen. It
+// returns nil when nothing else failed.
+func Ignoring(err, target error) error {
+	var batch *BatchError
+	if !errors.As(err, &batch) {
+		if errors.Is(err, target) {
+			return nil
+		}
+		return err
+	}
+
+	var remaining []error
+	for _, err := range batch.Errors {
+		if !errors.Is(err, target) {
+			remaining = append(remaining, err)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	return &BatchError{Errors: remaining}
+}
+
+// SetValues issues commands concurrently, so actuators switch together without waiting for each other's round trip.
+// Every command is attempted. Returned error is a *BatchError listing the commands which failed.
+func (c *Client) SetValues(commands []Command) error {
+	errs := make([]error, len(commands))
+	var wg sync.WaitGroup
+	for i, cmd := range commands {
+		wg.Add(1)
+		go func(i int, cmd Command) {
+			defer wg.Done()
+			if err := c.SetValue(cmd.Dev, cmd.Circuit, cmd.Value); err != nil {
+				errs[i] = fmt.Errorf("%s/%s: %w", cmd.Dev, cmd.Circuit, err)
+			}
+		}(i, cmd)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &BatchError{Errors: failed}
+}
+
+func (c *Client) setApplied(name string, value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.applied == nil {
+		c.applied = make(map[string]float64)
+	}
+	c.applied[name] = value
+	if value == 0 && c.lockoutPending[name] {
+		delete(c.lockoutPending, name)
+		c.lockOut(name)
+	}
+}
+
+// Pending returns commands whose value was not acknowledged by EVOK yet, so a sequence interrupted by an error can be
+// repeated without commanding actuators which already switched. Actuator changed outside of the controller is always
+// commanded again.
+func (c *Client) Pending(commands []Command) []Command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pending []Command
+	for _, cmd := range commands {
+		applied, ok := c.applied[c.Actuators.nameOf(cmd.Dev, cmd.Circuit)]
+		if !ok || math.Abs(applied-cmd.Value) >= analogTolerance {
+			pending = append(pending, cmd)
+		}
+	}
+	return pending
+}
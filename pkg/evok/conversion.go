@@ -0,0 +1,166 @@
+package evok
+
+import (
+	"fmt"
+	"math"
+)
+
+// Conversion types of analog transmitters.
+const (
+	// ConversionLinear maps InMin-InMax range of raw reading onto OutMin-OutMax temperature range.
+	ConversionLinear = "linear"
+	// ConversionVoltage is a voltage transmitter, 0-10V unless InMin and InMax are set.
+	ConversionVoltage = "voltage"
+	// ConversionCurrent is a 4-20mA transmitter. Raw reading is voltage across Shunt resistor in ohms, or current in
+	// mA when Shunt is not set.
+	ConversionCurrent = "current"
+	// ConversionPT1000 is a PT1000 sensor on resistance input. Raw reading is resistance in ohms.
+	ConversionPT1000 = "pt1000"
+)
+
+// Callendar-Van Dusen coefficients of IEC 60751 platinum sensors.
+const (
+	pt1000R0 = 1000.0
+	ptA      = 3.9083e-3
+	ptB      = -5.775e-7
+)
+
+// Physical range of IEC 60751 platinum sensors. Readings outside of it come from an open or shorted sensor.
+const (
+	ptMinTemperature = -200.0
+	ptMaxTemperature = 850.0
+)
+
+// Loop current of a 4-20mA transmitter outside of this range signals a broken loop or transmitter failure (NAMUR NE 43).
+const (
+	loopMinCurrent = 3.6
+	loopMaxCurrent = 21.0
+)
+
+// Conversion maps a raw analog input reading onto temperature. Type selects transmitter profile, linear is used when
+// it is empty. OutMin and OutMax is the temperature range of linear, voltage and current transmitters.
+type Conversion struct {
+	Type   string  `yaml:"type,omitempty"`
+	InMin  float64 `yaml:"inMin"`
+	InMax  float64 `yaml:"inMax"`
+	OutMin float64 `yaml:"outMin"`
+	OutMax float64 `yaml:"outMax"`
+	Shunt  float64 `yaml:"shunt,omitempty"`
+}
+
+// defaultConversion is used for analog inputs without explicit conversion: 0-12V transmitter with 0-200°C range.
+var defaultConversion = Conversion{InMin: 0, InMax: 12, OutMin: 0, OutMax: 200}
+
+// Validate checks that conversion can produce a temperature.
+func (c Conversion) Validate() error {
+	switch c.Type {
+	case "", ConversionLinear:
+		if c.InMin == c.InMax {
+			return fmt.Errorf("linear conversion needs inMin different from inMax")
+		}
+	case ConversionVoltage:
+		if c.InMin == c.InMax && c.InMin != 0 {
+			return fmt.Errorf("voltage conversion needs inMin different from inMax")
+		}
+	case ConversionCurrent:
+		if c.Shunt < 0 {
+			return fmt.Errorf("current conversion shunt can't be negative")
+		}
+	case ConversionPT1000:
+		return nil
+	default:
+		return fmt.Errorf("unknown conversion type %q", c.Type)
+	}
+	if c.OutMin == c.OutMax {
+		return fmt.Errorf("%s conversion needs outMin different from outMax", c.kind())
+	}
+	return nil
+}
+
+func (c Conversion) kind() string {
+	if c.Type == "" {
+		return ConversionLinear
+	}
+	return c.Type
+}
+
+func (c Conversion) apply(raw float64) (float64, error) {
+	switch c.Type {
+	case ConversionVoltage:
+		if c.InMin == 0 && c.InMax == 0 {
+			c.InMax = 10
+		}
+		return c.linear(raw), nil
+	case ConversionCurrent:
+		current := raw
+		if c.Shunt > 0 {
+			current = raw / c.Shunt * 1000
+		}
+		if current < loopMinCurrent || current > loopMaxCurrent {
+			return 0, fmt.Errorf("loop current %.2f mA outside of [%.1f, %.1f] mA", current, loopMinCurrent, loopMaxCurrent)
+		}
+		c.InMin, c.InMax = 4, 20
+		return c.linear(current), nil
+	case ConversionPT1000:
+		t := platinum(raw, pt1000R0)
+		if math.IsNaN(t) || t < ptMinTemperature || t > ptMaxTemperature {
+			return 0, fmt.Errorf("resistance %.1f Ω outside of PT1000 range", raw)
+		}
+		return t, nil
+	default:
+		return c.linear(raw), nil
+	}
+}
+
+func (c Conversion) linear(raw float64) float64 {
+	return (raw-c.InMin)*(c.OutMax-c.OutMin)/(c.InMax-c.InMin) + c.OutMin
+}
+
+// platinum returns temperature of a platinum sensor with r0 resistance at 0°C. Callendar-Van Dusen equation is
+// solved without the C coefficient, which adds less than 0.1°C of error down to -40°C. Resistance above about 7.6 r0
+// has no solution and gives NaN.
+func platinum(resistance, r0 float64) float64 {
+	return (-ptA + math.Sqrt(ptA*ptA-4*ptB*(1-resistance/r0))) / (2 * ptB)
+}
+
+// analog reports if device is an analog input which needs conversion to temperature.
+func (d *Device) analog() bool {
+	return d.Dev == "ai"
+}
+
+// convert returns temperature for a raw reading of the device. 1-wire temperature sensors report temperature
+// directly, analog inputs use configured conversion. Readings which don't map onto a valid temperature, like NaN or
+// those of a broken sensor, are errors.
+func (d *Device) convert(raw float64) (float64, error) {
+	if math.IsNaN(raw) || math.IsInf(raw, 0) {
+		return 0, fmt.Errorf("invalid reading %v", raw)
+	}
+	if !d.analog() {
+		return raw, nil
+	}
+	conversion := defaultConversion
+	if d.Conversion != nil {
+		conversion = *d.Conversion
+	}
+	value, err := conversion.apply(raw)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("reading %v converts to invalid temperature %v", raw, value)
+	}
+	return value, nil
+}
+
+// ValidateConversions checks conversions of all sensors.
+func (s *Sensors) ValidateConversions() error {
+	for name, d := range s.byName() {
+		if d.Conversion == nil {
+			continue
+		}
+		if err := d.Conversion.Validate(); err != nil {
+			return fmt.Errorf("sensor %s: %w", name, err)
+		}
+	}
+	return nil
+}
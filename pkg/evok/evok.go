@@ -4,35 +4,172 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/errs"
+	"github.com/automatedhome/solar/pkg/fault"
+	"github.com/automatedhome/solar/pkg/logging"
 )
 
+const component = "evok"
+
+// requestTimeout bounds every REST request to EVOK, so a hanging call can't block the control loop.
+const requestTimeout = 10 * time.Second
+
 type Device struct {
 	Value   float64 `json:"value,omitempty" yaml:"value,omitempty"`
 	Circuit string  `json:"circuit" yaml:"circuit"`
 	Dev     string  `json:"dev" yaml:"dev"`
+	// Conversion of raw analog input to temperature. Applies only to sensors with "ai" dev.
+	Conversion *Conversion `json:"-" yaml:"conversion,omitempty"`
+
+	// Metadata of the last sensor reading, exposed on /sensors.
+	Raw     float64 `json:"raw,omitempty" yaml:"-"`
+	Unit    string  `json:"unit,omitempty" yaml:"-"`
+	Updated int64   `json:"updated,omitempty" yaml:"-"`
+	Source  string  `json:"source,omitempty" yaml:"-"`
+	// Fault describes why the last reading was rejected. Value keeps the last valid reading meanwhile.
+	Fault string `json:"fault,omitempty" yaml:"-"`
 }
 
+// Sources of sensor readings.
+const (
+	SourceWebsocket  = "websocket"
+	SourceREST       = "rest"
+	SourceSimulation = "simulation"
+)
+
+// temperatureUnit is the unit of all sensor values, analog inputs are converted to temperature.
+const temperatureUnit = "°C"
+
 type Sensors struct {
 	SolarUp  Device `yaml:"solarUp"`
 	SolarIn  Device `yaml:"solarIn"`
 	SolarOut Device `yaml:"solarOut"`
 	TankUp   Device `yaml:"tankUp"`
+	// Optional tank sensors improving tank heat content estimation.
+	TankMiddle Device `yaml:"tankMiddle,omitempty"`
+	TankBottom Device `yaml:"tankBottom,omitempty"`
+	// DHWOutlet is an optional domestic hot water temperature sensor after the thermostatic mixing valve.
+	DHWOutlet Device `yaml:"dhwOutlet,omitempty"`
+}
+
+// byName returns sensors keyed by their configuration name.
+func (s *Sensors) byName() map[string]*Device {
+	return map[string]*Device{
+		"solarUp":  &s.SolarUp,
+		"solarIn":  &s.SolarIn,
+		"solarOut": &s.SolarOut,
+		"tankUp":   &s.TankUp,
+
+		"tankMiddle": &s.TankMiddle,
+		"tankBottom": &s.TankBottom,
+		"dhwOutlet":  &s.DHWOutlet,
+	}
+}
+
+// Values returns readings of configured sensors keyed by their configuration name.
+func (s *Sensors) Values() map[string]float64 {
+	values := make(map[string]float64)
+	for name, d := range s.byName() {
+		if d.Dev != "" {
+			values[name] = d.Value
+		}
+	}
+	return values
+}
+
+// Faults returns configured sensors whose last reading was rejected, with the reason.
+func (s *Sensors) Faults() map[string]string {
+	faults := make(map[string]string)
+	for name, d := range s.byName() {
+		if d.Dev != "" && d.Fault != "" {
+			faults[name] = d.Fault
+		}
+	}
+	return faults
+}
+
+// Tank returns all configured tank sensors.
+func (s *Sensors) Tank() []*Device {
+	var tank []*Device
+	for _, d := range []*Device{&s.TankUp, &s.TankMiddle, &s.TankBottom} {
+		if d.Dev != "" {
+			tank = append(tank, d)
+		}
+	}
+	return tank
 }
 
 type Actuators struct {
 	Pump   Device `yaml:"pump"`
 	Switch Device `yaml:"switch"`
 	Flow   Device `yaml:"flow"`
+	// HeatDump is an optional output diverting heat to a dump radiator.
+	HeatDump Device `yaml:"heatDump,omitempty"`
+	// StatusLED and Buzzer are optional digital outputs of a boiler-room panel.
+	StatusLED Device `yaml:"statusLed,omitempty"`
+	Buzzer    Device `yaml:"buzzer,omitempty"`
+	// Watchdog is an optional output pulsed while the controller works. Watchdog relay wired into pump supply
+	// de-energizes the pump once pulses stop.
+	Watchdog Device `yaml:"watchdog,omitempty"`
+}
+
+// byName returns actuators keyed by their configuration name.
+func (a *Actuators) byName() map[string]*Device {
+	return map[string]*Device{
+		"pump":      &a.Pump,
+		"switch":    &a.Switch,
+		"flow":      &a.Flow,
+		"heatDump":  &a.HeatDump,
+		"statusLed": &a.StatusLED,
+		"buzzer":    &a.Buzzer,
+		"watchdog":  &a.Watchdog,
+	}
+}
+
+// nameOf returns configuration name of an actuator or "dev/circuit" for unknown ones.
+func (a *Actuators) nameOf(dev, circuit string) string {
+	for name, d := range a.byName() {
+		if d.Dev == dev && d.Circuit == circuit {
+			return name
+		}
+	}
+	return dev + "/" + circuit
 }
 
+var sensorTemperature = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "solar",
+	Name:      "sensor_temperature_celsius",
+	Help:      "Sensor readings exported as soon as EVOK reports them",
+}, []string{"sensor"})
+
+var sensorFault = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "solar",
+	Name:      "sensor_fault",
+	Help:      "Set while the last sensor reading was rejected as invalid, like an open or shorted analog sensor",
+}, []string{"sensor"})
+
+var commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "solar",
+	Name:      "evok_command_duration_seconds",
+	Help:      "Round-trip time of actuator commands sent to EVOK",
+	Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+}, []string{"actuator"})
+
 type Client struct {
 	Sensors     Sensors
 	Actuators   Actuators
@@ -40,8 +177,30 @@ type Client struct {
 	httpAddress string
 	httpClient  *http.Client
 	wsConn      net.Conn
+	inhibited   int32
+	closed      int32
+	done        chan struct{}
+	lastMessage int64
+	sim         *simulator
+	// commanded holds last value sent to each actuator, used to detect changes made outside of the controller.
+	mu        sync.Mutex
+	commanded map[string]float64
+	// applied holds last value EVOK acknowledged for each actuator, used to skip commands already in effect.
+	applied         map[string]float64
+	externalChanges chan ExternalChange
+	updateHook      func()
+	panicHook       func(recovered interface{})
+	// lockedOut holds actuators locked out for maintenance.
+	lockedOut map[string]bool
+	// lockoutPending holds actuators whose lockout waits until they are switched off.
+	lockoutPending map[string]bool
+	// stream relays received websocket messages to API subscribers.
+	stream updateStream
 }
 
+// ErrInhibited is returned by SetValue while actuator commands are inhibited.
+var ErrInhibited = errors.New("actuator commands are inhibited")
+
 type evokValue struct {
 	Value interface{} `json:"value"`
 }
@@ -53,7 +212,11 @@ func NewClient(address string, sensors Sensors, actuators Actuators) *Client {
 		wsAddress:   fmt.Sprintf("ws://%s/ws", address),
 		wsConn:      nil,
 		httpAddress: fmt.Sprintf("http://%s", address),
-		httpClient:  &http.Client{},
+		httpClient:  &http.Client{Timeout: requestTimeout},
+
+		done:            make(chan struct{}),
+		commanded:       make(map[string]float64),
+		externalChanges: make(chan ExternalChange, externalChangesSize),
 	}
 }
 
@@ -79,140 +242,406 @@ func (c *Client) ExposeSensorsOnHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (c *Client) HandleWebsocketConnection() {
+// HandleWebsocketConnection receives sensor and actuator updates from EVOK. It returns nil when client is closed
+// and an error when connection fails, so the caller can reconnect. In simulation mode it only waits for the client
+// to be closed.
+func (c *Client) HandleWebsocketConnection() error {
+	if c.sim != nil {
+		log.Println("Simulation mode, not connecting to EVOK")
+		<-c.done
+		return nil
+	}
+
 	log.Printf("Connecting to EVOK at %s\n", c.wsAddress)
 
-	err := c.establishWebsocketConnection()
+	conn, _, _, err := ws.DefaultDialer.Dial(context.TODO(), c.wsAddress)
 	if err != nil {
-		log.Fatalf("Connecting to EVOK failed: %v", err)
+		return errs.New(component, errs.Transport, fmt.Errorf("connecting to EVOK failed: %w", err))
 	}
-	defer c.wsConn.Close()
-
-	c.sendWebsocketFilterMessage()
+	defer conn.Close()
 
-	c.processWebsocketMessages()
-}
+	c.mu.Lock()
+	c.wsConn = conn
+	c.mu.Unlock()
+	if c.isClosed() {
+		return nil
+	}
 
-func (c *Client) establishWebsocketConnection() error {
-	conn, _, _, err := ws.DefaultDialer.Dial(context.TODO(), c.wsAddress)
-	if err != nil {
+	if err := c.sendWebsocketFilterMessage(); err != nil {
 		return err
 	}
 
-	c.wsConn = conn
+	return c.processWebsocketMessages()
+}
+
+// sendWebsocketFilterMessage subscribes to updates of all configured sensor and actuator device types.
+func (c *Client) sendWebsocketFilterMessage() error {
+	seen := make(map[string]bool)
+	devices := []string{}
+	for _, d := range c.Sensors.byName() {
+		if d.Dev != "" && !seen[d.Dev] {
+			seen[d.Dev] = true
+			devices = append(devices, d.Dev)
+		}
+	}
+	for _, d := range c.Actuators.byName() {
+		if d.Dev != "" && !seen[d.Dev] {
+			seen[d.Dev] = true
+			devices = append(devices, d.Dev)
+		}
+	}
 
+	msg, _ := json.Marshal(map[string]interface{}{"cmd": "filter", "devices": devices})
+	if err := wsutil.WriteClientMessage(c.wsConn, ws.OpText, msg); err != nil {
+		return errs.New(component, errs.Transport, fmt.Errorf("sending websocket message to EVOK failed: %w", err))
+	}
 	return nil
 }
 
-func (c *Client) sendWebsocketFilterMessage() {
-	msg := "{\"cmd\":\"filter\", \"devices\":[\"ai\",\"temp\"]}"
-	if err := wsutil.WriteClientMessage(c.wsConn, ws.OpText, []byte(msg)); err != nil {
-		panic("Sending websocket message to EVOK failed: " + err.Error())
+// Close stops websocket processing. Client is not usable for receiving sensor updates afterwards.
+func (c *Client) Close() {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	close(c.done)
+	c.ResetConnection()
+}
+
+func (c *Client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// ResetConnection drops websocket connection, which makes HandleWebsocketConnection return.
+func (c *Client) ResetConnection() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wsConn != nil {
+		c.wsConn.Close()
 	}
 }
 
-func (c *Client) processWebsocketMessages() {
-	var inputs []Device
+// LastMessage returns time of the last message received over websocket.
+func (c *Client) LastMessage() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastMessage))
+}
+
+// wsQueueSize is the number of received websocket messages waiting for processing. When the queue is full, the
+// oldest message is dropped, so reading never stalls and EVOK doesn't disconnect us as a slow consumer.
+const wsQueueSize = 64
+
+var wsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "solar",
+	Name:      "evok_websocket_messages_dropped_total",
+	Help:      "Total number of websocket messages dropped because processing could not keep up",
+})
+
+func (c *Client) processWebsocketMessages() error {
+	queue := make(chan []byte, wsQueueSize)
+	defer close(queue)
+	go c.handleWebsocketMessages(queue)
+
 	for {
 		payload, err := wsutil.ReadServerText(c.wsConn)
+		if c.isClosed() {
+			log.Printf("Websocket connection to %s closed", c.wsAddress)
+			return nil
+		}
 		if err != nil {
-			log.Printf("Received incorrect data: %#v", err)
+			return errs.New(component, errs.Transport, fmt.Errorf("websocket connection to EVOK failed: %w", err))
+		}
+		atomic.StoreInt64(&c.lastMessage, time.Now().UnixNano())
+
+		select {
+		case queue <- payload:
+		default:
+			// Drop the oldest message, newer readings supersede it anyway. This is the only sender, so there is
+			// room for the payload afterwards.
+			select {
+			case <-queue:
+				wsDroppedTotal.Inc()
+			default:
+			}
+			queue <- payload
+		}
+	}
+}
+
+// handleWebsocketMessages parses queued messages and updates sensors until queue is closed.
+func (c *Client) handleWebsocketMessages(queue <-chan []byte) {
+	defer c.recoverPanic()
+	var inputs []Device
+	for payload := range queue {
+		if fault.DropMessage() {
 			continue
 		}
 
 		if err := json.Unmarshal(payload, &inputs); err != nil {
-			log.Printf("Could not parse received data: %#v", err)
+			log.Printf("Could not parse received data: %v", errs.New(component, errs.Parse, err))
 			continue
 		}
+		c.stream.publish(payload)
+
+		for i := range inputs {
+			inputs[i].Value = fault.CorruptReading(inputs[i].Value)
+		}
 
 		c.parseData(inputs)
 	}
 }
 
 func (c *Client) parseData(data []Device) {
+	sensors := c.Sensors.byName()
+	updated := false
 	for _, msg := range data {
-		switch {
-		case msg.Circuit == c.Sensors.SolarUp.Circuit && msg.Dev == c.Sensors.SolarUp.Dev:
-			temp := calculateTemperature(msg.Value)
-			c.Sensors.SolarUp.Value = temp
-			//solarPanelTemperature.Set(temp)
-			//solarPanelVoltage.Set(msg.Value)
-		case msg.Dev != "temp":
-			continue
-		case msg.Circuit == c.Sensors.SolarIn.Circuit:
-			c.Sensors.SolarIn.Value = msg.Value
-		case msg.Circuit == c.Sensors.SolarOut.Circuit:
-			c.Sensors.SolarOut.Value = msg.Value
-		case msg.Circuit == c.Sensors.TankUp.Circuit:
-			c.Sensors.TankUp.Value = msg.Value
+		for name, sensor := range sensors {
+			if msg.Dev == sensor.Dev && msg.Circuit == sensor.Circuit {
+				readSensor(name, sensor, msg.Value, SourceWebsocket)
+				updated = true
+			}
 		}
+		c.checkActuator(msg)
 	}
+	if updated {
+		c.sensorsUpdated()
+	}
+}
+
+// readSensor converts raw reading of the sensor and stores it. Reading which can't be converted marks the sensor
+// faulted instead, so NaN or a temperature of a broken sensor never reaches the control loop.
+func readSensor(name string, sensor *Device, raw float64, source string) {
+	value, err := sensor.convert(raw)
+	if err != nil {
+		if sensor.Fault == "" {
+			log.Printf("Rejected reading of sensor %s: %v", name, errs.New(component, errs.Parse, err))
+		}
+		sensor.Fault = err.Error()
+		sensor.Raw = raw
+		sensor.Updated = time.Now().Unix()
+		sensor.Source = source
+		sensorFault.WithLabelValues(name).Set(1)
+		return
+	}
+	if sensor.Fault != "" {
+		log.Printf("Sensor %s reports valid readings again", name)
+	}
+	setSensor(name, sensor, raw, value, source)
+}
+
+// setSensor stores sensor reading with its metadata and exports it immediately, independently of the control loop
+// cadence.
+func setSensor(name string, sensor *Device, raw, value float64, source string) {
+	sensor.Value = value
+	sensor.Fault = ""
+	sensorFault.WithLabelValues(name).Set(0)
+	sensor.Raw = raw
+	sensor.Unit = temperatureUnit
+	sensor.Updated = time.Now().Unix()
+	sensor.Source = source
+	sensorTemperature.WithLabelValues(name).Set(value)
+}
+
+// SetUpdateHook registers function called whenever sensors are updated from websocket stream or simulation. It
+// runs on the receiving goroutine, so it has to be quick.
+func (c *Client) SetUpdateHook(hook func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateHook = hook
 }
 
-func calculateTemperature(voltage float64) float64 {
-	return voltage*(200-0)/12 + 0
+// SetPanicHook registers function called when the receiving goroutine panics, so the caller can put actuators into
+// safe state. Without a hook the panic crashes the process.
+func (c *Client) SetPanicHook(hook func(recovered interface{})) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.panicHook = hook
 }
 
+func (c *Client) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	c.mu.Lock()
+	hook := c.panicHook
+	c.mu.Unlock()
+	if hook == nil {
+		panic(r)
+	}
+	hook(r)
+}
+
+func (c *Client) sensorsUpdated() {
+	c.mu.Lock()
+	hook := c.updateHook
+	c.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+// InitializeSensorsValues fetches current readings of all sensors with a single bulk request. Sensors missing in
+// the bulk response are read one by one.
 func (c *Client) InitializeSensorsValues() error {
-	var err error
-	var errs []error
+	if c.sim != nil {
+		return nil
+	}
 
-	err = c.updateValue(&c.Sensors.SolarUp)
+	found, err := c.readAll()
 	if err != nil {
-		errs = append(errs, err)
+		log.Printf("Bulk read failed, reading sensors one by one: %v", err)
 	}
-	err = c.updateValue(&c.Sensors.SolarIn)
-	if err != nil {
-		errs = append(errs, err)
+
+	var failed int
+	for name, sensor := range c.Sensors.byName() {
+		if sensor.Dev == "" || found[sensor] {
+			continue
+		}
+		if err := c.updateValue(name, sensor); err != nil {
+			log.Printf("Could not read sensor %s: %v", name, err)
+			failed++
+		}
 	}
-	err = c.updateValue(&c.Sensors.SolarOut)
-	if err != nil {
-		errs = append(errs, err)
+
+	if failed > 0 {
+		return fmt.Errorf("encountered %d error(s) while fetching sensors", failed)
 	}
-	err = c.updateValue(&c.Sensors.TankUp)
+
+	return nil
+}
+
+// readAll updates sensors from EVOK /rest/all response and reports which sensors were found in it.
+func (c *Client) readAll() (map[*Device]bool, error) {
+	fault.DelayHTTP()
+
+	resp, err := c.httpClient.Get(c.httpAddress + "/rest/all")
 	if err != nil {
-		errs = append(errs, err)
+		return nil, errs.New(component, errs.Transport, fmt.Errorf("failed to get data from EVOK: %w", err))
 	}
+	defer resp.Body.Close()
 
-	if len(errs) > 0 {
-		return fmt.Errorf("encountered %d error(s) while fetching settings", len(errs))
+	if err := errs.CheckResponse(resp); err != nil {
+		return nil, errs.New(component, errs.Transport, fmt.Errorf("failed to get data from EVOK: %w", err))
 	}
 
-	return nil
+	// Values of some devices aren't numbers, so they are decoded only for configured sensors.
+	var devices []struct {
+		Dev     string          `json:"dev"`
+		Circuit string          `json:"circuit"`
+		Value   json.RawMessage `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return nil, errs.New(component, errs.Parse, fmt.Errorf("failed to parse received data: %w", err))
+	}
+
+	found := make(map[*Device]bool)
+	for _, d := range devices {
+		for name, sensor := range c.Sensors.byName() {
+			if sensor.Dev != d.Dev || sensor.Circuit != d.Circuit {
+				continue
+			}
+			var raw float64
+			if err := json.Unmarshal(d.Value, &raw); err != nil {
+				log.Printf("Invalid value of %s/%s in bulk response: %v", d.Dev, d.Circuit, errs.New(component, errs.Parse, err))
+				continue
+			}
+			readSensor(name, sensor, raw, SourceREST)
+			found[sensor] = true
+		}
+	}
+	return found, nil
 }
 
-func (c *Client) updateValue(obj *Device) error {
-	var err error
-	obj.Value, err = c.getValue(obj.Dev, obj.Circuit)
+func (c *Client) updateValue(name string, obj *Device) error {
+	raw, err := c.getValue(obj.Dev, obj.Circuit)
 	if err != nil {
 		return fmt.Errorf("failed to update value: %w", err)
 	}
+	readSensor(name, obj, raw, SourceREST)
 	return nil
 }
 
 func (c *Client) getValue(dev, circuit string) (float64, error) {
+	fault.DelayHTTP()
+
 	address := fmt.Sprintf("%s/rest/%s/%s", c.httpAddress, dev, circuit)
 
-	resp, err := http.Get(address)
+	resp, err := c.httpClient.Get(address)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get data from EVOK: %w", err)
+		return 0, errs.New(component, errs.Transport, fmt.Errorf("failed to get data from EVOK: %w", err))
 	}
 	defer resp.Body.Close()
 
+	if err := errs.CheckResponse(resp); err != nil {
+		return 0, errs.New(component, errs.Transport, fmt.Errorf("failed to get %s/%s from EVOK: %w", dev, circuit, err))
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read response body: %w", err)
+		return 0, errs.New(component, errs.Transport, fmt.Errorf("failed to read response body: %w", err))
 	}
 
 	var data Device
 	if err := json.Unmarshal(body, &data); err != nil {
-		return 0, fmt.Errorf("failed to parse received data: %w", err)
+		return 0, errs.New(component, errs.Parse, fmt.Errorf("failed to parse received data: %w", err))
 	}
 
 	return data.Value, nil
 }
 
-func (c *Client) SetValue(dev, circuit string, value float64) error {
+// SetInhibited blocks or unblocks all actuator commands.
+func (c *Client) SetInhibited(inhibited bool) {
+	var v int32
+	if inhibited {
+		v = 1
+	}
+	atomic.StoreInt32(&c.inhibited, v)
+}
+
+// Inhibited reports if actuator commands are blocked.
+func (c *Client) Inhibited() bool {
+	return atomic.LoadInt32(&c.inhibited) == 1
+}
+
+func (c *Client) SetValue(dev, circuit string, value float64) (err error) {
+	if c.Inhibited() {
+		return ErrInhibited
+	}
+	if c.IsLockedOut(c.Actuators.nameOf(dev, circuit)) {
+		return ErrLockedOut
+	}
+
+	logging.Debugf("Setting %s/%s to %f", dev, circuit, value)
+	if c.sim != nil {
+		c.sim.setActuator(dev, circuit, value)
+		c.setApplied(c.Actuators.nameOf(dev, circuit), value)
+		return nil
+	}
+
+	// Value is recorded before the request, as EVOK may report the change over websocket before it responds. It is
+	// rolled back when the request fails, so a value which was never applied isn't reported as an external change.
+	name := c.Actuators.nameOf(dev, circuit)
+	c.mu.Lock()
+	previous, commanded := c.commanded[name]
+	c.commanded[name] = value
+	c.mu.Unlock()
+	defer func() {
+		if err == nil {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.commanded[name] != value {
+			return
+		}
+		if commanded {
+			c.commanded[name] = previous
+		} else {
+			delete(c.commanded, name)
+		}
+	}()
+
+	fault.DelayHTTP()
+
 	address := fmt.Sprintf("%s/json/%s/%s", c.httpAddress, dev, circuit)
 
 	var jsonValue []byte
@@ -227,16 +656,23 @@ func (c *Client) SetValue(dev, circuit string, value float64) error {
 
 	req, err := http.NewRequest("POST", address, bytes.NewBuffer(jsonValue))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return errs.New(component, errs.Validation, fmt.Errorf("failed to create request: %w", err))
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	commandDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("failed to set circuit state in EVOK: %w", err)
+		return errs.New(component, errs.Actuator, fmt.Errorf("failed to set circuit state in EVOK: %w", err))
 	}
 	defer resp.Body.Close()
 
+	if err := errs.CheckResponse(resp); err != nil {
+		return errs.New(component, errs.Actuator, fmt.Errorf("EVOK rejected %s/%s state: %w", dev, circuit, err))
+	}
+
+	c.setApplied(name, value)
 	return nil
 }
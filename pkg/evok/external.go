@@ -0,0 +1,59 @@
+package evok
+
+import (
+	"log"
+	"math"
+)
+
+const (
+	externalChangesSize = 16
+	// analogTolerance absorbs rounding of analog output values reported by EVOK.
+	analogTolerance = 0.1
+)
+
+// ExternalChange describes actuator state reported by EVOK which differs from the last value sent by the
+// controller, e.g. when pump was toggled manually from EVOK UI.
+type ExternalChange struct {
+	Actuator string
+	Dev      string
+	Circuit  string
+	Expected float64
+	Actual   float64
+}
+
+// ExternalChanges returns channel of detected external actuator changes.
+func (c *Client) ExternalChanges() <-chan ExternalChange {
+	return c.externalChanges
+}
+
+// checkActuator compares actuator state update with the last commanded value. Actuators which weren't commanded
+// yet are not checked, neither is watchdog output which toggles faster than EVOK reports its state.
+func (c *Client) checkActuator(msg Device) {
+	for name, actuator := range c.Actuators.byName() {
+		if actuator.Dev == "" || actuator.Dev != msg.Dev || actuator.Circuit != msg.Circuit {
+			continue
+		}
+		if name == "watchdog" {
+			return
+		}
+
+		c.mu.Lock()
+		expected, ok := c.commanded[name]
+		locked := c.lockedOut[name]
+		c.mu.Unlock()
+		if !ok || locked || math.Abs(expected-msg.Value) < analogTolerance {
+			return
+		}
+		c.mu.Lock()
+		delete(c.applied, name)
+		c.mu.Unlock()
+
+		change := ExternalChange{Actuator: name, Dev: msg.Dev, Circuit: msg.Circuit, Expected: expected, Actual: msg.Value}
+		select {
+		case c.externalChanges <- change:
+		default:
+			log.Printf("Dropping external change of %s, previous changes were not handled yet", name)
+		}
+		return
+	}
+}
@@ -0,0 +1,119 @@
+package evok
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrLockedOut is returned by SetValue for actuators locked out for maintenance.
+var ErrLockedOut = errors.New("actuator is locked out for maintenance")
+
+var lockedOutMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "solar",
+	Name:      "actuator_locked_out",
+	Help:      "Whether actuator is locked out for maintenance and is not commanded",
+}, []string{"actuator"})
+
+// IsActuator reports if name identifies an actuator.
+func IsActuator(name string) bool {
+	var a Actuators
+	_, ok := a.byName()[name]
+	return ok
+}
+
+// SetLockedOut locks named actuator out for maintenance or releases it. Locked out actuators are not commanded and
+// their state changes are not reported as external changes. Digital output which was switched on is locked out only
+// once it is switched off, so it isn't left energized while the controller considers it off. Analog outputs stay
+// where they were left.
+func (c *Client) SetLockedOut(name string, locked bool) error {
+	if !IsActuator(name) {
+		return fmt.Errorf("unknown actuator %s", name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lockedOut[name] == locked {
+		if !locked && c.lockoutPending[name] {
+			log.Printf("Pending maintenance lockout of actuator %s is cancelled", name)
+			delete(c.lockoutPending, name)
+		}
+		return nil
+	}
+
+	if locked {
+		if c.energized(name) {
+			if !c.lockoutPending[name] {
+				log.Printf("Actuator %s is energized, it will be locked out for maintenance once switched off", name)
+			}
+			if c.lockoutPending == nil {
+				c.lockoutPending = make(map[string]bool)
+			}
+			c.lockoutPending[name] = true
+			return nil
+		}
+		c.lockOut(name)
+	} else {
+		log.Printf("Actuator %s is released from maintenance lockout", name)
+		delete(c.lockedOut, name)
+		// Its state may have been changed by hand, so it is not compared with the last command.
+		delete(c.commanded, name)
+		delete(c.applied, name)
+		lockedOutMetric.WithLabelValues(name).Set(0)
+	}
+	return nil
+}
+
+// lockOut locks named actuator out. It has to be called with c.mu held.
+func (c *Client) lockOut(name string) {
+	if c.lockedOut == nil {
+		c.lockedOut = make(map[string]bool)
+	}
+	log.Printf("Actuator %s is locked out for maintenance", name)
+	c.lockedOut[name] = true
+	lockedOutMetric.WithLabelValues(name).Set(1)
+}
+
+// energized reports if named actuator is a digital output which was switched on by the last command. It has to be
+// called with c.mu held.
+func (c *Client) energized(name string) bool {
+	if c.Actuators.byName()[name].Dev == "ao" {
+		return false
+	}
+	return c.applied[name] != 0
+}
+
+// PendingLockouts returns sorted names of actuators waiting to be switched off before they are locked out.
+func (c *Client) PendingLockouts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.lockoutPending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsLockedOut reports if named actuator is locked out for maintenance.
+func (c *Client) IsLockedOut(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lockedOut[name]
+}
+
+// LockedOut returns sorted names of actuators locked out for maintenance.
+func (c *Client) LockedOut() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.lockedOut {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,97 @@
+package evok
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// simulator replaces EVOK in simulation mode. Actuator commands are only recorded and sensor values are set over
+// HTTP, which allows bench testing of controller reactions without any hardware.
+type simulator struct {
+	mu        sync.Mutex
+	actuators map[string]float64
+}
+
+// NewSimulatedClient creates a client which does not communicate with EVOK.
+func NewSimulatedClient(sensors Sensors, actuators Actuators) *Client {
+	return &Client{
+		Sensors:   sensors,
+		Actuators: actuators,
+		sim:       &simulator{actuators: make(map[string]float64)},
+		done:      make(chan struct{}),
+	}
+}
+
+func (s *simulator) setActuator(dev, circuit string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%s", dev, circuit)
+	if s.actuators[key] != value {
+		log.Printf("Simulated actuator %s set to %f", key, value)
+	}
+	s.actuators[key] = value
+}
+
+// HandleSimulatedSensors shows simulated sensors on GET and sets them from a JSON object of sensor names and
+// temperatures on POST.
+func (c *Client) HandleSimulatedSensors(w http.ResponseWriter, r *http.Request) {
+	if c.sim == nil {
+		http.Error(w, "simulation mode is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var values map[string]float64
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		sensors := c.Sensors.byName()
+		for name := range values {
+			if _, ok := sensors[name]; !ok {
+				http.Error(w, fmt.Sprintf("unknown sensor %s", name), http.StatusBadRequest)
+				return
+			}
+		}
+		for name, value := range values {
+			log.Printf("Simulated sensor %s set to %f", name, value)
+			setSensor(name, sensors[name], value, value, SourceSimulation)
+		}
+		c.sensorsUpdated()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.ExposeSensorsOnHTTP(w, r)
+}
+
+// ExposeSimulatedActuatorsOnHTTP shows last values commanded to simulated actuators.
+func (c *Client) ExposeSimulatedActuatorsOnHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.sim == nil {
+		http.Error(w, "simulation mode is disabled", http.StatusNotFound)
+		return
+	}
+
+	c.sim.mu.Lock()
+	js, err := json.Marshal(c.sim.actuators)
+	c.sim.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,120 @@
+package evok
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// streamBuffer is the number of messages waiting for a stream subscriber. Messages for a subscriber which doesn't
+	// keep up are dropped, so it can't slow down processing of sensor updates.
+	streamBuffer = 16
+	// maxStreamSubscribers limits concurrent streams, each of them holds a connection open.
+	maxStreamSubscribers = 8
+)
+
+var streamDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "solar",
+	Name:      "evok_stream_messages_dropped_total",
+	Help:      "Total number of EVOK messages not relayed to a stream subscriber which could not keep up",
+})
+
+// updateStream fans websocket messages received from EVOK out to API subscribers.
+type updateStream struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func (s *updateStream) subscribe() (chan []byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribers) >= maxStreamSubscribers {
+		return nil, false
+	}
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan []byte]struct{})
+	}
+	ch := make(chan []byte, streamBuffer)
+	s.subscribers[ch] = struct{}{}
+	return ch, true
+}
+
+func (s *updateStream) unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, ch)
+}
+
+func (s *updateStream) publish(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- payload:
+		default:
+			streamDroppedTotal.Inc()
+		}
+	}
+}
+
+// StreamUpdates relays device updates received over EVOK websocket as server-sent events, so other services can use
+// the same readings without their own connection to EVOK. Every event is a JSON array of devices as sent by EVOK,
+// limited to device types the controller subscribes to. Nothing is relayed in simulation mode. Stream ends after
+// maxDuration when it is positive, which keeps it within server write timeout, and clients reconnect.
+func (c *Client) StreamUpdates(w http.ResponseWriter, r *http.Request, maxDuration time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	updates, ok := c.stream.subscribe()
+	if !ok {
+		http.Error(w, "too many subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer c.stream.unsubscribe(updates)
+
+	var deadline <-chan time.Time
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write([]byte("retry: 1000\n\n")); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	var event bytes.Buffer
+	for {
+		select {
+		case payload := <-updates:
+			// Event data can't span lines.
+			event.Reset()
+			event.WriteString("data: ")
+			if err := json.Compact(&event, payload); err != nil {
+				continue
+			}
+			event.WriteString("\n\n")
+			if _, err := w.Write(event.Bytes()); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
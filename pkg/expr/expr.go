@@ -0,0 +1,383 @@
+// Package expr implements small arithmetic and boolean expressions over named float64 variables. It is used for
+// user-defined rules and computed sensors in configuration.
+//
+// Supported operators by increasing precedence: ||, &&, comparisons (< <= > >= == !=), + -, * /, unary - and !.
+// Functions min, max and abs are available. Boolean values are represented as 1 (true) and 0 (false).
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse compiles an expression.
+func Parse(src string) (*Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.tokens[p.pos].text, src)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns expression source.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval computes expression value. Unknown variables are reported as errors.
+func (e *Expr) Eval(vars map[string]float64) (float64, error) {
+	return e.root.eval(vars)
+}
+
+// Vars returns names of all variables referenced by the expression.
+func (e *Expr) Vars() []string {
+	var names []string
+	e.root.vars(func(name string) {
+		names = append(names, name)
+	})
+	return names
+}
+
+type node interface {
+	eval(vars map[string]float64) (float64, error)
+	vars(func(string))
+}
+
+type number float64
+
+func (n number) eval(map[string]float64) (float64, error) { return float64(n), nil }
+func (n number) vars(func(string))                        {}
+
+type variable string
+
+func (v variable) eval(vars map[string]float64) (float64, error) {
+	value, ok := vars[string(v)]
+	if !ok {
+		return 0, fmt.Errorf("unknown variable %s", string(v))
+	}
+	return value, nil
+}
+
+func (v variable) vars(f func(string)) { f(string(v)) }
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (u unary) eval(vars map[string]float64) (float64, error) {
+	v, err := u.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if u.op == "!" {
+		return boolean(v == 0), nil
+	}
+	return -v, nil
+}
+
+func (u unary) vars(f func(string)) { u.operand.vars(f) }
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (b binary) eval(vars map[string]float64) (float64, error) {
+	l, err := b.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	// Logical operators short-circuit.
+	switch b.op {
+	case "&&":
+		if l == 0 {
+			return 0, nil
+		}
+	case "||":
+		if l != 0 {
+			return 1, nil
+		}
+	}
+
+	r, err := b.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "<":
+		return boolean(l < r), nil
+	case "<=":
+		return boolean(l <= r), nil
+	case ">":
+		return boolean(l > r), nil
+	case ">=":
+		return boolean(l >= r), nil
+	case "==":
+		return boolean(l == r), nil
+	case "!=":
+		return boolean(l != r), nil
+	default:
+		return boolean(r != 0), nil
+	}
+}
+
+func (b binary) vars(f func(string)) {
+	b.left.vars(f)
+	b.right.vars(f)
+}
+
+type call struct {
+	name string
+	args []node
+}
+
+var functions = map[string]struct {
+	arity int
+	fn    func(args []float64) float64
+}{
+	"abs": {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"min": {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"max": {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+}
+
+func (c call) eval(vars map[string]float64) (float64, error) {
+	args := make([]float64, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return functions[c.name].fn(args), nil
+}
+
+func (c call) vars(f func(string)) {
+	for _, arg := range c.args {
+		arg.vars(f)
+	}
+}
+
+func boolean(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type token struct {
+	text  string
+	ident bool
+	num   bool
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{text: string(runes[i:j]), num: true})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			// Dots allow referring to nested settings, e.g. flow.dutyMin.
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{text: string(runes[i:j]), ident: true})
+			i = j
+		default:
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				switch two {
+				case "<=", ">=", "==", "!=", "&&", "||":
+					tokens = append(tokens, token{text: two})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/<>!(),", r) {
+				return nil, fmt.Errorf("unexpected character %q in expression %q", r, src)
+			}
+			tokens = append(tokens, token{text: string(r)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	if t.ident || t.num {
+		return ""
+	}
+	return t.text
+}
+
+// binaryLevel parses left-associative chain of operators using next for operands.
+func (p *parser) binaryLevel(next func() (node, error), ops ...string) (node, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		matched := false
+		for _, o := range ops {
+			if op == o {
+				matched = true
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) or() (node, error) {
+	return p.binaryLevel(p.and, "||")
+}
+
+func (p *parser) and() (node, error) {
+	return p.binaryLevel(p.comparison, "&&")
+}
+
+func (p *parser) comparison() (node, error) {
+	return p.binaryLevel(p.sum, "<", "<=", ">", ">=", "==", "!=")
+}
+
+func (p *parser) sum() (node, error) {
+	return p.binaryLevel(p.term, "+", "-")
+}
+
+func (p *parser) term() (node, error) {
+	return p.binaryLevel(p.unary, "*", "/")
+}
+
+func (p *parser) unary() (node, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unary{op: op, operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+	switch {
+	case t.num:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return number(v), nil
+	case t.ident:
+		if p.peek() != "(" {
+			return variable(t.text), nil
+		}
+		return p.call(t.text)
+	case t.text == "(":
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+func (p *parser) call(name string) (node, error) {
+	f, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.pos++ // (
+
+	var args []node
+	for p.peek() != ")" {
+		if len(args) > 0 {
+			if p.peek() != "," {
+				return nil, fmt.Errorf("expected comma in arguments of %s", name)
+			}
+			p.pos++
+		}
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++ // )
+
+	if len(args) != f.arity {
+		return nil, fmt.Errorf("function %s takes %d argument(s), got %d", name, f.arity, len(args))
+	}
+	return call{name: name, args: args}, nil
+}
@@ -0,0 +1,125 @@
+// Package fault implements fault injection hooks used for chaos testing of the controller safety design.
+// Hooks are no-ops unless injection is enabled with Enable.
+package fault
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Config describes faults to inject.
+type Config struct {
+	// DropMessages is a probability (0-1) of dropping a websocket message.
+	DropMessages float64 `json:"dropMessages"`
+	// HTTPDelay is added to every outgoing HTTP call.
+	HTTPDelay Duration `json:"httpDelay"`
+	// CorruptReadings is a probability (0-1) of replacing a sensor reading with a random value.
+	CorruptReadings float64 `json:"corruptReadings"`
+}
+
+// Duration is a time.Duration encoded as a string in JSON (e.g. "1.5s").
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var (
+	mu      sync.Mutex
+	enabled bool
+	current Config
+)
+
+// Enable turns on fault injection hooks.
+func Enable() {
+	mu.Lock()
+	defer mu.Unlock()
+	enabled = true
+	log.Println("Fault injection is enabled")
+}
+
+func get() (Config, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	return current, enabled
+}
+
+// DropMessage reports if a received message should be dropped.
+func DropMessage() bool {
+	cfg, ok := get()
+	return ok && cfg.DropMessages > 0 && rand.Float64() < cfg.DropMessages
+}
+
+// DelayHTTP blocks for configured HTTP delay.
+func DelayHTTP() {
+	cfg, ok := get()
+	if ok && cfg.HTTPDelay > 0 {
+		time.Sleep(time.Duration(cfg.HTTPDelay))
+	}
+}
+
+// CorruptReading returns either the reading or, with configured probability, a random value between -50 and 250.
+func CorruptReading(value float64) float64 {
+	cfg, ok := get()
+	if ok && cfg.CorruptReadings > 0 && rand.Float64() < cfg.CorruptReadings {
+		return rand.Float64()*300 - 50
+	}
+	return value
+}
+
+// HandleHTTP shows injected faults on GET and replaces them with a JSON encoded Config on PUT.
+func HandleHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := get(); !ok {
+		http.Error(w, "fault injection is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var cfg Config
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		current = cfg
+		mu.Unlock()
+		log.Printf("Injecting faults: %+v", cfg)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, _ := get()
+	js, err := json.Marshal(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,62 @@
+package homeassistant
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tokenValidMetric = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "solar",
+	Name:      "homeassistant_token_valid",
+	Help:      "Whether Home Assistant accepts the access token",
+})
+
+// SetToken replaces access token used for following requests, e.g. after it was rotated.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// TokenInvalid reports if Home Assistant rejected the access token in the last request.
+func (c *Client) TokenInvalid() bool {
+	return atomic.LoadInt32(&c.tokenInvalid) == 1
+}
+
+// CloseIdleConnections drops kept-alive connections, so following requests connect to Home Assistant again.
+func (c *Client) CloseIdleConnections() {
+	c.client.CloseIdleConnections()
+}
+
+// do sends authorized request and tracks if the token is accepted.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		if atomic.SwapInt32(&c.tokenInvalid, 1) == 0 {
+			log.Println("Home Assistant rejected the access token, token is invalid or expired")
+		}
+		tokenValidMetric.Set(0)
+	} else {
+		if atomic.SwapInt32(&c.tokenInvalid, 0) == 1 {
+			log.Println("Home Assistant accepts the access token again")
+		}
+		tokenValidMetric.Set(1)
+	}
+	return resp, nil
+}
@@ -0,0 +1,169 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// historySize is the number of settings snapshots kept in memory.
+const historySize = 100
+
+// Change describes a single setting value change.
+type Change struct {
+	Setting string  `json:"setting"`
+	Old     float64 `json:"old"`
+	New     float64 `json:"new"`
+}
+
+// Snapshot records settings values after a change together with its origin.
+type Snapshot struct {
+	ID      int                `json:"id"`
+	Time    time.Time          `json:"time"`
+	Source  string             `json:"source"`
+	Changes []Change           `json:"changes"`
+	Values  map[string]float64 `json:"values"`
+}
+
+type history struct {
+	mu        sync.Mutex
+	nextID    int
+	snapshots []Snapshot
+}
+
+func (h *history) add(source string, changes []Change, values map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	h.snapshots = append(h.snapshots, Snapshot{
+		ID:      h.nextID,
+		Time:    time.Now(),
+		Source:  source,
+		Changes: changes,
+		Values:  values,
+	})
+	if len(h.snapshots) > historySize {
+		h.snapshots = h.snapshots[len(h.snapshots)-historySize:]
+	}
+}
+
+func (h *history) get(id int) (Snapshot, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range h.snapshots {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Snapshot{}, false
+}
+
+func (h *history) list() []Snapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]Snapshot, len(h.snapshots))
+	copy(list, h.snapshots)
+	return list
+}
+
+// Values returns current value of every setting bound to an entity.
+func (s *Settings) Values() map[string]float64 {
+	values := make(map[string]float64)
+	for name, entity := range s.entities() {
+		if entity.EntityID != "" {
+			values[name] = entity.Value
+		}
+	}
+	return values
+}
+
+// recordChanges compares current settings with the previous ones and stores a snapshot if anything changed.
+func (c *Client) recordChanges(before Settings, source string) {
+	after := c.GetSettings()
+	old := before.Values()
+	values := after.Values()
+
+	var changes []Change
+	for name, value := range values {
+		if old[name] != value {
+			changes = append(changes, Change{Setting: name, Old: old[name], New: value})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Setting < changes[j].Setting })
+
+	c.history.add(source, changes, values)
+}
+
+// Rollback restores settings to values recorded in snapshot with given ID.
+func (c *Client) Rollback(id int) error {
+	snapshot, ok := c.history.get(id)
+	if !ok {
+		return fmt.Errorf("snapshot %d not found", id)
+	}
+
+	current := c.GetSettings()
+	values := current.Values()
+	changed := make(map[string]float64)
+	for name, value := range snapshot.Values {
+		if values[name] != value {
+			changed[name] = value
+		}
+	}
+
+	log.Printf("Rolling back settings to snapshot %d", id)
+	return c.SetSettings(changed, fmt.Sprintf("rollback:%d", id))
+}
+
+// ExposeHistoryOnHTTP lists recorded settings snapshots.
+func (c *Client) ExposeHistoryOnHTTP(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(c.history.list())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// HandleRollbackAPI rolls settings back to a snapshot passed as {"id": <snapshot id>} in POST body.
+func (c *Client) HandleRollbackAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := c.history.get(req.ID); !ok {
+		http.Error(w, fmt.Sprintf("snapshot %d not found", req.ID), http.StatusNotFound)
+		return
+	}
+
+	if err := c.Rollback(req.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	c.ExposeSettingsOnHTTP(w, r)
+}
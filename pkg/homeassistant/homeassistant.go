@@ -1,17 +1,31 @@
 package homeassistant
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
-	"strconv"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/automatedhome/solar/pkg/errs"
+	"github.com/automatedhome/solar/pkg/fault"
+	"github.com/automatedhome/solar/pkg/logging"
 )
 
+const component = "homeassistant"
+
+// requestTimeout bounds every request to Home Assistant, so a hanging call can't block settings refresh.
+const requestTimeout = 10 * time.Second
+
 type Settings struct {
 	SolarEmergency Entity       `yaml:"solarEmergency"`
 	SolarCritical  Entity       `yaml:"solarCritical"`
@@ -19,6 +33,69 @@ type Settings struct {
 	SolarOff       Entity       `yaml:"solarOff"`
 	TankMax        Entity       `yaml:"tankMax"`
 	Flow           FlowSettings `yaml:"flow"`
+	// Optional entities. Those without entity_id are not fetched from Home Assistant.
+	CoolingSeason  Entity `yaml:"coolingSeason,omitempty"`
+	CoolingTankMax Entity `yaml:"coolingTankMax,omitempty"`
+	NightCooldown  Entity `yaml:"nightCooldown,omitempty"`
+	// Smart tank max allows overshooting TankMax when no more sun is expected today.
+	SmartTankMax            Entity `yaml:"smartTankMax,omitempty"`
+	SmartTankMaxHour        Entity `yaml:"smartTankMaxHour,omitempty"`
+	TankMaxOvershoot        Entity `yaml:"tankMaxOvershoot,omitempty"`
+	TankMaxMorningReduction Entity `yaml:"tankMaxMorningReduction,omitempty"`
+	SunRemaining            Entity `yaml:"sunRemaining,omitempty"`
+	// SolarOffDeadband is added to SolarOff for returning from reduced to working mode, so delta hovering at SolarOff
+	// doesn't toggle between them.
+	SolarOffDeadband Entity `yaml:"solarOffDeadband,omitempty"`
+	// DeltaWindow is a period in seconds over which temperature delta is averaged before making decisions.
+	DeltaWindow Entity `yaml:"deltaWindow,omitempty"`
+	// SolarEmergencySoft parks the system in min-flow standby. SolarEmergency is the hard one de-energizing everything.
+	SolarEmergencySoft Entity `yaml:"solarEmergencySoft,omitempty"`
+	// DHWRecirculation is a state of domestic hot water recirculation pump. While it runs, flow is raised by DHWFlowBoost.
+	DHWRecirculation Entity `yaml:"dhwRecirculation,omitempty"`
+	DHWFlowBoost     Entity `yaml:"dhwFlowBoost,omitempty"`
+	// Weather readings used for stagnation risk: irradiance in W/m², outdoor temperature in °C and wind speed in m/s.
+	Irradiance         Entity `yaml:"irradiance,omitempty"`
+	OutdoorTemperature Entity `yaml:"outdoorTemperature,omitempty"`
+	WindSpeed          Entity `yaml:"windSpeed,omitempty"`
+	// MeasuredFlow of the solar circuit from a flow meter, e.g. in l/min, used to detect air in the loop.
+	MeasuredFlow Entity `yaml:"measuredFlow,omitempty"`
+	// ElectricityPrice per kWh, used to block electric backup heater during expensive hours.
+	ElectricityPrice Entity `yaml:"electricityPrice,omitempty"`
+}
+
+// entities returns pointers to all entities which should be synchronized with Home Assistant keyed by their
+// configuration name. Nested settings are separated with a dot.
+func (s *Settings) entities() map[string]*Entity {
+	return map[string]*Entity{
+		"solarEmergency": &s.SolarEmergency,
+		"solarCritical":  &s.SolarCritical,
+		"solarOn":        &s.SolarOn,
+		"solarOff":       &s.SolarOff,
+		"tankMax":        &s.TankMax,
+		"flow.dutyMin":   &s.Flow.DutyMin,
+		"flow.dutyMax":   &s.Flow.DutyMax,
+		"flow.tempMin":   &s.Flow.TempMin,
+		"flow.tempMax":   &s.Flow.TempMax,
+		"coolingSeason":  &s.CoolingSeason,
+		"coolingTankMax": &s.CoolingTankMax,
+		"nightCooldown":  &s.NightCooldown,
+
+		"smartTankMax":            &s.SmartTankMax,
+		"smartTankMaxHour":        &s.SmartTankMaxHour,
+		"tankMaxOvershoot":        &s.TankMaxOvershoot,
+		"tankMaxMorningReduction": &s.TankMaxMorningReduction,
+		"sunRemaining":            &s.SunRemaining,
+		"deltaWindow":             &s.DeltaWindow,
+		"solarOffDeadband":        &s.SolarOffDeadband,
+		"solarEmergencySoft":      &s.SolarEmergencySoft,
+		"dhwRecirculation":        &s.DHWRecirculation,
+		"dhwFlowBoost":            &s.DHWFlowBoost,
+		"irradiance":              &s.Irradiance,
+		"outdoorTemperature":      &s.OutdoorTemperature,
+		"windSpeed":               &s.WindSpeed,
+		"measuredFlow":            &s.MeasuredFlow,
+		"electricityPrice":        &s.ElectricityPrice,
+	}
 }
 
 type FlowSettings struct {
@@ -28,17 +105,94 @@ type FlowSettings struct {
 	TempMax Entity `yaml:"tempMax"`
 }
 
+// Entity binds a setting to Home Assistant entity. EntityID can be followed by a slash separated path into entity
+// state object to use one of its attributes, e.g. "climate.boiler/attributes/temperature".
 type Entity struct {
 	EntityID string  `json:"entity_id" yaml:"entity_id"`
 	State    string  `json:"state,omitempty" yaml:"state,omitempty"`
 	Value    float64 `json:"value,omitempty" yaml:"value,omitempty"`
+	// Stale marks Value kept from before the entity became unavailable.
+	Stale bool `json:"stale,omitempty" yaml:"-"`
+	// Source tells where Value came from, e.g. "yaml", "homeassistant" or "profile".
+	Source string `json:"source,omitempty" yaml:"-"`
+}
+
+// Sources of setting values set by the client. They take precedence over values the settings were created with.
+const (
+	SourceHomeAssistant = "homeassistant"
+	SourceFallback      = "fallback"
+	SourceProfile       = "profile"
+)
+
+// SettingNames returns sorted names of all settings.
+func SettingNames() []string {
+	var s Settings
+	var names []string
+	for name := range s.entities() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns entity of named setting.
+func (s *Settings) Lookup(name string) (Entity, bool) {
+	entity, ok := s.entities()[name]
+	if !ok {
+		return Entity{}, false
+	}
+	return *entity, true
+}
+
+// Set changes value of named setting and records its source. It reports if the setting exists.
+func (s *Settings) Set(name string, value float64, source string) bool {
+	entity, ok := s.entities()[name]
+	if !ok {
+		return false
+	}
+	entity.Value, entity.Source = value, source
+	return true
+}
+
+// Stale returns names of settings whose values are kept from before their entities became unavailable.
+func (s *Settings) Stale() []string {
+	var names []string
+	for name, entity := range s.entities() {
+		if entity.Stale {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 type Client struct {
 	Settings Settings
 	Address  string
-	Token    string
+	token    string
 	client   *http.Client
+	mu       sync.RWMutex
+	history  history
+	// overrides replace values received from Home Assistant, e.g. when an operating profile is active.
+	overrides map[string]float64
+	// fallbacks are used instead of values of entities which are unavailable or unknown.
+	fallbacks map[string]float64
+	// bounds limit values received from Home Assistant.
+	bounds map[string]Bounds
+	// schedules change values of settings during the week, scheduleOn holds state of their helper entities.
+	schedules    map[string]Schedule
+	scheduleOn   map[string]bool
+	tokenInvalid int32
+}
+
+// Bounds is an inclusive range of allowed setting values.
+type Bounds struct {
+	Min, Max float64
+}
+
+// Clamp limits value to the bounds.
+func (b Bounds) Clamp(value float64) float64 {
+	return math.Max(b.Min, math.Min(b.Max, value))
 }
 
 var (
@@ -52,68 +206,123 @@ var (
 		Name:      "homeassistant_settups_update_errors_total",
 		Help:      "Total number of failed requests to update settings from Home Assistant",
 	})
+	settingStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "setting_stale",
+		Help:      "Whether setting value is kept from before its entity became unavailable",
+	}, []string{"setting"})
+	settingClamped = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "solar",
+		Name:      "setting_clamped",
+		Help:      "Whether setting value received from Home Assistant is outside of safety bounds and was clamped",
+	}, []string{"setting"})
 )
 
 func NewClient(address, token string, settings Settings) *Client {
 	return &Client{
 		Address:  address,
-		Token:    token,
+		token:    token,
 		Settings: settings,
-		client:   &http.Client{},
+		client:   &http.Client{Timeout: requestTimeout},
 	}
 }
 
+// UpdateAll refreshes all settings with a single request for states of all entities.
 func (c *Client) UpdateAll() error {
 	var errs []error
-	var err error
 
-	err = c.updateEntityValue(&c.Settings.SolarEmergency)
+	settings := c.GetSettings()
+	defer c.recordChanges(settings, "homeassistant")
+
+	states, err := c.getAllEntities()
 	if err != nil {
-		errs = append(errs, err)
+		log.Printf("Could not get states from Home Assistant: %v", err)
+		return err
 	}
-	err = c.updateEntityValue(&c.Settings.SolarCritical)
-	if err != nil {
-		errs = append(errs, err)
+	c.updateSchedules(states)
+
+	for name, entity := range settings.entities() {
+		if entity.EntityID == "" {
+			continue
+		}
+		if err := c.updateEntityValue(name, entity.EntityID, states); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	err = c.updateEntityValue(&c.Settings.SolarOn)
-	if err != nil {
-		errs = append(errs, err)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("encountered %d error(s) while fetching settings", len(errs))
 	}
-	err = c.updateEntityValue(&c.Settings.SolarOff)
-	if err != nil {
-		errs = append(errs, err)
+
+	return nil
+}
+
+// UpdateEntity refreshes only settings taken from a single entity, e.g. the instant an automation reports its change.
+// It returns ErrUnknownEntity when no setting uses the entity.
+func (c *Client) UpdateEntity(entityID string) error {
+	settings := c.GetSettings()
+	names := make(map[string]string)
+	for name, entity := range settings.entities() {
+		if id, _ := splitEntity(entity.EntityID); entity.EntityID != "" && id == entityID {
+			names[name] = entity.EntityID
+		}
 	}
-	err = c.updateEntityValue(&c.Settings.TankMax)
-	if err != nil {
-		errs = append(errs, err)
+	if len(names) == 0 {
+		return ErrUnknownEntity
 	}
+	defer c.recordChanges(settings, "homeassistant")
 
-	err = c.updateEntityValue(&c.Settings.Flow.DutyMin)
+	data, err := c.getEntity(entityID)
 	if err != nil {
-		errs = append(errs, err)
+		log.Printf("Could not get state of %s from Home Assistant: %v", entityID, err)
+		return err
 	}
-	err = c.updateEntityValue(&c.Settings.Flow.DutyMax)
-	if err != nil {
-		errs = append(errs, err)
+	states := map[string]state{entityID: data}
+
+	var errs []error
+	for name, id := range names {
+		if err := c.updateEntityValue(name, id, states); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	err = c.updateEntityValue(&c.Settings.Flow.TempMin)
-	if err != nil {
-		errs = append(errs, err)
+	if len(errs) > 0 {
+		return fmt.Errorf("encountered %d error(s) while fetching settings of %s", len(errs), entityID)
 	}
-	err = c.updateEntityValue(&c.Settings.Flow.TempMax)
-	if err != nil {
-		errs = append(errs, err)
+	return nil
+}
+
+// HandleRefreshAPI re-reads settings of an entity passed as {"entity_id": "<entity>"} in POST body. It is a light
+// alternative to waiting for the next full update, meant to be called by Home Assistant automations.
+func (c *Client) HandleRefreshAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("encountered %d error(s) while fetching settings", len(errs))
+	var req struct {
+		EntityID string `json:"entity_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	return nil
+	err := c.UpdateEntity(req.EntityID)
+	if errors.Is(err, ErrUnknownEntity) {
+		http.Error(w, fmt.Sprintf("no setting uses entity %q", req.EntityID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	c.ExposeSettingsOnHTTP(w, r)
 }
 
 func (c *Client) ExposeSettingsOnHTTP(w http.ResponseWriter, r *http.Request) {
-	js, err := json.Marshal(c.Settings)
+	js, err := json.Marshal(c.GetSettings())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -127,66 +336,238 @@ func (c *Client) ExposeSettingsOnHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Client) GetSettings() Settings {
-	return c.Settings
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	settings := c.Settings
+	entities := settings.entities()
+	now := time.Now()
+	for name, schedule := range c.schedules {
+		if value, ok := schedule.valueAt(now, c.scheduleOn[name]); ok {
+			if entity, ok := entities[name]; ok {
+				entity.Value, entity.Source = value, SourceSchedule
+			}
+		}
+	}
+	for name, value := range c.overrides {
+		if entity, ok := entities[name]; ok {
+			entity.Value, entity.Source = value, SourceProfile
+		}
+	}
+	return settings
 }
 
-func (c *Client) updateEntityValue(entity *Entity) error {
-	value, err := c.getSingleValue(entity.EntityID)
-	if err != nil {
-		log.Printf("Could not get setting for entity %s from Home Assistant: %#v", entity.EntityID, err)
-		return err
+// SetOverrides replaces values of given settings regardless of their Home Assistant state. Nil removes overrides.
+// Values are clamped to bounds like those received from Home Assistant.
+func (c *Client) SetOverrides(overrides map[string]float64) {
+	if overrides != nil {
+		clamped := make(map[string]float64, len(overrides))
+		for name, value := range overrides {
+			clamped[name] = c.clamp(name, value, "profile")
+		}
+		overrides = clamped
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.overrides = overrides
+}
+
+// SetFallback sets value used for a setting while its entity is unavailable or unknown in Home Assistant.
+func (c *Client) SetFallback(name string, value float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fallbacks == nil {
+		c.fallbacks = make(map[string]float64)
+	}
+	c.fallbacks[name] = value
+}
+
+// SetBounds sets safety limits applied to values received from Home Assistant.
+func (c *Client) SetBounds(bounds map[string]Bounds) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bounds = bounds
+}
+
+// CheckBounds reports an error when value is outside of bounds of named setting.
+func (c *Client) CheckBounds(name string, value float64) error {
+	c.mu.RLock()
+	b, ok := c.bounds[name]
+	c.mu.RUnlock()
+	if ok && b.Clamp(value) != value {
+		return errs.New(component, errs.Validation, fmt.Errorf("setting %s value %g is outside of [%g, %g]", name, value, b.Min, b.Max))
 	}
-	entity.Value = value
 	return nil
 }
 
-func (c *Client) getSingleValue(entity string) (float64, error) {
+// clamp limits value of named setting coming from source to its bounds.
+func (c *Client) clamp(name string, value float64, source string) float64 {
+	c.mu.RLock()
+	b, ok := c.bounds[name]
+	c.mu.RUnlock()
+	if !ok {
+		return value
+	}
+
+	clamped := b.Clamp(value)
+	if clamped != value {
+		log.Printf("Warning: setting %s value %f from %s is outside of [%g, %g], using %g", name, value, source, b.Min, b.Max, clamped)
+		settingClamped.WithLabelValues(name).Set(1)
+	} else {
+		settingClamped.WithLabelValues(name).Set(0)
+	}
+	return clamped
+}
+
+// IsSetting reports if name identifies a setting.
+func IsSetting(name string) bool {
+	var s Settings
+	_, ok := s.entities()[name]
+	return ok
+}
+
+// PublishState creates or updates state of an entity in Home Assistant. It is used to expose controller data
+// as Home Assistant sensors.
+func (c *Client) PublishState(entity, state string, attributes map[string]interface{}) error {
 	address := fmt.Sprintf("http://%s/api/states/%s", c.Address, entity)
 
-	hassRequestsTotal.Inc()
+	payload, err := json.Marshal(struct {
+		State      string                 `json:"state"`
+		Attributes map[string]interface{} `json:"attributes,omitempty"`
+	}{state, attributes})
+	if err != nil {
+		return fmt.Errorf("could not encode state: %w", err)
+	}
 
-	req, err := http.NewRequest("GET", address, nil)
+	req, err := http.NewRequest("POST", address, bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.do(req)
 	if err != nil {
+		return errs.New(component, errs.Transport, fmt.Errorf("could not publish state to Home Assistant: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if err := errs.CheckResponse(resp); err != nil {
+		return errs.New(component, errs.Transport, fmt.Errorf("Home Assistant rejected state of %s: %w", entity, err))
+	}
+
+	return nil
+}
+
+func (c *Client) updateEntityValue(name, entityID string, states map[string]state) error {
+	id, path := splitEntity(entityID)
+	data, ok := states[id]
+	if !ok {
 		hassRequestsErrorsTotal.Inc()
-		return -1, fmt.Errorf("could not create request: %w", err)
+		err := errs.New(component, errs.Validation, fmt.Errorf("entity %s does not exist", id))
+		log.Printf("Could not get setting %s from Home Assistant: %v", name, err)
+		return err
+	}
+
+	value, err := parseValue(data, path)
+	if errors.Is(err, ErrNotAvailable) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		entity := c.Settings.entities()[name]
+		if fallback, ok := c.fallbacks[name]; ok {
+			log.Printf("Entity %s of setting %s is %s, using %f", id, name, data.State, fallback)
+			entity.Value, entity.Stale, entity.Source = fallback, false, SourceFallback
+			settingStale.WithLabelValues(name).Set(0)
+			return nil
+		}
+		log.Printf("Entity %s of setting %s is %s, keeping previous value %f", id, name, data.State, entity.Value)
+		entity.Stale = true
+		settingStale.WithLabelValues(name).Set(1)
+		return nil
 	}
+	if err != nil {
+		log.Printf("Could not get setting for entity %s from Home Assistant: %v", entityID, err)
+		return err
+	}
+	value = c.clamp(name, value, "Home Assistant")
 
-	if c.Token != "" {
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	c.mu.Lock()
+	entity := c.Settings.entities()[name]
+	if entity.Source != SourceHomeAssistant {
+		log.Printf("Setting %s is now taken from Home Assistant entity %s (was %s)", name, entityID, entity.Source)
 	}
+	entity.Value, entity.Stale, entity.Source = value, false, SourceHomeAssistant
+	c.mu.Unlock()
+	logging.Debugf("Setting %s = %f from Home Assistant entity %s", name, value, entityID)
+	settingStale.WithLabelValues(name).Set(0)
+	return nil
+}
 
-	resp, err := c.client.Do(req)
+// GetState returns raw state of an entity, e.g. selected option of an input_select.
+func (c *Client) GetState(entity string) (string, error) {
+	data, err := c.getEntity(entity)
 	if err != nil {
-		hassRequestsErrorsTotal.Inc()
-		return -1, fmt.Errorf("could not get data from Home Assistant: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
+	return data.State, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+func (c *Client) getEntity(entity string) (state, error) {
+	var data state
+	err := c.get("states/"+entity, &data)
+	return data, err
+}
+
+// getAllEntities returns states of all Home Assistant entities keyed by entity ID.
+func (c *Client) getAllEntities() (map[string]state, error) {
+	var list []state
+	if err := c.get("states", &list); err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]state, len(list))
+	for _, e := range list {
+		states[e.EntityID] = e
+	}
+	return states, nil
+}
+
+// get decodes JSON response of Home Assistant REST API path into v.
+func (c *Client) get(path string, v interface{}) error {
+	address := fmt.Sprintf("http://%s/api/%s", c.Address, path)
+
+	hassRequestsTotal.Inc()
+	fault.DelayHTTP()
+
+	req, err := http.NewRequest("GET", address, nil)
 	if err != nil {
 		hassRequestsErrorsTotal.Inc()
-		return -1, fmt.Errorf("could not read response body: %w", err)
+		return errs.New(component, errs.Validation, fmt.Errorf("could not create request: %w", err))
 	}
 
-	var data Entity
-	if err := json.Unmarshal(body, &data); err != nil {
+	resp, err := c.do(req)
+	if err != nil {
 		hassRequestsErrorsTotal.Inc()
-		return -1, fmt.Errorf("could not parse received data: %w", err)
+		return errs.New(component, errs.Transport, fmt.Errorf("could not get data from Home Assistant: %w", err))
 	}
+	defer resp.Body.Close()
 
-	// Special case for handling boolean values
-	switch data.State {
-	case "on":
-		return 1, nil
-	case "off":
-		return 0, nil
+	if err := errs.CheckResponse(resp); err != nil {
+		hassRequestsErrorsTotal.Inc()
+		return errs.New(component, errs.Transport, fmt.Errorf("could not get %s from Home Assistant: %w", path, err))
 	}
 
-	data.Value, err = strconv.ParseFloat(data.State, 64)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		hassRequestsErrorsTotal.Inc()
-		return -1, fmt.Errorf("could not convert value to float64: %w", err)
+		return errs.New(component, errs.Transport, fmt.Errorf("could not read response body: %w", err))
 	}
 
-	return data.Value, nil
+	if err := json.Unmarshal(body, v); err != nil {
+		hassRequestsErrorsTotal.Inc()
+		return errs.New(component, errs.Parse, fmt.Errorf("could not parse received data: %w", err))
+	}
+
+	return nil
 }
@@ -0,0 +1,138 @@
+package homeassistant
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SourceSchedule marks setting values taken from a weekly schedule.
+const SourceSchedule = "schedule"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// SchedulePeriod sets value of a setting between From and To, given as local "15:04", on listed days. Period with To
+// before From spans midnight and belongs to the day it starts on. No days means every day.
+type SchedulePeriod struct {
+	Days  []string `json:"days,omitempty" yaml:"days,omitempty"`
+	From  string   `json:"from" yaml:"from"`
+	To    string   `json:"to" yaml:"to"`
+	Value float64  `json:"value" yaml:"value"`
+}
+
+// Schedule changes value of a setting during the week. While Home Assistant schedule helper EntityID is on, On value
+// is used. Otherwise the first period covering current time sets the value. Outside of them, the setting keeps its
+// value from Home Assistant.
+type Schedule struct {
+	EntityID string           `json:"entity_id,omitempty" yaml:"entity_id,omitempty"`
+	On       float64          `json:"on,omitempty" yaml:"on,omitempty"`
+	Periods  []SchedulePeriod `json:"periods,omitempty" yaml:"periods,omitempty"`
+}
+
+// Empty reports if schedule has nothing to apply.
+func (s Schedule) Empty() bool {
+	return s.EntityID == "" && len(s.Periods) == 0
+}
+
+// Validate checks days and times of all periods and that scheduled values are within bounds.
+func (s Schedule) Validate(b Bounds) error {
+	inBounds := func(v float64) bool { return v >= b.Min && v <= b.Max }
+	if s.EntityID != "" && !inBounds(s.On) {
+		return fmt.Errorf("value %g is outside of [%g, %g]", s.On, b.Min, b.Max)
+	}
+	for i, p := range s.Periods {
+		if _, err := clockMinutes(p.From); err != nil {
+			return fmt.Errorf("period %d: %w", i+1, err)
+		}
+		if _, err := clockMinutes(p.To); err != nil {
+			return fmt.Errorf("period %d: %w", i+1, err)
+		}
+		for _, d := range p.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok {
+				return fmt.Errorf("period %d: unknown day %s, use mon, tue, ...", i+1, d)
+			}
+		}
+		if !inBounds(p.Value) {
+			return fmt.Errorf("period %d: value %g is outside of [%g, %g]", i+1, p.Value, b.Min, b.Max)
+		}
+	}
+	return nil
+}
+
+// valueAt returns value scheduled at t, given if schedule helper entity is on.
+func (s Schedule) valueAt(t time.Time, entityOn bool) (float64, bool) {
+	if s.EntityID != "" && entityOn {
+		return s.On, true
+	}
+	for _, p := range s.Periods {
+		if p.covers(t) {
+			return p.Value, true
+		}
+	}
+	return 0, false
+}
+
+func (p SchedulePeriod) covers(t time.Time) bool {
+	from, _ := clockMinutes(p.From)
+	to, _ := clockMinutes(p.To)
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if from <= to {
+		return now >= from && now < to && p.onDay(day)
+	}
+	// Period spanning midnight
+	if now >= from {
+		return p.onDay(day)
+	}
+	return now < to && p.onDay((day+6)%7)
+}
+
+func (p SchedulePeriod) onDay(day time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+	for _, d := range p.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// clockMinutes converts "15:04" to minutes since midnight.
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// SetSchedule applies weekly schedule to named setting. Values of an active operating profile take precedence.
+func (c *Client) SetSchedule(name string, schedule Schedule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.schedules == nil {
+		c.schedules = make(map[string]Schedule)
+	}
+	c.schedules[name] = schedule
+}
+
+// updateSchedules follows state of schedule helper entities.
+func (c *Client) updateSchedules(states map[string]state) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, schedule := range c.schedules {
+		if schedule.EntityID == "" {
+			continue
+		}
+		if c.scheduleOn == nil {
+			c.scheduleOn = make(map[string]bool)
+		}
+		data, ok := states[schedule.EntityID]
+		c.scheduleOn[name] = ok && data.State == "on"
+	}
+}
@@ -0,0 +1,120 @@
+package homeassistant
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/automatedhome/solar/pkg/errs"
+)
+
+// state is an entity state object returned by Home Assistant REST API.
+type state struct {
+	EntityID   string                 `json:"entity_id"`
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// ErrNotAvailable is returned for entities whose state is unavailable or unknown, e.g. while their integration
+// is starting.
+var ErrNotAvailable = errors.New("entity is not available")
+
+// ErrUnknownEntity is returned when refreshing an entity which no setting is taken from.
+var ErrUnknownEntity = errors.New("entity is not used by any setting")
+
+// targetTemperature is a path of target temperature in climate and water_heater state objects.
+const targetTemperature = "attributes/temperature"
+
+// splitEntity separates entity ID from an optional path into its state object, e.g.
+// "climate.boiler/attributes/temperature". Path is empty for plain entity IDs, meaning the state itself. Climate and
+// water heater entities default to their target temperature, as their state is an operation mode.
+func splitEntity(entity string) (id, path string) {
+	parts := strings.SplitN(entity, "/", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	if hasTargetTemperature(parts[0]) {
+		return parts[0], targetTemperature
+	}
+	return parts[0], ""
+}
+
+// hasTargetTemperature reports if entity belongs to a domain with target temperature attribute.
+func hasTargetTemperature(entityID string) bool {
+	switch strings.SplitN(entityID, ".", 2)[0] {
+	case "climate", "water_heater":
+		return true
+	}
+	return false
+}
+
+// lookup returns value under slash separated path in the state object. Empty path selects the state.
+func (s state) lookup(path string) (interface{}, error) {
+	if path == "" || path == "state" {
+		return s.State, nil
+	}
+
+	var current interface{} = map[string]interface{}{
+		"entity_id":  s.EntityID,
+		"state":      s.State,
+		"attributes": s.Attributes,
+	}
+	for _, key := range strings.Split(path, "/") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s of %s is not an object", key, s.EntityID)
+		}
+		if current, ok = object[key]; !ok {
+			return nil, fmt.Errorf("%s does not have %s", s.EntityID, path)
+		}
+	}
+	return current, nil
+}
+
+// parseValue converts value under path in the state object to a number. Entity which is unavailable or unknown has
+// no attributes, so it is reported as not available whatever the path is.
+func parseValue(s state, path string) (float64, error) {
+	switch s.State {
+	case "unavailable", "unknown":
+		return -1, errs.New(component, errs.Validation, fmt.Errorf("%s is %s: %w", s.EntityID, s.State, ErrNotAvailable))
+	}
+
+	value, err := s.lookup(path)
+	if err != nil {
+		hassRequestsErrorsTotal.Inc()
+		return -1, errs.New(component, errs.Validation, err)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return -1, errs.New(component, errs.Validation, fmt.Errorf("%s of %s is not set: %w", path, s.EntityID, ErrNotAvailable))
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		// Special case for handling boolean values
+		switch v {
+		case "on":
+			return 1, nil
+		case "off":
+			return 0, nil
+		case "unavailable", "unknown":
+			return -1, errs.New(component, errs.Validation, fmt.Errorf("%s of %s is %s: %w", path, s.EntityID, v, ErrNotAvailable))
+		}
+
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			hassRequestsErrorsTotal.Inc()
+			return -1, errs.New(component, errs.Validation, fmt.Errorf("could not convert value to float64: %w", err))
+		}
+		return f, nil
+	default:
+		hassRequestsErrorsTotal.Inc()
+		return -1, errs.New(component, errs.Validation, fmt.Errorf("%s of %s is not a number", path, s.EntityID))
+	}
+}
@@ -0,0 +1,178 @@
+package homeassistant
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/automatedhome/solar/pkg/errs"
+)
+
+// SetSettings applies new values of settings identified by their configuration name (e.g. "solarOn" or
+// "flow.dutyMin") and writes them back to the corresponding Home Assistant entities, which stay the source of truth.
+// Source describes who requested the change and is recorded in settings history.
+func (c *Client) SetSettings(values map[string]float64, source string) error {
+	before := c.GetSettings()
+	defer c.recordChanges(before, source)
+
+	for name := range values {
+		entity, ok := before.entities()[name]
+		if !ok {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+		if entity.EntityID == "" {
+			return fmt.Errorf("setting %s is not bound to any entity", name)
+		}
+		if err := c.CheckBounds(name, values[name]); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range values {
+		entityID := before.entities()[name].EntityID
+		if err := c.writeEntityValue(entityID, value); err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.Settings.entities()[name].Value = value
+		c.mu.Unlock()
+
+		log.Printf("Setting %s (%s) changed to %f by %s", name, entityID, value, source)
+	}
+	return nil
+}
+
+// writeEntityValue calls Home Assistant service appropriate for entity domain to change its state.
+func (c *Client) writeEntityValue(entity string, value float64) error {
+	entityID, path := splitEntity(entity)
+	domain := strings.SplitN(entityID, ".", 2)[0]
+	if hasTargetTemperature(entityID) && path == targetTemperature {
+		return c.callService(domain, "set_temperature", map[string]interface{}{"entity_id": entityID, "temperature": value})
+	}
+	if path != "" {
+		return errs.New(component, errs.Validation, fmt.Errorf("writing to %s of %s is not supported", path, entityID))
+	}
+
+	var service string
+	data := map[string]interface{}{"entity_id": entityID}
+	switch domain {
+	case "input_boolean", "switch":
+		service = "turn_off"
+		if value != 0 {
+			service = "turn_on"
+		}
+	case "input_number", "number":
+		service = "set_value"
+		data["value"] = value
+	default:
+		return errs.New(component, errs.Validation, fmt.Errorf("writing to %s entities is not supported", domain))
+	}
+
+	return c.callService(domain, service, data)
+}
+
+// SetSwitch turns input_boolean or switch entity on or off.
+func (c *Client) SetSwitch(entityID string, on bool) error {
+	value := 0.0
+	if on {
+		value = 1
+	}
+	return c.writeEntityValue(entityID, value)
+}
+
+// SelectOption selects option of an input_select entity.
+func (c *Client) SelectOption(entityID, option string) error {
+	return c.callService("input_select", "select_option", map[string]interface{}{"entity_id": entityID, "option": option})
+}
+
+// Notify sends a message through notify service, e.g. "notify.mobile_app_phone".
+func (c *Client) Notify(service, title, message string) error {
+	parts := strings.SplitN(service, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid notify service %q", service)
+	}
+	return c.callService(parts[0], parts[1], map[string]interface{}{"title": title, "message": message})
+}
+
+func (c *Client) callService(domain, service string, data map[string]interface{}) error {
+	if err := c.post(fmt.Sprintf("services/%s/%s", domain, service), data); err != nil {
+		return fmt.Errorf("could not call Home Assistant service %s.%s: %w", domain, service, err)
+	}
+	return nil
+}
+
+// FireEvent fires an event on Home Assistant event bus, so it can trigger automations.
+func (c *Client) FireEvent(eventType string, data map[string]interface{}) error {
+	if err := c.post("events/"+eventType, data); err != nil {
+		return fmt.Errorf("could not fire Home Assistant event %s: %w", eventType, err)
+	}
+	return nil
+}
+
+// post sends JSON payload to Home Assistant REST API path.
+func (c *Client) post(path string, data map[string]interface{}) error {
+	address := fmt.Sprintf("http://%s/api/%s", c.Address, path)
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("could not encode payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", address, bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return errs.New(component, errs.Transport, err)
+	}
+	defer resp.Body.Close()
+
+	if err := errs.CheckResponse(resp); err != nil {
+		return errs.New(component, errs.Transport, err)
+	}
+
+	return nil
+}
+
+// HandleSettingsAPI exposes settings on GET and applies a JSON object of setting names and values on PATCH.
+func (c *Client) HandleSettingsAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		c.ExposeSettingsOnHTTP(w, r)
+	case http.MethodPatch:
+		var patch map[string]float64
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		settings := c.GetSettings()
+		for name, value := range patch {
+			if _, ok := settings.entities()[name]; !ok {
+				http.Error(w, fmt.Sprintf("unknown setting %s", name), http.StatusBadRequest)
+				return
+			}
+			if err := c.CheckBounds(name, value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := c.SetSettings(patch, "api"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		c.ExposeSettingsOnHTTP(w, r)
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
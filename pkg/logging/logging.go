@@ -0,0 +1,154 @@
+// Package logging adds a debug verbosity level on top of the standard logger. Messages logged with log package are
+// always printed, Debugf messages only while debug level is set. Level can be raised at runtime for a limited time,
+// so a live controller can be diagnosed without restarting it and losing the faulty state.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Verbosity levels.
+const (
+	LevelInfo  = "info"
+	LevelDebug = "debug"
+)
+
+var (
+	debug int32
+
+	mu       sync.Mutex
+	revertAt time.Time
+	timer    *time.Timer
+	// generation tells apart timers of earlier SetLevel calls which fired while level was being changed.
+	generation int
+)
+
+// SetLevel switches verbosity. Non-zero duration switches it back to info level once it elapses.
+func SetLevel(level string, duration time.Duration) error {
+	var v int32
+	switch level {
+	case LevelInfo:
+	case LevelDebug:
+		v = 1
+	default:
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if duration < 0 {
+		return fmt.Errorf("duration can't be negative")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if timer != nil {
+		timer.Stop()
+		timer = nil
+	}
+	generation++
+	revertAt = time.Time{}
+	if duration > 0 {
+		gen := generation
+		revertAt = time.Now().Add(duration)
+		timer = time.AfterFunc(duration, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if gen != generation {
+				return
+			}
+			log.Printf("Log level %s expired, switching back to %s", level, LevelInfo)
+			atomic.StoreInt32(&debug, 0)
+			revertAt, timer = time.Time{}, nil
+		})
+	}
+	atomic.StoreInt32(&debug, v)
+	return nil
+}
+
+// Level returns current verbosity.
+func Level() string {
+	if atomic.LoadInt32(&debug) == 1 {
+		return LevelDebug
+	}
+	return LevelInfo
+}
+
+// Debugf logs a message only at debug level.
+func Debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&debug) == 0 {
+		return
+	}
+	if err := log.Output(2, "DEBUG: "+fmt.Sprintf(format, v...)); err != nil {
+		fmt.Println(err)
+	}
+}
+
+type levelRequest struct {
+	Level string `json:"level"`
+	// Duration after which level reverts to info, e.g. "15m". Empty keeps the level until changed.
+	Duration string `json:"duration,omitempty"`
+}
+
+type levelResponse struct {
+	Level    string `json:"level"`
+	RevertAt int64  `json:"revertAt,omitempty"`
+}
+
+// HandleHTTP shows verbosity on GET and changes it on PUT with {"level": "debug", "duration": "15m"}.
+func HandleHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req levelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(req.Duration); err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := SetLevel(req.Level, duration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Log level set to %s for %s", req.Level, durationText(duration))
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mu.Lock()
+	resp := levelResponse{Level: Level()}
+	if !revertAt.IsZero() {
+		resp.RevertAt = revertAt.Unix()
+	}
+	mu.Unlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func durationText(d time.Duration) string {
+	if d == 0 {
+		return "unlimited time"
+	}
+	return d.String()
+}
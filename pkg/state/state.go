@@ -0,0 +1,125 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store keeps controller state which needs to survive process restarts. Values are kept in memory and written
+// to a JSON file on Save.
+type Store struct {
+	path string
+	mu   sync.Mutex
+	data map[string]json.RawMessage
+}
+
+// NewStore creates a store backed by a file at path and loads its content if the file exists. Empty path
+// creates an in-memory store.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		data: make(map[string]json.RawMessage),
+	}
+
+	if path == "" {
+		log.Println("State file not set, controller state will not be persisted")
+		return s, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("State file %s does not exist, starting with empty state", path)
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &s.data); err != nil {
+		return nil, fmt.Errorf("could not parse state file: %w", err)
+	}
+
+	return s, nil
+}
+
+// Get decodes value stored under key into v. It returns false if there is no such key.
+func (s *Store) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, ok := s.data[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, fmt.Errorf("could not decode state key %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// Set stores v under key. Value is written to disk on the next Save.
+func (s *Store) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not encode state key %s: %w", key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = raw
+	return nil
+}
+
+// Export returns the state in the format of state file.
+func (s *Store) Export() ([]byte, error) {
+	s.mu.Lock()
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("could not encode state: %w", err)
+	}
+	return content, nil
+}
+
+// Restore replaces the state with exported content and saves it.
+func (s *Store) Restore(content []byte) error {
+	data := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &data); err != nil {
+		return fmt.Errorf("could not parse state: %w", err)
+	}
+
+	s.mu.Lock()
+	s.data = data
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// Save atomically writes the state to its file.
+func (s *Store) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	content, err := s.Export()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("could not create state directory: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("could not write state file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("could not replace state file: %w", err)
+	}
+	return nil
+}